@@ -0,0 +1,378 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/capture"
+	"github.com/d0ugal/mqtt-exporter/internal/collectors"
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/mapping"
+	"github.com/d0ugal/mqtt-exporter/internal/mappingtest"
+	promexporter_config "github.com/d0ugal/promexporter/config"
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// commands are the subcommands run instead of the exporter, such as
+// "mqtt-exporter validate -config config.yaml". Each returns the exit code.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"validate":     runValidate,
+	"print-config": runPrintConfig,
+	"test-mapping": runTestMapping,
+	"replay":       runReplay,
+}
+
+// resolveConfigPath falls back to CONFIG_PATH when -config was not given
+func resolveConfigPath(path string) string {
+	if path == "config.yaml" {
+		if envConfig := os.Getenv("CONFIG_PATH"); envConfig != "" {
+			return envConfig
+		}
+	}
+
+	return path
+}
+
+// newFlagSet creates the flags of a subcommand, which all take -config
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("mqtt-exporter "+name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	configPath := flags.String("config", "config.yaml", "Path to configuration file")
+
+	return flags, configPath
+}
+
+// runValidate checks a configuration file the way the exporter would load
+// it, and lists every problem found rather than stopping at the first
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags, configPath := newFlagSet("validate", stderr)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := resolveConfigPath(*configPath)
+
+	// The exporter runs without a file, but a missing file here is a typo
+	if _, err := os.Stat(path); err != nil {
+		_, _ = fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	cfg, err := config.Parse(path)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	errs := splitErrors(cfg.Validate())
+
+	mappings, err := mapping.Compile(cfg.MQTT.Mappings)
+	errs = append(errs, splitErrors(err)...)
+
+	if len(errs) > 0 {
+		_, _ = fmt.Fprintf(stderr, "%s: %d problems found:\n", path, len(errs))
+
+		for _, err := range errs {
+			_, _ = fmt.Fprintf(stderr, "  - %v\n", err)
+		}
+
+		return 1
+	}
+
+	_, _ = fmt.Fprintf(stdout, "%s: configuration is valid (%d topics, %d mappings, %d heartbeats)\n",
+		path, len(cfg.MQTT.Topics), mappings.Len(), len(cfg.MQTT.Heartbeats))
+
+	return 0
+}
+
+// runPrintConfig prints the effective configuration, after environment
+// variables and defaults are applied, with secrets redacted
+func runPrintConfig(args []string, stdout, stderr io.Writer) int {
+	flags, configPath := newFlagSet("print-config", stderr)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(resolveConfigPath(*configPath))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	out, err := config.Marshal(cfg)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Failed to encode configuration: %v\n", err)
+		return 1
+	}
+
+	_, _ = stdout.Write(out)
+
+	return 0
+}
+
+// runTestMapping runs the mapping test cases in fixtures files against a
+// configuration, like promtool test rules:
+//
+//	mqtt-exporter test-mapping -config config.yaml fixtures.yaml...
+func runTestMapping(args []string, stdout, stderr io.Writer) int {
+	flags, configPath := newFlagSet("test-mapping", stderr)
+	verbose := flags.Bool("v", false, "Print the resulting metrics of passing tests too")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		_, _ = fmt.Fprintln(stderr, "usage: mqtt-exporter test-mapping -config config.yaml fixtures.yaml...")
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(resolveConfigPath(*configPath))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	// Every test case builds an application, which would log its routes
+	gin.SetMode(gin.ReleaseMode)
+
+	passed, failed := 0, 0
+
+	for _, path := range flags.Args() {
+		fixtures, err := mappingtest.LoadFixtures(path)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+
+		_, _ = fmt.Fprintln(stdout, path)
+
+		for _, c := range fixtures.Tests {
+			result, err := mappingtest.Run(cfg, c)
+			if err != nil {
+				_, _ = fmt.Fprintf(stderr, "%s: %s: %v\n", path, c.Name, err)
+				return 1
+			}
+
+			if len(result.Problems) == 0 {
+				passed++
+
+				_, _ = fmt.Fprintf(stdout, "  PASS %s\n", c.Name)
+			} else {
+				failed++
+
+				_, _ = fmt.Fprintf(stdout, "  FAIL %s\n", c.Name)
+
+				for _, problem := range result.Problems {
+					_, _ = fmt.Fprintf(stdout, "    %s\n", problem)
+				}
+			}
+
+			if len(result.Problems) > 0 || *verbose {
+				_, _ = fmt.Fprintln(stdout, "    metrics:")
+
+				for line := range strings.Lines(result.Exposition) {
+					_, _ = fmt.Fprintf(stdout, "      %s", line)
+				}
+			}
+		}
+	}
+
+	_, _ = fmt.Fprintf(stdout, "%d passed, %d failed\n", passed, failed)
+
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runReplay feeds a capture recorded with mqtt.record through the message
+// pipeline and reports the throughput and the series each metric ended up
+// with:
+//
+//	mqtt-exporter replay -config config.yaml [-speed 1] capture.jsonl.gz
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	flags, configPath := newFlagSet("replay", stderr)
+	speed := flags.Float64("speed", 0, "Replay speed relative to the recording, 0 replays as fast as possible")
+	metricsPath := flags.String("metrics", "", "Write the resulting metrics to this file, - for standard output")
+	top := flags.Int("top", 10, "Number of metrics with the most series to list")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 || *speed < 0 {
+		_, _ = fmt.Fprintln(stderr, "usage: mqtt-exporter replay -config config.yaml [-speed 1] capture.jsonl.gz")
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(resolveConfigPath(*configPath))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	// Replays run offline: no traces, and no per-message debug logs slowing
+	// them down. Warnings go to stderr to keep them out of the report.
+	cfg.Tracing = promexporter_config.TracingConfig{}
+
+	logOptions := &slog.HandlerOptions{Level: slog.LevelWarn}
+
+	var logHandler slog.Handler = slog.NewJSONHandler(stderr, logOptions)
+	if strings.EqualFold(cfg.Logging.Format, "text") {
+		logHandler = slog.NewTextHandler(stderr, logOptions)
+	}
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(logHandler))
+
+	gin.SetMode(gin.ReleaseMode)
+
+	reader, err := capture.Open(flags.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	defer func() { _ = reader.Close() }()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	collector, registry := collectors.NewOfflineCollector(cfg)
+	defer collector.Stop()
+
+	started := time.Now()
+	replayed, err := collector.Replay(ctx, reader, *speed)
+	elapsed := time.Since(started)
+
+	_, _ = fmt.Fprintf(stdout, "Replayed %d messages from %s in %s (%.0f messages/s)\n",
+		replayed, flags.Arg(0), elapsed.Round(time.Millisecond), float64(replayed)/elapsed.Seconds())
+
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Replay stopped early: %v\n", err)
+	}
+
+	families, gatherErr := registry.Gather()
+	if gatherErr != nil {
+		_, _ = fmt.Fprintf(stderr, "Failed to gather metrics: %v\n", gatherErr)
+		return 1
+	}
+
+	printSeries(stdout, families, *top)
+
+	if *metricsPath != "" {
+		if err := writeMetrics(*metricsPath, stdout, families); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Failed to write metrics: %v\n", err)
+			return 1
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// printSeries lists the exporter metrics with the most series, which is
+// where a cardinality problem shows up
+func printSeries(w io.Writer, families []*dto.MetricFamily, top int) {
+	type familySeries struct {
+		name   string
+		series int
+	}
+
+	var (
+		counts []familySeries
+		total  int
+	)
+
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "mqtt_") {
+			continue
+		}
+
+		series := 0
+
+		for _, metric := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_HISTOGRAM:
+				// Every bucket, +Inf, _sum and _count
+				series += len(metric.GetHistogram().GetBucket()) + 3
+			case dto.MetricType_SUMMARY:
+				series += len(metric.GetSummary().GetQuantile()) + 2
+			default:
+				series++
+			}
+		}
+
+		counts = append(counts, familySeries{name: family.GetName(), series: series})
+		total += series
+	}
+
+	slices.SortFunc(counts, func(a, b familySeries) int {
+		return cmp.Or(cmp.Compare(b.series, a.series), strings.Compare(a.name, b.name))
+	})
+
+	_, _ = fmt.Fprintf(w, "%d series in %d metrics, most series:\n", total, len(counts))
+
+	for _, count := range counts[:min(top, len(counts))] {
+		_, _ = fmt.Fprintf(w, "  %8d  %s\n", count.series, count.name)
+	}
+}
+
+// writeMetrics writes metric families in the text exposition format to path,
+// or to stdout for -
+func writeMetrics(path string, stdout io.Writer, families []*dto.MetricFamily) error {
+	if path == "-" {
+		return encodeMetrics(stdout, families)
+	}
+
+	file, err := os.Create(path) //nolint:gosec // G304: the path is given on the command line
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(encodeMetrics(file, families), file.Close())
+}
+
+func encodeMetrics(w io.Writer, families []*dto.MetricFamily) error {
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitErrors returns the errors joined in err with errors.Join
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		return joined.Unwrap()
+	}
+
+	return []error{err}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/capture"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestRunValidate(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	code := runValidate([]string{"-config", "../config.example.yaml"}, &stdout, &stderr)
+	assert.Equal(t, 0, code, stderr.String())
+	assert.Contains(t, stdout.String(), "configuration is valid")
+
+	path := writeConfig(t, `
+mqtt:
+  broker: "localhost:1883"
+  qos: 3
+  mappings:
+    - name: climate
+      topic: "sensor/+/climate"
+      fields: ["battery..level"]
+      timestamp:
+        field: "ts"
+        format: "sometimes"
+`)
+
+	stdout.Reset()
+	stderr.Reset()
+
+	code = runValidate([]string{"-config", path}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Empty(t, stdout.String())
+	assert.Contains(t, stderr.String(), "3 problems found")
+	assert.Contains(t, stderr.String(), "mqtt qos must be between 0 and 2, got 3")
+	assert.Contains(t, stderr.String(), "invalid timestamp format: sometimes")
+	assert.Contains(t, stderr.String(), `field path "battery..level" has an empty segment`)
+
+	stderr.Reset()
+
+	code = runValidate([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr.String(), "no such file or directory")
+}
+
+func TestRunPrintConfig(t *testing.T) {
+	t.Setenv("MQTT_EXPORTER_MQTT_CLIENT_ID", "from-env")
+
+	path := writeConfig(t, `
+mqtt:
+  broker: "localhost:1883"
+  password: "supersecretmqttpw"
+`)
+
+	var stdout, stderr bytes.Buffer
+
+	code := runPrintConfig([]string{"-config", path}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+
+	assert.Contains(t, stdout.String(), "client_id: from-env")
+	assert.Contains(t, stdout.String(), "password: '[REDACTED]'")
+	assert.Contains(t, stdout.String(), "overflow: block")
+	assert.NotContains(t, stdout.String(), "supersecretmqttpw")
+}
+
+func TestRunTestMapping(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	code := runTestMapping([]string{"-config", "../config.example.yaml", "../mapping-tests.example.yaml"}, &stdout, &stderr)
+	assert.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Contains(t, stdout.String(), "3 passed, 0 failed")
+
+	fixtures := writeConfig(t, `
+tests:
+  - name: wrong temperature
+    topic: "sensor/hall/climate"
+    payload: '{"temperature": 19.5}'
+    expected: |
+      mqtt_payload_value{mapping="climate",topic="sensor/hall/climate",field="temperature"} 20
+`)
+
+	stdout.Reset()
+
+	code = runTestMapping([]string{"-config", "../config.example.yaml", fixtures}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "FAIL wrong temperature")
+	assert.Contains(t, stdout.String(), "got 19.5, want 20")
+	assert.Contains(t, stdout.String(), "0 passed, 1 failed")
+
+	code = runTestMapping([]string{"-config", "../config.example.yaml"}, &stdout, &stderr)
+	assert.Equal(t, 2, code)
+}
+
+func TestRunReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl.gz")
+
+	writer, err := capture.Create(path, 0)
+	require.NoError(t, err)
+
+	for i := range 50 {
+		require.NoError(t, writer.Write(capture.Record{
+			Time:    time.Now(),
+			Topic:   fmt.Sprintf("sensor/%d/climate", i%5),
+			Payload: []byte(`{"temperature": 21.5, "battery": {"level": 90}}`),
+		}))
+	}
+
+	require.NoError(t, writer.Close())
+
+	metricsPath := filepath.Join(t.TempDir(), "metrics.txt")
+
+	var stdout, stderr bytes.Buffer
+
+	code := runReplay([]string{"-config", "../config.example.yaml", "-metrics", metricsPath, path}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+
+	// Only warnings are logged, and not to the report
+	assert.Empty(t, stderr.String())
+	assert.NotContains(t, stdout.String(), `"level"`)
+	assert.Contains(t, stdout.String(), "Replayed 50 messages")
+	assert.Contains(t, stdout.String(), "10  mqtt_payload_value")
+	assert.Contains(t, stdout.String(), "5  mqtt_messages_total")
+
+	exposition, err := os.ReadFile(metricsPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(exposition), `mqtt_messages_total{topic="sensor/3/climate"} 10`)
+
+	code = runReplay([]string{"-config", "../config.example.yaml"}, &stdout, &stderr)
+	assert.Equal(t, 2, code)
+}
@@ -1,21 +1,34 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 
+	"github.com/d0ugal/mqtt-exporter/internal/broker"
+	"github.com/d0ugal/mqtt-exporter/internal/capture"
 	"github.com/d0ugal/mqtt-exporter/internal/collectors"
 	"github.com/d0ugal/mqtt-exporter/internal/config"
 	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	"github.com/d0ugal/mqtt-exporter/internal/reload"
+	"github.com/d0ugal/mqtt-exporter/internal/state"
 	"github.com/d0ugal/mqtt-exporter/internal/version"
+	"github.com/d0ugal/mqtt-exporter/internal/web"
 	"github.com/d0ugal/promexporter/app"
 	"github.com/d0ugal/promexporter/logging"
 	promexporter_metrics "github.com/d0ugal/promexporter/metrics"
 )
 
 func main() {
+	// Run a subcommand instead of the exporter if one was given
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	// Parse command line flags
 	var showVersion bool
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
@@ -34,11 +47,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if configPath == "config.yaml" {
-		if envConfig := os.Getenv("CONFIG_PATH"); envConfig != "" {
-			configPath = envConfig
-		}
-	}
+	configPath = resolveConfigPath(configPath)
 
 	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
@@ -56,7 +65,11 @@ func main() {
 	metricsRegistry := promexporter_metrics.NewRegistry("mqtt_exporter_info")
 
 	// Add custom metrics to the registry
-	mqttRegistry := metrics.NewMQTTRegistry(metricsRegistry)
+	mqttRegistry := metrics.NewMQTTRegistry(metricsRegistry, metrics.Options{
+		MessageQoSLabel: cfg.MQTT.MessageLabels.QoS,
+		MessageDupLabel: cfg.MQTT.MessageLabels.Dup,
+		Replica:         cfg.MQTT.ReplicaLabel(),
+	})
 
 	// Create and run application using promexporter
 	application := app.New("MQTT Exporter").
@@ -65,10 +78,75 @@ func main() {
 		WithVersionInfo(version.Version, version.Commit, version.BuildDate).
 		Build()
 
+	// In embedded broker mode the exporter is the broker and subscribes to
+	// itself; the broker is started before the collector connects to it
+	if cfg.Mode == config.ModeEmbeddedBroker {
+		embeddedBroker, err := broker.New(cfg)
+		if err != nil {
+			slog.Error("Failed to create embedded MQTT broker", "error", err)
+			os.Exit(1)
+		}
+
+		application.WithCollector(embeddedBroker)
+	}
+
 	// Create collector with app reference for tracing
 	mqttCollector := collectors.NewMQTTCollector(cfg, mqttRegistry, application)
+
+	if cfg.MQTT.Record.File != "" {
+		recorder, err := capture.Create(cfg.MQTT.Record.File, cfg.MQTT.Record.MaxMessages)
+		if err != nil {
+			slog.Error("Failed to start recording", "error", err)
+			os.Exit(1)
+		}
+
+		slog.Info("Recording received messages", "file", cfg.MQTT.Record.File, "max_messages", cfg.MQTT.Record.MaxMessages)
+		mqttCollector.SetRecorder(recorder)
+	}
+
+	// Carry the counters and last values over from the previous run
+	if cfg.State.File != "" {
+		snapshot, err := state.Load(cfg.State.File)
+
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			slog.Info("No saved state to restore", "file", cfg.State.File)
+		case err != nil:
+			slog.Error("Failed to restore state, starting from zero", "error", err)
+		default:
+			mqttCollector.Restore(snapshot)
+		}
+	}
+
 	application.WithCollector(mqttCollector)
 
+	// Added after the collector so that the final snapshot is saved once it
+	// has stopped
+	if cfg.State.File != "" {
+		application.WithCollector(state.NewSaver(cfg.State, mqttRegistry, mqttCollector.Snapshot))
+	}
+
+	// Reload the configuration on SIGHUP, POST /-/reload and file changes
+	reloader := reload.New(configPath, cfg, mqttRegistry, mqttCollector.Reload)
+	application.WithCollector(reloader)
+
+	// Serve the exporter's own endpoints on a separate port. /ready is
+	// always served, so that readiness probes work with the defaults.
+	webServer := web.NewServer(cfg)
+	webServer.Handle("/ready", collectors.NewReadinessHandler(mqttCollector))
+
+	if cfg.Web.Enabled {
+		webServer.Handle("/probe", collectors.NewTargetProber(mqttCollector))
+		webServer.Handle("/topics", collectors.NewTopicBrowser(mqttCollector))
+		webServer.Handle("/-/reload", reloader)
+
+		if cfg.Web.Tail.Enabled {
+			webServer.Handle("/tail", collectors.NewTailStreamer(mqttCollector))
+		}
+	}
+
+	application.WithCollector(webServer)
+
 	if err := application.Run(); err != nil {
 		slog.Error("Application failed", "error", err)
 		os.Exit(1)
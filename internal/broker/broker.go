@@ -0,0 +1,96 @@
+// Package broker runs an MQTT broker inside the exporter, for the
+// embedded-broker mode where small sites use the exporter as their broker.
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// Broker is an embedded MQTT broker. It implements app.Collector so that
+// the application starts it before the MQTT collector connects to it and
+// stops it on shutdown.
+type Broker struct {
+	server   *mqtt.Server
+	listener *listeners.TCP
+}
+
+// New creates the broker for cfg.EmbeddedBroker and binds its listener, so
+// that a port already in use fails at startup rather than in the background
+func New(cfg *config.Config) (*Broker, error) {
+	server := mqtt.New(&mqtt.Options{
+		Logger: slog.Default().With("component", "embedded-broker"),
+	})
+
+	hook, hookOptions := newAuthHook(cfg)
+	if err := server.AddHook(hook, hookOptions); err != nil {
+		return nil, fmt.Errorf("failed to configure embedded broker authentication: %w", err)
+	}
+
+	listener := listeners.NewTCP(listeners.Config{
+		ID:      "tcp",
+		Address: cfg.EmbeddedBroker.Address,
+	})
+
+	if err := server.AddListener(listener); err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.EmbeddedBroker.Address, err)
+	}
+
+	return &Broker{
+		server:   server,
+		listener: listener,
+	}, nil
+}
+
+// newAuthHook allows every client when no users are configured, and
+// otherwise builds a user ledger that always lets the exporter in with its
+// own credentials
+func newAuthHook(cfg *config.Config) (mqtt.Hook, any) {
+	if len(cfg.EmbeddedBroker.Users) == 0 {
+		return new(auth.AllowHook), nil
+	}
+
+	users := make(auth.Users, len(cfg.EmbeddedBroker.Users)+1)
+
+	for _, user := range cfg.EmbeddedBroker.Users {
+		users[user.Username] = auth.UserRule{
+			Username: auth.RString(user.Username),
+			Password: auth.RString(user.Password.Value()),
+		}
+	}
+
+	users[cfg.MQTT.Username] = auth.UserRule{
+		Username: auth.RString(cfg.MQTT.Username),
+		Password: auth.RString(cfg.MQTT.Password.Value()),
+	}
+
+	return new(auth.Hook), &auth.Options{Ledger: &auth.Ledger{Users: users}}
+}
+
+// Address returns the address the broker listens on, with the port chosen
+// by the system when the configured port was 0
+func (b *Broker) Address() string {
+	return b.listener.Address()
+}
+
+// Start accepts connections in the background
+func (b *Broker) Start(_ context.Context) {
+	slog.Info("Starting embedded MQTT broker", "address", b.Address())
+
+	if err := b.server.Serve(); err != nil {
+		slog.Error("Embedded MQTT broker failed", "address", b.Address(), "error", err)
+	}
+}
+
+// Stop disconnects every client and closes the listener
+func (b *Broker) Stop() {
+	if err := b.server.Close(); err != nil {
+		slog.Error("Embedded MQTT broker shutdown error", "error", err)
+	}
+}
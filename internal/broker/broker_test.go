@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connect(address, username, password string) error {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker("tcp://" + address)
+	opts.SetClientID("broker-test-" + username)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetConnectTimeout(5 * time.Second)
+
+	client := MQTT.NewClient(opts)
+
+	token := client.Connect()
+	token.Wait()
+
+	if token.Error() == nil {
+		client.Disconnect(0)
+	}
+
+	return token.Error()
+}
+
+// TestBroker_Users checks that configured users and the exporter itself can
+// connect, and that anyone else is rejected.
+func TestBroker_Users(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.EmbeddedBroker.Address = "127.0.0.1:0"
+	cfg.EmbeddedBroker.Users = []config.BrokerUserConfig{
+		{Username: "sensor", Password: config.NewSensitiveString("sensorpw")},
+	}
+	cfg.MQTT.Username = "exporter"
+	cfg.MQTT.Password = config.NewSensitiveString("exporterpw")
+
+	b, err := New(cfg)
+	require.NoError(t, err)
+
+	b.Start(t.Context())
+	defer b.Stop()
+
+	assert.NoError(t, connect(b.Address(), "sensor", "sensorpw"))
+	assert.NoError(t, connect(b.Address(), "exporter", "exporterpw"))
+	assert.Error(t, connect(b.Address(), "sensor", "wrong"))
+	assert.Error(t, connect(b.Address(), "", ""))
+}
+
+// TestBroker_Anonymous checks that any client can connect without users.
+func TestBroker_Anonymous(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.EmbeddedBroker.Address = "127.0.0.1:0"
+
+	b, err := New(cfg)
+	require.NoError(t, err)
+
+	b.Start(t.Context())
+	defer b.Stop()
+
+	assert.NoError(t, connect(b.Address(), "", ""))
+
+	// A second broker cannot take the same port
+	cfg.EmbeddedBroker.Address = b.Address()
+	_, err = New(cfg)
+	assert.ErrorContains(t, err, "failed to listen on "+b.Address())
+}
@@ -0,0 +1,329 @@
+// Package capture reads and writes capture files of received MQTT messages,
+// for recording production traffic and replaying it without a broker. A
+// capture is JSON Lines, gzip compressed when the file name ends in .gz.
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A Writer flushes every flushMessages records, and flushInterval after an
+// unflushed record at the latest, so a capture cut short by the exporter
+// being killed keeps all but its last records
+const (
+	flushMessages = 100
+	flushInterval = time.Second
+)
+
+// ErrFull is returned by Writer.Write once the capture holds its maximum
+// number of messages
+var ErrFull = errors.New("capture is full")
+
+// Record is a captured message
+type Record struct {
+	Time      time.Time
+	Topic     string
+	QoS       byte
+	Retained  bool
+	Duplicate bool
+	Payload   []byte
+}
+
+// NewRecord captures msg as received at receivedAt
+func NewRecord(msg MQTT.Message, receivedAt time.Time) Record {
+	return Record{
+		Time:      receivedAt,
+		Topic:     msg.Topic(),
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Duplicate: msg.Duplicate(),
+		Payload:   msg.Payload(),
+	}
+}
+
+// encodedRecord is a line of a capture file. Payloads are stored as text
+// when they are valid UTF-8, which keeps captures readable with zcat, and
+// base64 encoded otherwise.
+type encodedRecord struct {
+	Time          time.Time `json:"time"`
+	Topic         string    `json:"topic"`
+	QoS           byte      `json:"qos"`
+	Retained      bool      `json:"retained,omitempty"`
+	Duplicate     bool      `json:"duplicate,omitempty"`
+	Payload       *string   `json:"payload,omitempty"`
+	PayloadBase64 []byte    `json:"payload_base64,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (r Record) MarshalJSON() ([]byte, error) {
+	encoded := encodedRecord{
+		Time:      r.Time,
+		Topic:     r.Topic,
+		QoS:       r.QoS,
+		Retained:  r.Retained,
+		Duplicate: r.Duplicate,
+	}
+
+	if utf8.Valid(r.Payload) {
+		payload := string(r.Payload)
+		encoded.Payload = &payload
+	} else {
+		encoded.PayloadBase64 = r.Payload
+	}
+
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var encoded encodedRecord
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	*r = Record{
+		Time:      encoded.Time,
+		Topic:     encoded.Topic,
+		QoS:       encoded.QoS,
+		Retained:  encoded.Retained,
+		Duplicate: encoded.Duplicate,
+		Payload:   encoded.PayloadBase64,
+	}
+
+	if encoded.Payload != nil {
+		r.Payload = []byte(*encoded.Payload)
+	}
+
+	return nil
+}
+
+// Message returns the record as an MQTT.Message
+func (r Record) Message() MQTT.Message {
+	return &message{record: r}
+}
+
+// message implements MQTT.Message for a replayed record
+type message struct {
+	record Record
+}
+
+func (m *message) Duplicate() bool   { return m.record.Duplicate }
+func (m *message) Qos() byte         { return m.record.QoS }
+func (m *message) Retained() bool    { return m.record.Retained }
+func (m *message) Topic() string     { return m.record.Topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.record.Payload }
+func (m *message) Ack()              {}
+
+// Writer appends records to a capture file. It is safe for concurrent use.
+type Writer struct {
+	mu          sync.Mutex
+	file        *os.File
+	buffered    *bufio.Writer
+	compressed  *gzip.Writer
+	encoder     *json.Encoder
+	maxMessages int
+	messages    int
+	unflushed   int
+	flushTimer  *time.Timer
+	err         error
+}
+
+// Create creates or truncates the capture file at path. With maxMessages
+// above zero, Write returns ErrFull once that many messages were written.
+func Create(path string, maxMessages int) (*Writer, error) {
+	file, err := os.Create(path) //nolint:gosec // G304: the capture path comes from the configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	w := &Writer{
+		file:        file,
+		buffered:    bufio.NewWriter(file),
+		maxMessages: maxMessages,
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		w.compressed = gzip.NewWriter(w.buffered)
+		w.encoder = json.NewEncoder(w.compressed)
+	} else {
+		w.encoder = json.NewEncoder(w.buffered)
+	}
+
+	return w, nil
+}
+
+// Write appends a record. After a failure every later Write returns the
+// same error.
+func (w *Writer) Write(record Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.maxMessages > 0 && w.messages >= w.maxMessages {
+		w.err = ErrFull
+		return w.err
+	}
+
+	if err := w.encoder.Encode(record); err != nil {
+		w.err = fmt.Errorf("failed to write capture: %w", err)
+		return w.err
+	}
+
+	w.messages++
+	w.unflushed++
+
+	if w.unflushed >= flushMessages {
+		return w.flush()
+	}
+
+	if w.flushTimer == nil {
+		w.flushTimer = time.AfterFunc(flushInterval, w.flushPending)
+	}
+
+	return nil
+}
+
+// flushPending flushes the records written since the last flush
+func (w *Writer) flushPending() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil || errors.Is(w.err, ErrFull) {
+		_ = w.flush()
+	}
+}
+
+// flush writes the buffered records through to the file, with the lock
+// held. Records are only complete in a compressed capture once the gzip
+// writer is flushed as well.
+func (w *Writer) flush() error {
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+		w.flushTimer = nil
+	}
+
+	if w.unflushed == 0 {
+		return nil
+	}
+
+	w.unflushed = 0
+
+	if w.compressed != nil {
+		if err := w.compressed.Flush(); err != nil {
+			w.err = fmt.Errorf("failed to write capture: %w", err)
+			return w.err
+		}
+	}
+
+	if err := w.buffered.Flush(); err != nil {
+		w.err = fmt.Errorf("failed to write capture: %w", err)
+		return w.err
+	}
+
+	return nil
+}
+
+// Messages returns the number of records written
+func (w *Writer) Messages() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.messages
+}
+
+// Close flushes and closes the capture file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+		w.flushTimer = nil
+	}
+
+	if w.err == nil || errors.Is(w.err, ErrFull) {
+		w.err = os.ErrClosed
+	}
+
+	var errs []error
+
+	if w.compressed != nil {
+		errs = append(errs, w.compressed.Close())
+	}
+
+	errs = append(errs, w.buffered.Flush(), w.file.Close())
+
+	return errors.Join(errs...)
+}
+
+// Reader reads the records of a capture file in order
+type Reader struct {
+	file    *os.File
+	decoder *json.Decoder
+}
+
+// Open opens a capture file, compressed or not
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path) //nolint:gosec // G304: the capture path is given on the command line
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+
+	buffered := bufio.NewReader(file)
+
+	var in io.Reader = buffered
+
+	// gzip streams start with 0x1f 0x8b
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		compressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to open capture file: %w", err)
+		}
+
+		in = compressed
+	}
+
+	return &Reader{
+		file:    file,
+		decoder: json.NewDecoder(in),
+	}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture. A
+// capture cut short, for example because the exporter was killed while
+// recording, ends with io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Record, error) {
+	var record Record
+
+	if err := r.decoder.Decode(&record); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Record{}, io.EOF
+		}
+
+		return Record{}, fmt.Errorf("failed to read capture: %w", err)
+	}
+
+	return record, nil
+}
+
+// Close closes the capture file
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,121 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, path string) ([]Record, error) {
+	t.Helper()
+
+	reader, err := Open(path)
+	require.NoError(t, err)
+
+	defer func() { _ = reader.Close() }()
+
+	var records []Record
+
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+
+		if err != nil {
+			return records, err
+		}
+
+		records = append(records, record)
+	}
+}
+
+// TestCapture_RoundTrip checks that records read back the same from plain
+// and compressed captures, including payloads that are not valid UTF-8.
+func TestCapture_RoundTrip(t *testing.T) {
+	now := time.Now().UTC()
+	records := []Record{
+		{Time: now, Topic: "sensor/a", QoS: 1, Payload: []byte(`{"temperature": 21.5}`)},
+		{Time: now.Add(time.Second), Topic: "sensor/b", Retained: true, Duplicate: true, Payload: []byte{0xff, 0x00, 0x10}},
+		{Time: now.Add(2 * time.Second), Topic: "sensor/c", Payload: []byte{}},
+	}
+
+	for _, name := range []string{"capture.jsonl", "capture.jsonl.gz"} {
+		path := filepath.Join(t.TempDir(), name)
+
+		writer, err := Create(path, 0)
+		require.NoError(t, err)
+
+		for _, record := range records {
+			require.NoError(t, writer.Write(record))
+		}
+
+		require.NoError(t, writer.Close())
+		assert.Equal(t, 3, writer.Messages())
+
+		read, err := readAll(t, path)
+		require.NoError(t, err, name)
+		assert.Equal(t, records, read, name)
+	}
+}
+
+// TestCapture_Limits checks that a full capture stops accepting records and
+// that a capture cut short still reads up to where it stops.
+func TestCapture_Limits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl.gz")
+
+	writer, err := Create(path, 2)
+	require.NoError(t, err)
+
+	record := Record{Time: time.Now(), Topic: "sensor/a", Payload: []byte("1")}
+
+	require.NoError(t, writer.Write(record))
+	require.NoError(t, writer.Write(record))
+	assert.ErrorIs(t, writer.Write(record), ErrFull)
+	require.NoError(t, writer.Close())
+	assert.ErrorIs(t, writer.Write(record), os.ErrClosed)
+
+	read, err := readAll(t, path)
+	require.NoError(t, err)
+	assert.Len(t, read, 2)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data)-10], 0o600))
+
+	_, err = readAll(t, path)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// TestCapture_Flush checks that records reach a compressed capture before it
+// is closed, every flushMessages records and after flushInterval, so that
+// most of a capture survives the exporter being killed.
+func TestCapture_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl.gz")
+
+	writer, err := Create(path, 0)
+	require.NoError(t, err)
+
+	defer func() { _ = writer.Close() }()
+
+	record := Record{Time: time.Now(), Topic: "sensor/a", Payload: []byte("1")}
+
+	for range flushMessages + 1 {
+		require.NoError(t, writer.Write(record))
+	}
+
+	read, err := readAll(t, path)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, read, flushMessages)
+
+	assert.Eventually(t, func() bool {
+		read, _ := readAll(t, path)
+		return len(read) == flushMessages+1
+	}, 5*flushInterval, 50*time.Millisecond)
+}
@@ -0,0 +1,97 @@
+package collectors
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceState is the last known availability of a device
+type deviceState struct {
+	online bool
+}
+
+// availabilityDevice returns the device name for an availability topic: the
+// topic levels matched by the filter's wildcards, or the topic itself when
+// the filter has none
+func availabilityDevice(filter, topicName string) string {
+	if wildcards := topic.Wildcards(filter, topicName); len(wildcards) > 0 {
+		return strings.Join(wildcards, "/")
+	}
+
+	return topicName
+}
+
+// updateAvailability tracks device availability from online/offline status
+// messages. It returns whether the message matched an availability topic.
+func (mc *MQTTCollector) updateAvailability(msg MQTT.Message, receivedAt time.Time) bool {
+	for _, availability := range mc.config.Load().MQTT.Availability {
+		if !topic.Match(availability.Topic, msg.Topic()) {
+			continue
+		}
+
+		var online bool
+
+		switch payload := string(bytes.TrimSpace(msg.Payload())); payload {
+		case availability.Online:
+			online = true
+		case availability.Offline:
+			online = false
+		default:
+			slog.Debug("Ignoring unknown availability payload",
+				"topic", msg.Topic(),
+				"payload", payload,
+			)
+
+			continue
+		}
+
+		mc.setDeviceState(availabilityDevice(availability.Topic, msg.Topic()), online, msg.Retained(), receivedAt)
+
+		return true
+	}
+
+	return false
+}
+
+// setDeviceState records a device's availability and counts state changes
+// as flaps
+func (mc *MQTTCollector) setDeviceState(device string, online, retained bool, receivedAt time.Time) {
+	mc.mu.Lock()
+	state, known := mc.devices[device]
+
+	if !known {
+		state = &deviceState{}
+		mc.devices[device] = state
+	}
+
+	changed := known && state.online != online
+	state.online = online
+	mc.mu.Unlock()
+
+	labels := prometheus.Labels{
+		"device": device,
+	}
+
+	up := float64(0)
+	if online {
+		up = 1
+	}
+
+	mc.metrics.MQTTDeviceUp.With(labels).Set(up)
+
+	if changed {
+		mc.metrics.MQTTDeviceFlaps.With(labels).Inc()
+	}
+
+	// A retained message seen for the first time may have been published
+	// long ago, so it says nothing about when the state last changed.
+	if changed || !known && !retained {
+		mc.metrics.MQTTDeviceLastStateChange.With(labels).Set(float64(receivedAt.Unix()))
+	}
+}
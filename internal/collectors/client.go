@@ -0,0 +1,128 @@
+package collectors
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connectionSettings is what both the collector connection and the target
+// probe need to reach a broker
+type connectionSettings struct {
+	broker         string
+	clientID       string
+	username       string
+	password       string
+	tls            *tls.Config
+	keepAlive      time.Duration
+	connectTimeout time.Duration
+}
+
+// newClientOptions builds the paho options shared by every connection the
+// exporter makes
+func newClientOptions(settings connectionSettings) *MQTT.ClientOptions {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(brokerURL(settings.broker, settings.tls != nil))
+	opts.SetClientID(settings.clientID)
+
+	if settings.username != "" {
+		opts.SetUsername(settings.username)
+		opts.SetPassword(settings.password)
+	}
+
+	if settings.tls != nil {
+		opts.SetTLSConfig(settings.tls)
+	}
+
+	opts.SetKeepAlive(settings.keepAlive)
+	opts.SetConnectTimeout(settings.connectTimeout)
+
+	return opts
+}
+
+// brokerURL adds a scheme to broker addresses given as host:port, using
+// ssl:// when TLS is enabled and tcp:// otherwise
+func brokerURL(broker string, useTLS bool) string {
+	if strings.Contains(broker, "://") {
+		return broker
+	}
+
+	if useTLS {
+		return "ssl://" + broker
+	}
+
+	return "tcp://" + broker
+}
+
+// newTLSConfig builds the TLS configuration for a broker connection, or nil
+// when TLS is disabled. onCertificates, if not nil, is called with the peer
+// certificate chain after every handshake.
+func newTLSConfig(cfg config.TLSConfig, onCertificates func([]*x509.Certificate)) (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // G402: explicitly requested in the configuration
+	}
+
+	if cfg.CAFile != "" {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", cfg.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if onCertificates != nil {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			onCertificates(state.PeerCertificates)
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// newSessionStore returns the paho store for the collector's session, or nil
+// for paho's default in-memory store. The file store gets a directory per
+// client ID, so that exporters sharing a volume keep their sessions apart.
+func newSessionStore(cfg config.MQTTConfig) (MQTT.Store, error) {
+	if cfg.SessionStore != config.SessionStoreFile {
+		return nil, nil
+	}
+
+	dir := filepath.Join(cfg.SessionDir, url.PathEscape(cfg.ConnectClientID()))
+
+	// paho creates the directory too, but only logs when that fails
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	return MQTT.NewFileStore(dir), nil
+}
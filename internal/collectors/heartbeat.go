@@ -0,0 +1,204 @@
+package collectors
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// heartbeat tracks when the topics matching a heartbeat filter last
+// published
+type heartbeat struct {
+	config   config.HeartbeatConfig
+	lastSeen map[string]time.Time
+}
+
+// heartbeatStatus is the silence of one topic at the time of a check
+type heartbeatStatus struct {
+	pattern string
+	topic   string
+	silent  bool
+}
+
+func newHeartbeats(cfgs []config.HeartbeatConfig) []*heartbeat {
+	heartbeats := make([]*heartbeat, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		heartbeats = append(heartbeats, &heartbeat{
+			config:   cfg,
+			lastSeen: make(map[string]time.Time),
+		})
+	}
+
+	return heartbeats
+}
+
+// tracks reports whether the heartbeat tracks topicName: the topic of a
+// filter without wildcards, or one of the expected topics of a wildcard
+// filter. Other topics matching a wildcard filter are not tracked, so that
+// the tracked topics are bounded by the configuration.
+func (h *heartbeat) tracks(topicName string) bool {
+	if !topic.HasWildcards(h.config.Topic) {
+		return topicName == h.config.Topic
+	}
+
+	return slices.Contains(h.config.Expected, topicName)
+}
+
+// statuses reports the silence of every tracked topic. Topics that never
+// published count from started, so an expected topic that never comes up
+// turns silent too.
+func (h *heartbeat) statuses(started, now time.Time) []heartbeatStatus {
+	threshold := h.config.Interval.Duration * time.Duration(h.config.Missed)
+	lastSeen := make(map[string]time.Time, len(h.config.Expected)+1)
+
+	if !topic.HasWildcards(h.config.Topic) {
+		lastSeen[h.config.Topic] = started
+	}
+
+	for _, expected := range h.config.Expected {
+		lastSeen[expected] = started
+	}
+
+	for topicName, seen := range h.lastSeen {
+		if _, ok := lastSeen[topicName]; ok {
+			lastSeen[topicName] = seen
+		}
+	}
+
+	statuses := make([]heartbeatStatus, 0, len(lastSeen))
+	for topicName, seen := range lastSeen {
+		statuses = append(statuses, heartbeatStatus{
+			pattern: h.config.Topic,
+			topic:   topicName,
+			silent:  now.Sub(seen) > threshold,
+		})
+	}
+
+	return statuses
+}
+
+// recordHeartbeat notes a message on topicName for every heartbeat whose
+// filter matches it
+func (mc *MQTTCollector) recordHeartbeat(topicName string, receivedAt time.Time) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for _, h := range mc.heartbeats {
+		if h.tracks(topicName) {
+			h.lastSeen[topicName] = receivedAt
+		}
+	}
+}
+
+// runHeartbeats periodically updates mqtt_topic_silent until the collector
+// stops. The check interval follows the heartbeats, which can change when
+// the configuration is reloaded.
+func (mc *MQTTCollector) runHeartbeats(ctx context.Context) {
+	mc.setHeartbeatIntervals()
+
+	ticker := time.NewTicker(mc.heartbeatCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		mc.checkHeartbeats(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-mc.done:
+			return
+		case <-ticker.C:
+			ticker.Reset(mc.heartbeatCheckInterval())
+		}
+	}
+}
+
+// heartbeatCheckInterval returns half the shortest heartbeat interval,
+// between a second and a minute
+func (mc *MQTTCollector) heartbeatCheckInterval() time.Duration {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	checkInterval := time.Minute
+
+	for _, h := range mc.heartbeats {
+		checkInterval = minDuration(checkInterval, h.config.Interval.Duration/2)
+	}
+
+	return max(checkInterval, time.Second)
+}
+
+// setHeartbeatIntervals replaces mqtt_topic_expected_interval_seconds with
+// the configured heartbeats
+func (mc *MQTTCollector) setHeartbeatIntervals() {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	mc.metrics.MQTTTopicExpectedInterval.Reset()
+
+	for _, h := range mc.heartbeats {
+		mc.metrics.MQTTTopicExpectedInterval.With(prometheus.Labels{
+			"pattern": h.config.Topic,
+		}).Set(h.config.Interval.Duration.Seconds())
+	}
+}
+
+// replaceHeartbeats swaps in the heartbeats of a reloaded configuration,
+// keeping when topics were last seen for the patterns that did not change
+func (mc *MQTTCollector) replaceHeartbeats(cfgs []config.HeartbeatConfig) {
+	heartbeats := newHeartbeats(cfgs)
+
+	mc.mu.Lock()
+
+	for _, h := range heartbeats {
+		for _, previous := range mc.heartbeats {
+			if previous.config.Topic == h.config.Topic {
+				maps.Copy(h.lastSeen, previous.lastSeen)
+			}
+		}
+	}
+
+	mc.heartbeats = heartbeats
+	mc.mu.Unlock()
+
+	// Drop the series of patterns and topics that are no longer tracked
+	mc.metrics.MQTTTopicSilent.Reset()
+	mc.setHeartbeatIntervals()
+	mc.checkHeartbeats(time.Now())
+}
+
+// checkHeartbeats sets mqtt_topic_silent for every tracked topic. A standby
+// receives no messages, so it leaves the checks to the leader.
+func (mc *MQTTCollector) checkHeartbeats(now time.Time) {
+	if mc.standby() {
+		mc.metrics.MQTTTopicSilent.Reset()
+		return
+	}
+
+	mc.mu.RLock()
+
+	var statuses []heartbeatStatus
+	for _, h := range mc.heartbeats {
+		statuses = append(statuses, h.statuses(mc.started, now)...)
+	}
+
+	mc.mu.RUnlock()
+
+	for _, status := range statuses {
+		silent := float64(0)
+		if status.silent {
+			silent = 1
+		}
+
+		mc.metrics.MQTTTopicSilent.With(prometheus.Labels{
+			"pattern": status.pattern,
+			"topic":   status.topic,
+		}).Set(silent)
+	}
+}
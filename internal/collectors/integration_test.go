@@ -0,0 +1,602 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/broker"
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// integrationConfig returns a configuration for running MQTTCollector
+// against an embedded broker on a free loopback port
+func integrationConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+
+	cfg, err := config.Parse("")
+	require.NoError(t, err)
+
+	cfg.Logging.Level = "error"
+	cfg.Mode = config.ModeEmbeddedBroker
+	cfg.EmbeddedBroker.Address = "127.0.0.1:0"
+	cfg.MQTT.ClientID = "mqtt-exporter-test"
+	cfg.MQTT.Topics = []string{"sensor/#"}
+	cfg.MQTT.ConnectTimeout = config.Duration{Duration: 5 * time.Second}
+	cfg.MQTT.Mappings = []config.MappingConfig{
+		{Name: "climate", Topic: "sensor/+/climate", Fields: []string{"temperature"}},
+	}
+
+	return cfg
+}
+
+// startTestBroker starts an embedded broker for cfg and points the exporter
+// at it
+func startTestBroker(t *testing.T, cfg *config.Config) *broker.Broker {
+	t.Helper()
+
+	b, err := broker.New(cfg)
+	require.NoError(t, err)
+
+	b.Start(t.Context())
+
+	cfg.MQTT.Broker = "tcp://" + b.Address()
+
+	return b
+}
+
+// startIntegrationCollector starts a collector and stops it at the end of
+// the test
+func startIntegrationCollector(t *testing.T, cfg *config.Config) *MQTTCollector {
+	t.Helper()
+
+	mc := newTestCollector(t, cfg)
+	mc.Start(t.Context())
+	t.Cleanup(mc.Stop)
+
+	return mc
+}
+
+// publish sends messages to the broker at address as another client
+func publish(t *testing.T, address string, messages ...testMessage) {
+	t.Helper()
+
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker("tcp://" + address)
+	opts.SetClientID("mqtt-exporter-test-publisher")
+
+	client := MQTT.NewClient(opts)
+
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	defer client.Disconnect(250)
+
+	for _, msg := range messages {
+		token := client.Publish(msg.topic, msg.qos, msg.retained, msg.payload)
+		require.True(t, token.WaitTimeout(5*time.Second))
+		require.NoError(t, token.Error())
+	}
+}
+
+func waitReady(t *testing.T, mc *MQTTCollector, timeout time.Duration) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return mc.Readiness().Ready
+	}, timeout, 10*time.Millisecond, "collector did not become ready: %+v", mc.Readiness())
+}
+
+// TestIntegration_Messages checks that the collector connects, subscribes
+// and counts the messages published on the topics it subscribed to.
+func TestIntegration_Messages(t *testing.T) {
+	cfg := integrationConfig(t)
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	mc := startIntegrationCollector(t, cfg)
+	waitReady(t, mc, 5*time.Second)
+
+	status := mc.Readiness()
+	require.Len(t, status.Brokers, 1)
+	assert.Equal(t, []SubscriptionStatus{{Topic: "sensor/#", Subscribed: true}}, status.Brokers[0].Subscriptions)
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTConnectionStatus.With(prometheus.Labels{
+		"broker": cfg.MQTT.Broker,
+	})))
+
+	publish(t, b.Address(),
+		testMessage{topic: "sensor/hall/climate", payload: []byte(`{"temperature": 19.5}`), qos: 1},
+		testMessage{topic: "sensor/hall/climate", payload: []byte(`{"temperature": 20}`), qos: 1},
+		testMessage{topic: "sensor/door", payload: []byte("open"), qos: 1},
+		testMessage{topic: "meter/power", payload: []byte("230"), qos: 1},
+	)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/hall/climate"})) == 2 &&
+			testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/door"})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 2, testutil.CollectAndCount(mc.metrics.MQTTMessageCount, "mqtt_messages_total"),
+		"messages on topics the collector did not subscribe to must not be counted")
+
+	expected := `
+# HELP mqtt_payload_value Last value extracted from the payload by a mapping
+# TYPE mqtt_payload_value gauge
+mqtt_payload_value{field="temperature",mapping="climate",topic="sensor/hall/climate"} 20
+`
+	assert.NoError(t, testutil.CollectAndCompare(mc.metrics.MQTTPayloadValues, strings.NewReader(expected)))
+}
+
+// TestIntegration_Reconnect checks that losing the broker is reported in the
+// metrics and /ready, and that the collector reconnects and subscribes again
+// once the broker is back.
+func TestIntegration_Reconnect(t *testing.T) {
+	cfg := integrationConfig(t)
+	first := startTestBroker(t, cfg)
+
+	mc := startIntegrationCollector(t, cfg)
+	waitReady(t, mc, 5*time.Second)
+
+	first.Stop()
+
+	require.Eventually(t, func() bool {
+		return !mc.Readiness().Ready
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
+			"broker": cfg.MQTT.Broker, "error_type": "connection_lost",
+		})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTReconnectsTotal.With(prometheus.Labels{
+		"broker": cfg.MQTT.Broker,
+	})))
+
+	// Bring the broker back on the same port
+	restarted := *cfg
+	restarted.EmbeddedBroker.Address = first.Address()
+	second := startTestBroker(t, &restarted)
+	defer second.Stop()
+
+	waitReady(t, mc, 15*time.Second)
+
+	publish(t, second.Address(), testMessage{topic: "sensor/door", payload: []byte("closed"), qos: 1})
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/door"})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestIntegration_AuthFailure checks that a rejected connection is counted
+// and shown in /ready, and that the collector connects once a reload fixes
+// the credentials.
+func TestIntegration_AuthFailure(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.EmbeddedBroker.Users = []config.BrokerUserConfig{
+		{Username: "sensor", Password: config.NewSensitiveString("sensor-secret")},
+	}
+	cfg.MQTT.Username = "exporter"
+	cfg.MQTT.Password = config.NewSensitiveString("exporter-secret")
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	wrong := *cfg
+	wrong.MQTT.Password = config.NewSensitiveString("wrong")
+
+	mc := startIntegrationCollector(t, &wrong)
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
+			"broker": cfg.MQTT.Broker, "error_type": "connect",
+		})) >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status := mc.Readiness()
+	assert.False(t, status.Ready)
+	require.Len(t, status.Brokers, 1)
+	assert.False(t, status.Brokers[0].Connected)
+	assert.NotEmpty(t, status.Brokers[0].LastError)
+
+	require.NoError(t, mc.Reload(cfg))
+
+	waitReady(t, mc, 10*time.Second)
+}
+
+// TestIntegration_PersistentSession checks that with a persistent session in
+// the file store, the messages published while the exporter was down are
+// delivered and counted once it is back.
+func TestIntegration_PersistentSession(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.MQTT.ClientID = "mqtt-exporter-billing"
+	cfg.MQTT.QoS = 1
+	cfg.MQTT.CleanSession = false
+	cfg.MQTT.SessionStore = config.SessionStoreFile
+	cfg.MQTT.SessionDir = t.TempDir()
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	first := newTestCollector(t, cfg)
+	first.Start(t.Context())
+	waitReady(t, first, 5*time.Second)
+	first.Stop()
+
+	assert.DirExists(t, filepath.Join(cfg.MQTT.SessionDir, "mqtt-exporter-billing"))
+
+	publish(t, b.Address(),
+		testMessage{topic: "sensor/meter", payload: []byte("1"), qos: 1},
+		testMessage{topic: "sensor/meter", payload: []byte("2"), qos: 1},
+	)
+
+	second := startIntegrationCollector(t, cfg)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(second.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/meter"})) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestIntegration_PersistentSessionUnprocessed checks that with the file
+// session store, messages still waiting for a processing worker when the
+// exporter stops are not acknowledged, so the broker delivers them again.
+func TestIntegration_PersistentSessionUnprocessed(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.MQTT.ClientID = "mqtt-exporter-billing"
+	cfg.MQTT.QoS = 1
+	cfg.MQTT.CleanSession = false
+	cfg.MQTT.SessionStore = config.SessionStoreFile
+	cfg.MQTT.SessionDir = t.TempDir()
+	cfg.MQTT.Processing = config.ProcessingConfig{Workers: 1, QueueSize: 10, Overflow: config.OverflowBlock}
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	// The first exporter's worker hangs on the first message, as if the
+	// exporter crashed before processing them
+	processing := make(chan struct{}, 1)
+	hang := make(chan struct{})
+	defer close(hang)
+
+	first := newTestCollector(t, cfg)
+	first.process = func(queuedMessage) {
+		processing <- struct{}{}
+		<-hang
+	}
+	first.Start(t.Context())
+	waitReady(t, first, 5*time.Second)
+
+	publish(t, b.Address(),
+		testMessage{topic: "sensor/meter", payload: []byte("1"), qos: 1},
+		testMessage{topic: "sensor/meter", payload: []byte("2"), qos: 1},
+	)
+
+	select {
+	case <-processing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	first.Stop()
+
+	second := startIntegrationCollector(t, cfg)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(second.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/meter"})) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestIntegration_SharedSubscription checks that replicas sharing their
+// subscriptions count every message once between them, each under its own
+// replica label.
+func TestIntegration_SharedSubscription(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.MQTT.QoS = 1
+	cfg.MQTT.Shared = config.SharedConfig{Enabled: true, Group: "exporters"}
+	cfg.MQTT.Replica = "a"
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	other := *cfg
+	other.MQTT.Replica = "b"
+
+	replicas := []*MQTTCollector{
+		startIntegrationCollector(t, cfg),
+		startIntegrationCollector(t, &other),
+	}
+
+	for _, mc := range replicas {
+		waitReady(t, mc, 5*time.Second)
+		assert.Equal(t, []SubscriptionStatus{{Topic: "sensor/#", Subscribed: true}}, mc.Readiness().Brokers[0].Subscriptions)
+	}
+
+	messages := make([]testMessage, 20)
+	for i := range messages {
+		messages[i] = testMessage{topic: "sensor/meter", payload: []byte(strconv.Itoa(i)), qos: 1}
+	}
+
+	publish(t, b.Address(), messages...)
+
+	counted := func() []float64 {
+		counts := make([]float64, len(replicas))
+		for i, mc := range replicas {
+			counts[i] = testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/meter"}))
+		}
+
+		return counts
+	}
+
+	assert.Eventually(t, func() bool {
+		counts := counted()
+		return counts[0]+counts[1] == float64(len(messages))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Never(t, func() bool {
+		counts := counted()
+		return counts[0]+counts[1] > float64(len(messages))
+	}, 200*time.Millisecond, 10*time.Millisecond, "messages must not be delivered to more than one replica")
+
+	for i, replica := range []string{"a", "b"} {
+		expected := fmt.Sprintf(`
+# HELP mqtt_messages_total Total number of MQTT messages received
+# TYPE mqtt_messages_total counter
+mqtt_messages_total{replica=%q,topic="sensor/meter"} %g
+`, replica, counted()[i])
+		assert.NoError(t, testutil.GatherAndCompare(replicas[i].metrics.GetRegistry(), strings.NewReader(expected), "mqtt_messages_total"))
+	}
+}
+
+// TestIntegration_LeaderElection checks that only the elected replica
+// subscribes and counts, that the standby is ready, and that the standby
+// takes over when the leader stops. Each replica also publishes its status.
+func TestIntegration_LeaderElection(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.MQTT.CleanSession = true
+	cfg.MQTT.Replica = "a"
+	cfg.MQTT.LeaderElection = config.LeaderElectionConfig{
+		Enabled: true,
+		Topic:   "mqtt-exporter/leader/test",
+		Lease:   config.Duration{Duration: 30 * time.Second},
+	}
+	cfg.MQTT.Status = config.StatusConfig{
+		Enabled: true,
+		Topic:   "mqtt-exporter/status/test-a",
+		Online:  "online",
+		Offline: "offline",
+	}
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	other := *cfg
+	other.MQTT.Replica = "b"
+	other.MQTT.Status.Topic = "mqtt-exporter/status/test-b"
+
+	replicas := []*MQTTCollector{newTestCollector(t, cfg), newTestCollector(t, &other)}
+	for _, mc := range replicas {
+		mc.Start(t.Context())
+	}
+
+	elected := -1
+
+	require.Eventually(t, func() bool {
+		leading := 0
+
+		for i, mc := range replicas {
+			if mc.leading.Load() {
+				elected = i
+				leading++
+			}
+		}
+
+		return leading == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	leader, standby := replicas[elected], replicas[1-elected]
+	defer standby.Stop()
+
+	waitReady(t, leader, 5*time.Second)
+	waitReady(t, standby, 5*time.Second)
+	assert.True(t, standby.Readiness().Brokers[0].Standby)
+
+	labels := prometheus.Labels{"topic": "mqtt-exporter/leader/test"}
+	assert.Equal(t, float64(1), testutil.ToFloat64(leader.metrics.Leader.With(labels)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(standby.metrics.Leader.With(labels)))
+
+	publish(t, b.Address(),
+		testMessage{topic: "sensor/meter", payload: []byte("1"), qos: 1},
+		testMessage{topic: "sensor/meter", payload: []byte("2"), qos: 1},
+	)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(leader.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/meter"})) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, testutil.CollectAndCount(standby.metrics.MQTTMessageCount), "the standby must not count messages")
+
+	leader.Stop()
+
+	require.Eventually(t, standby.leading.Load, 5*time.Second, 10*time.Millisecond, "the standby did not take over")
+	waitReady(t, standby, 5*time.Second)
+	assert.False(t, standby.Readiness().Brokers[0].Standby)
+
+	publish(t, b.Address(), testMessage{topic: "sensor/meter", payload: []byte("3"), qos: 1})
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(standby.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/meter"})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(cfg.MQTT.Broker)
+	opts.SetClientID("mqtt-exporter-test-watcher")
+
+	watcher := MQTT.NewClient(opts)
+
+	token := watcher.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	defer watcher.Disconnect(250)
+
+	var (
+		mu       sync.Mutex
+		statuses = map[string]string{}
+	)
+
+	token = watcher.Subscribe("mqtt-exporter/status/#", 1, func(_ MQTT.Client, msg MQTT.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		statuses[msg.Topic()] = string(msg.Payload())
+	})
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	expected := map[string]string{
+		leader.config.Load().MQTT.Status.Topic:  "offline",
+		standby.config.Load().MQTT.Status.Topic: "online",
+	}
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return maps.Equal(expected, statuses)
+	}, 5*time.Second, 10*time.Millisecond, "retained statuses")
+}
+
+// TestIntegration_Status checks that the collector publishes its retained
+// online status when it connects, a summary every interval, and its offline
+// status when it stops.
+func TestIntegration_Status(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.MQTT.Status = config.StatusConfig{
+		Enabled:         true,
+		Topic:           "mqtt-exporter/status/test",
+		Online:          "online",
+		Offline:         "offline",
+		SummaryTopic:    "mqtt-exporter/status/test/summary",
+		SummaryInterval: config.Duration{Duration: time.Second},
+	}
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(cfg.MQTT.Broker)
+	opts.SetClientID("mqtt-exporter-test-watcher")
+
+	watcher := MQTT.NewClient(opts)
+
+	token := watcher.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	defer watcher.Disconnect(250)
+
+	statuses := make(chan string, 16)
+	summaries := make(chan statusSummary, 16)
+
+	token = watcher.Subscribe("mqtt-exporter/status/#", 1, func(_ MQTT.Client, msg MQTT.Message) {
+		if msg.Topic() == cfg.MQTT.Status.Topic {
+			statuses <- string(msg.Payload())
+			return
+		}
+
+		var summary statusSummary
+		if err := json.Unmarshal(msg.Payload(), &summary); err == nil {
+			summaries <- summary
+		}
+	})
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	mc := newTestCollector(t, cfg)
+	mc.Start(t.Context())
+
+	select {
+	case status := <-statuses:
+		assert.Equal(t, "online", status)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no online status")
+	}
+
+	waitReady(t, mc, 5*time.Second)
+	publish(t, b.Address(), testMessage{topic: "sensor/meter", payload: []byte("1"), qos: 1})
+
+	require.Eventually(t, func() bool {
+		select {
+		case summary := <-summaries:
+			return summary.Topics == 1 && summary.Messages == 1
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond, "no summary with the published message")
+
+	mc.Stop()
+
+	select {
+	case status := <-statuses:
+		assert.Equal(t, "offline", status)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no offline status")
+	}
+}
+
+// TestIntegration_Probe checks that probe messages make the round trip
+// through the broker, and that a probe that doesn't come back in time is
+// counted as lost.
+func TestIntegration_Probe(t *testing.T) {
+	cfg := integrationConfig(t)
+	// The first probe is sent on connect, the next only after the test
+	cfg.Metrics.Collection.DefaultInterval = config.Duration{Duration: time.Minute}
+	cfg.MQTT.Probe = config.ProbeConfig{
+		Enabled: true,
+		Topic:   "mqtt-exporter/probe/test",
+		Timeout: config.Duration{Duration: 500 * time.Millisecond},
+	}
+
+	b := startTestBroker(t, cfg)
+	defer b.Stop()
+
+	mc := startIntegrationCollector(t, cfg)
+	labels := prometheus.Labels{"broker": cfg.MQTT.Broker}
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(mc.metrics.MQTTProbeSuccess.With(labels)) == 1
+	}, 5*time.Second, 10*time.Millisecond, "no probe round trip")
+
+	metric := &dto.Metric{}
+	require.NoError(t, mc.metrics.MQTTProbeRTT.With(labels).(prometheus.Histogram).Write(metric))
+	assert.GreaterOrEqual(t, metric.GetHistogram().GetSampleCount(), uint64(1))
+	assert.Less(t, metric.GetHistogram().GetSampleSum(), cfg.MQTT.Probe.Timeout.Duration.Seconds())
+	assert.Equal(t, float64(0), testutil.ToFloat64(mc.metrics.MQTTProbeLost.With(labels)))
+
+	// A probe whose response never arrives, or arrives for another probe,
+	// times out
+	responses := make(chan probeResponse, 1)
+	responses <- probeResponse{id: 1, receivedAt: time.Now()}
+
+	start := time.Now()
+	mc.probeOnce(t.Context(), mc.client, cfg, 2, responses)
+
+	assert.GreaterOrEqual(t, time.Since(start), cfg.MQTT.Probe.Timeout.Duration)
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTProbeLost.With(labels)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(mc.metrics.MQTTProbeSuccess.With(labels)))
+}
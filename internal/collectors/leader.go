@@ -0,0 +1,305 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// leaderLock is the retained message on the leader election topic. The
+// leader publishes a claim with its client ID as Holder, and replaces it with
+// a release when it stops, or its Will does when it loses its connection.
+type leaderLock struct {
+	Holder   string `json:"holder"`
+	Released bool   `json:"released,omitempty"`
+}
+
+// leaderSettle is how long a replica waits for the retained lock after
+// subscribing to the election topic before it claims a lock nobody holds
+const leaderSettle = time.Second
+
+// election is what a replica knows about the leader lock. The broker delivers
+// the messages on the lock topic to every replica in the same order, so the
+// replicas agree on the holder: the latest claim wins, like the retained
+// lock, and a leader that sees another replica's claim stands down. A
+// standby that claims an expired lock while the leader is still alive thus
+// takes over from it rather than both leading.
+type election struct {
+	self    string
+	holder  string // "" while the lock is free or not known yet
+	renewed time.Time
+}
+
+// observe updates the election with a message on the lock topic and returns
+// whether to publish a claim
+func (e *election) observe(lock leaderLock, now time.Time) bool {
+	switch {
+	case lock.Released && (lock.Holder == e.holder || e.holder == ""):
+		e.holder = ""
+		return true
+	case lock.Released:
+		// A replica that doesn't hold the lock, for example a standby whose
+		// Will was published, replaced the retained claim
+		return e.leader()
+	default:
+		e.holder = lock.Holder
+		e.renewed = now
+
+		return false
+	}
+}
+
+// expire frees the lock when its holder stopped renewing it, for example
+// because the broker restarted and lost its Will, and returns whether to
+// claim it
+func (e *election) expire(now time.Time, lease time.Duration) bool {
+	if e.holder == "" || e.leader() || now.Sub(e.renewed) <= lease {
+		return false
+	}
+
+	e.holder = ""
+
+	return true
+}
+
+// leader reports whether this replica holds the lock
+func (e *election) leader() bool {
+	return e.holder != "" && e.holder == e.self
+}
+
+// leaderRelease returns the message that releases the lock of cfg, which is
+// also the Will of every replica
+func leaderRelease(cfg *config.Config) []byte {
+	payload, _ := json.Marshal(leaderLock{Holder: cfg.MQTT.ConnectClientID(), Released: true})
+	return payload
+}
+
+// startLeaderElection takes part in the leader election for the lifetime of
+// a connection, when it is enabled. The returned function stops it, releasing
+// the lock if the collector holds it.
+func (mc *MQTTCollector) startLeaderElection(ctx context.Context, client MQTT.Client) func() {
+	if !mc.config.Load().MQTT.LeaderElection.Enabled {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		mc.runLeaderElection(ctx, client)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// runLeaderElection follows the lock topic and claims the lock when it is
+// free. The collector subscribes to the topics while it holds the lock and
+// unsubscribes when it loses it.
+func (mc *MQTTCollector) runLeaderElection(ctx context.Context, client MQTT.Client) {
+	// The election settings can't be reloaded, they are kept for the
+	// lifetime of the collector
+	cfg := mc.config.Load()
+	leaderElection := cfg.MQTT.LeaderElection
+	state := &election{self: cfg.MQTT.ConnectClientID()}
+	locks := make(chan leaderLock, 16)
+
+	mc.connection.setStandby(true)
+	mc.metrics.Leader.With(prometheus.Labels{"topic": leaderElection.Topic}).Set(0)
+
+	token := client.Subscribe(leaderElection.Topic, 1, func(_ MQTT.Client, msg MQTT.Message) {
+		var lock leaderLock
+
+		if len(msg.Payload()) == 0 {
+			// An empty message deletes the retained lock, which frees it
+			lock.Released = true
+		} else if err := json.Unmarshal(msg.Payload(), &lock); err != nil {
+			slog.Warn("Ignoring invalid leader lock", "topic", msg.Topic(), "error", err)
+			return
+		}
+
+		// Every message counts, as the latest claim holds the lock. The
+		// election stops reading once it stopped, which must not block paho.
+		select {
+		case locks <- lock:
+		case <-ctx.Done():
+		}
+	})
+	if err := waitToken(token, cfg.MQTT.ConnectTimeout.Duration); err != nil {
+		slog.Error("Failed to subscribe to leader election topic", "topic", leaderElection.Topic, "error", err)
+		mc.reconnect()
+
+		return
+	}
+
+	slog.Info("Joined leader election", "topic", leaderElection.Topic, "replica", cfg.MQTT.Replica)
+
+	defer mc.resign(client)
+
+	settle := time.NewTimer(leaderSettle)
+	defer settle.Stop()
+
+	renew := time.NewTicker(leaderElection.Lease.Duration / 3)
+	defer renew.Stop()
+
+	for {
+		var claim bool
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-settle.C:
+			claim = state.holder == ""
+		case <-renew.C:
+			claim = state.leader() || state.expire(time.Now(), leaderElection.Lease.Duration)
+		case lock := <-locks:
+			claim = state.observe(lock, time.Now())
+		}
+
+		mc.setLeader(ctx, client, state.leader())
+
+		if claim {
+			mc.claimLeadership(client, state.self)
+		}
+	}
+}
+
+// claimLeadership publishes a claim, or renews it when the collector already
+// holds the lock
+func (mc *MQTTCollector) claimLeadership(client MQTT.Client, self string) {
+	select {
+	case <-mc.done:
+		// A stopping collector must not claim the lock it released
+		return
+	default:
+	}
+
+	cfg := mc.config.Load()
+	payload, _ := json.Marshal(leaderLock{Holder: self})
+
+	token := client.Publish(cfg.MQTT.LeaderElection.Topic, 1, true, payload)
+	if err := waitToken(token, cfg.MQTT.ConnectTimeout.Duration); err != nil {
+		slog.Warn("Failed to publish leader claim", "topic", cfg.MQTT.LeaderElection.Topic, "error", err)
+	}
+}
+
+// setLeader subscribes to the topics when the collector was elected and
+// unsubscribes when it lost the lock. The heartbeats of a new leader count
+// from its election, as the standby did not see any message.
+func (mc *MQTTCollector) setLeader(ctx context.Context, client MQTT.Client, leading bool) {
+	if mc.leading.Swap(leading) == leading {
+		return
+	}
+
+	cfg := mc.config.Load()
+	labels := prometheus.Labels{"topic": cfg.MQTT.LeaderElection.Topic}
+
+	if !leading {
+		slog.Warn("Lost leader election, standing by", "topic", cfg.MQTT.LeaderElection.Topic)
+		mc.metrics.Leader.With(labels).Set(0)
+		mc.standDown()
+
+		filters := make([]string, 0, len(cfg.MQTT.Topics))
+		for _, topicName := range cfg.MQTT.Topics {
+			filters = append(filters, cfg.MQTT.SubscriptionFilter(topicName))
+		}
+
+		if err := waitToken(client.Unsubscribe(filters...), cfg.MQTT.ConnectTimeout.Duration); err != nil {
+			slog.Error("Failed to unsubscribe from topics", "topics", cfg.MQTT.Topics, "error", err)
+		}
+
+		return
+	}
+
+	slog.Info("Elected leader", "topic", cfg.MQTT.LeaderElection.Topic, "replica", cfg.MQTT.Replica)
+	mc.metrics.Leader.With(labels).Set(1)
+	mc.connection.setStandby(false)
+
+	mc.mu.Lock()
+	mc.started = time.Now()
+
+	for _, h := range mc.heartbeats {
+		clear(h.lastSeen)
+	}
+	mc.mu.Unlock()
+
+	if err := mc.subscribeToTopics(ctx, cfg.MQTT.Topics); err != nil {
+		slog.Error("Failed to subscribe to topics", "error", err)
+		mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
+			"broker":     cfg.MQTT.Broker,
+			"error_type": "subscribe",
+		}).Inc()
+
+		// Leave the topics to another replica and try again on a new
+		// connection
+		mc.resign(client)
+		mc.reconnect()
+	}
+}
+
+// resign releases the lock if the collector holds it, so that a standby
+// takes over without waiting for the Will. The connection is closed next, so
+// the topics are not unsubscribed from.
+func (mc *MQTTCollector) resign(client MQTT.Client) {
+	if client == nil || !mc.leading.CompareAndSwap(true, false) {
+		return
+	}
+
+	cfg := mc.config.Load()
+	mc.metrics.Leader.With(prometheus.Labels{"topic": cfg.MQTT.LeaderElection.Topic}).Set(0)
+	mc.standDown()
+
+	if !client.IsConnectionOpen() {
+		// The broker publishes the Will instead
+		return
+	}
+
+	token := client.Publish(cfg.MQTT.LeaderElection.Topic, 1, true, leaderRelease(cfg))
+	if err := waitToken(token, cfg.MQTT.ConnectTimeout.Duration); err != nil {
+		slog.Warn("Failed to release leader lock", "topic", cfg.MQTT.LeaderElection.Topic, "error", err)
+		return
+	}
+
+	slog.Info("Released leader lock", "topic", cfg.MQTT.LeaderElection.Topic)
+}
+
+// standDown drops the payload values and heartbeat checks of a former
+// leader, which the new leader reports instead
+func (mc *MQTTCollector) standDown() {
+	mc.connection.setStandby(true)
+	mc.metrics.MQTTPayloadValues.Retain(func(string, string) bool { return false })
+	mc.checkHeartbeats(time.Now())
+}
+
+// standby reports whether the collector is a standby of the leader election,
+// which leaves the topics to the leader
+func (mc *MQTTCollector) standby() bool {
+	return mc.config.Load().MQTT.LeaderElection.Enabled && !mc.leading.Load()
+}
+
+// reconnect makes the connection loop start over with a new connection
+func (mc *MQTTCollector) reconnect() {
+	select {
+	case mc.connectionLost <- struct{}{}:
+	default:
+		// A reconnection is already pending
+	}
+}
+
+// waitToken waits up to timeout for token to complete and returns its error
+func waitToken(token MQTT.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	return token.Error()
+}
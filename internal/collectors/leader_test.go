@@ -0,0 +1,114 @@
+package collectors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestElection delivers the messages on the lock topic to two replicas in
+// the same order, as the broker does, and checks that they agree on a single
+// leader.
+func TestElection(t *testing.T) {
+	now := time.Now()
+	a := &election{self: "a"}
+	b := &election{self: "b"}
+
+	deliver := func(lock leaderLock) (claimA, claimB bool) {
+		return a.observe(lock, now), b.observe(lock, now)
+	}
+
+	// Both claim a free lock and the latest claim wins, without either
+	// answering the other's claim
+	claimA, claimB := deliver(leaderLock{Holder: "a"})
+	assert.False(t, claimA)
+	assert.False(t, claimB)
+	assert.True(t, a.leader())
+	assert.False(t, b.leader())
+
+	claimA, claimB = deliver(leaderLock{Holder: "b"})
+	assert.False(t, claimA)
+	assert.False(t, claimB)
+	assert.False(t, a.leader())
+	assert.True(t, b.leader())
+
+	// The Will of a third replica replaces the retained claim
+	claimA, claimB = deliver(leaderLock{Holder: "c", Released: true})
+	assert.False(t, claimA)
+	assert.True(t, claimB, "the holder must restore the retained lock")
+	assert.True(t, b.leader())
+
+	// The holder releases the lock and the standby takes over
+	claimA, _ = deliver(leaderLock{Holder: "b", Released: true})
+	assert.True(t, claimA)
+	assert.False(t, b.leader())
+
+	deliver(leaderLock{Holder: "a"})
+	assert.True(t, a.leader())
+	assert.Equal(t, "a", b.holder)
+
+	// A lock that is not renewed expires, but never for its holder
+	lease := 30 * time.Second
+	assert.False(t, b.expire(now.Add(lease), lease))
+	assert.False(t, a.expire(now.Add(2*lease), lease))
+	assert.True(t, b.expire(now.Add(2*lease), lease))
+	assert.Empty(t, b.holder)
+
+	// Deleting the retained lock frees it for a replica that doesn't know
+	// the holder
+	c := &election{self: "c"}
+	assert.True(t, c.observe(leaderLock{Released: true}, now))
+}
+
+// TestElection_ExpiredWhileLeaderAlive checks that a standby that expires
+// the lock of a leader that is still alive, for example because it missed
+// the renewals, takes over from it instead of both leading and claiming the
+// lock in turn.
+func TestElection_ExpiredWhileLeaderAlive(t *testing.T) {
+	now := time.Now()
+	lease := 30 * time.Second
+	replicas := []*election{{self: "a"}, {self: "b"}}
+
+	deliver := func(lock leaderLock, at time.Time) []bool {
+		claims := make([]bool, len(replicas))
+		for i, e := range replicas {
+			claims[i] = e.observe(lock, at)
+		}
+
+		return claims
+	}
+
+	deliver(leaderLock{Holder: "a"}, now)
+	require.True(t, replicas[0].leader())
+
+	// b missed a's renewals and claims the lock it considers expired
+	expired := now.Add(2 * lease)
+	require.True(t, replicas[1].expire(expired, lease))
+	assert.Equal(t, []bool{false, false}, deliver(leaderLock{Holder: "b"}, expired), "no replica may answer the claim")
+	assert.False(t, replicas[0].leader())
+	assert.True(t, replicas[1].leader())
+
+	// From then on only b renews the lock, and every replica accepts it
+	for tick := range 6 {
+		at := expired.Add(time.Duration(tick+1) * lease / 3)
+
+		var claims []string
+
+		for _, e := range replicas {
+			if e.leader() || e.expire(at, lease) {
+				claims = append(claims, e.self)
+			}
+		}
+
+		require.Equal(t, []string{"b"}, claims)
+
+		for _, claim := range claims {
+			assert.Equal(t, []bool{false, false}, deliver(leaderLock{Holder: claim}, at))
+		}
+
+		assert.False(t, replicas[0].leader())
+		assert.True(t, replicas[1].leader())
+	}
+}
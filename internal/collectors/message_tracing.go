@@ -0,0 +1,111 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/mapping"
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sampleMessage decides whether a message on topicName is traced, using the
+// sample ratio of the first matching rule or the default ratio
+func (mc *MQTTCollector) sampleMessage(topicName string) bool {
+	cfg := mc.config.Load().MQTT.Tracing
+	if cfg.ConnectionOnly {
+		return false
+	}
+
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+
+	for _, rule := range cfg.Rules {
+		if topic.Match(rule.Topic, topicName) {
+			ratio = rule.SampleRatio
+			break
+		}
+	}
+
+	return ratio >= 1 || ratio > 0 && rand.Float64() < ratio //nolint:gosec // G404: sampling does not need a secure random source
+}
+
+// traceMessage decides whether a message on topicName with the producer's
+// trace context parent is traced. The sample ratio and rules decide unless
+// parent_based is set and the message carries a trace context, whose
+// sampling decision is then followed.
+func (mc *MQTTCollector) traceMessage(topicName string, parent trace.SpanContext) bool {
+	if mc.config.Load().MQTT.Tracing.ParentBased && parent.IsValid() {
+		return parent.IsSampled()
+	}
+
+	return mc.sampleMessage(topicName)
+}
+
+// messageTraceContext returns a context carrying the W3C trace context the
+// producer put in the message's JSON payload, or context.Background() when
+// the payload has none. The MQTT client only speaks MQTT 3.1.1, so trace
+// context in MQTT 5 user properties cannot be read.
+func (mc *MQTTCollector) messageTraceContext(payload []byte) context.Context {
+	cfg := mc.config.Load().MQTT.Tracing
+	if cfg.TraceparentField == "" {
+		return context.Background()
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return context.Background()
+	}
+
+	carrier := propagation.MapCarrier{}
+
+	if traceparent, ok := mapping.Field(document, cfg.TraceparentField); ok {
+		if value, ok := traceparent.(string); ok {
+			carrier["traceparent"] = value
+		}
+	}
+
+	if cfg.TracestateField != "" {
+		if tracestate, ok := mapping.Field(document, cfg.TracestateField); ok {
+			if value, ok := tracestate.(string); ok {
+				carrier["tracestate"] = value
+			}
+		}
+	}
+
+	return propagation.TraceContext{}.Extract(context.Background(), carrier)
+}
+
+// traceSlowMessage records a process-message span for a message whose
+// processing already finished, backdated to when the message was handed in
+// for processing
+func (mc *MQTTCollector) traceSlowMessage(ctx context.Context, msg MQTT.Message, handledAt time.Time, processingDuration time.Duration) {
+	tracer := mc.app.GetTracer()
+
+	_, span := tracer.StartSpan(ctx, "process-message", //nolint:spancheck // ended below with an explicit timestamp
+		trace.WithTimestamp(handledAt),
+		trace.WithAttributes(
+			attribute.String("collector.name", "mqtt-collector"),
+			attribute.String("collector.operation", "process-message"),
+			attribute.String("mqtt.topic", msg.Topic()),
+			attribute.Int("mqtt.payload_length", len(msg.Payload())),
+			attribute.Int("mqtt.qos", int(msg.Qos())),
+			attribute.Bool("mqtt.retained", msg.Retained()),
+			attribute.Float64("processing.duration_seconds", processingDuration.Seconds()),
+			attribute.Float64("processing.slow_threshold_seconds", mc.config.Load().MQTT.Tracing.SlowThreshold.Duration.Seconds()),
+		),
+	)
+
+	span.End(trace.WithTimestamp(handledAt.Add(processingDuration)))
+}
@@ -2,44 +2,98 @@ package collectors
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/d0ugal/mqtt-exporter/internal/capture"
 	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/mapping"
 	"github.com/d0ugal/mqtt-exporter/internal/metrics"
 	"github.com/d0ugal/promexporter/app"
 	"github.com/d0ugal/promexporter/tracing"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// topicState is what the collector remembers about each topic it has seen
+type topicState struct {
+	messages  int64
+	bytes     int64
+	lastSeen  time.Time
+	retained  bool
+	size      int
+	payload   []byte
+	sequences map[sequenceKey]*sequenceState
+}
+
+// MQTTCollector subscribes to the configured topics and turns the received
+// messages into metrics. The configuration and mappings are swapped
+// atomically when the configuration is reloaded.
 type MQTTCollector struct {
-	config         *config.Config
+	config         atomic.Pointer[config.Config]
 	metrics        *metrics.MQTTRegistry
 	app            *app.App
 	client         MQTT.Client
 	mu             sync.RWMutex
-	topics         map[string]int64
+	topics         map[string]*topicState
+	mappings       atomic.Pointer[mapping.Set]
+	certificates   []*x509.Certificate
+	devices        map[string]*deviceState
+	heartbeats     []*heartbeat
+	queue          *messageQueue
+	process        func(queuedMessage)
+	tail           *tailHub
+	connection     *connectionState
+	recorder       *capture.Writer
+	recordStopped  atomic.Bool
+	leading        atomic.Bool
+	started        time.Time
 	done           chan struct{}
 	connectionLost chan struct{}
+	reloaded       chan struct{}
 }
 
 func NewMQTTCollector(cfg *config.Config, metricsRegistry *metrics.MQTTRegistry, app *app.App) *MQTTCollector {
-	return &MQTTCollector{
-		config:         cfg,
+	done := make(chan struct{})
+
+	mc := &MQTTCollector{
 		metrics:        metricsRegistry,
 		app:            app,
-		topics:         make(map[string]int64),
-		done:           make(chan struct{}),
+		topics:         make(map[string]*topicState),
+		devices:        make(map[string]*deviceState),
+		heartbeats:     newHeartbeats(cfg.MQTT.Heartbeats),
+		queue:          newMessageQueue(cfg.MQTT.Processing, metricsRegistry, done),
+		tail:           newTailHub(),
+		connection:     newConnectionState(cfg.MQTT.Broker, cfg.MQTT.Topics),
+		started:        time.Now(),
+		done:           done,
 		connectionLost: make(chan struct{}, 1),
+		reloaded:       make(chan struct{}, 1),
 	}
+
+	mc.process = mc.processMessage
+	mc.config.Store(cfg)
+	mc.mappings.Store(mapping.New(cfg.MQTT.Mappings))
+
+	return mc
 }
 
 func (mc *MQTTCollector) Start(ctx context.Context) {
+	if mc.queue != nil {
+		mc.queue.start(ctx, mc.processAndAck)
+	}
+
 	go mc.run(ctx) //nolint:gosec // G118: ctx is passed to run; context.Background() is only used internally for tracing spans
+
+	go mc.runHeartbeats(ctx)
 }
 
 // run handles the main connection loop with automatic reconnection
@@ -48,6 +102,10 @@ func (mc *MQTTCollector) run(ctx context.Context) {
 	maxReconnectDelay := time.Minute
 
 	for {
+		// The configuration this connection is made with, which reloads
+		// are compared against
+		active := mc.config.Load()
+
 		// Create a span for each connection attempt
 		tracer := mc.app.GetTracer()
 
@@ -92,22 +150,23 @@ func (mc *MQTTCollector) run(ctx context.Context) {
 
 		if err := mc.connect(spanCtx); err != nil { //nolint:contextcheck
 			slog.Error("Failed to connect to MQTT broker",
-				"broker", mc.config.MQTT.Broker,
+				"broker", mc.config.Load().MQTT.Broker,
 				"error", err,
 			)
 
 			if collectorSpan != nil {
-				collectorSpan.RecordError(err, attribute.String("broker", mc.config.MQTT.Broker))
+				collectorSpan.RecordError(err, attribute.String("broker", mc.config.Load().MQTT.Broker))
 				collectorSpan.End()
 			}
 
 			mc.metrics.MQTTConnectionStatus.With(prometheus.Labels{
-				"broker": mc.config.MQTT.Broker,
+				"broker": mc.config.Load().MQTT.Broker,
 			}).Set(0)
 			mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
-				"broker":     mc.config.MQTT.Broker,
+				"broker":     mc.config.Load().MQTT.Broker,
 				"error_type": "connect",
 			}).Inc()
+			mc.connection.setDisconnected(err, reconnectDelay, time.Now())
 
 			select {
 			case <-spanCtx.Done():
@@ -130,19 +189,30 @@ func (mc *MQTTCollector) run(ctx context.Context) {
 
 		// Reset reconnect delay on successful connection
 		reconnectDelay = time.Second
+		mc.connection.setConnected(time.Now())
 
-		slog.Info("Connected to MQTT broker", "broker", mc.config.MQTT.Broker)
+		slog.Info("Connected to MQTT broker", "broker", mc.config.Load().MQTT.Broker)
 
 		if collectorSpan != nil {
-			collectorSpan.AddEvent("connected", attribute.String("broker", mc.config.MQTT.Broker))
+			collectorSpan.AddEvent("connected", attribute.String("broker", mc.config.Load().MQTT.Broker))
 		}
 
 		mc.metrics.MQTTConnectionStatus.With(prometheus.Labels{
-			"broker": mc.config.MQTT.Broker,
+			"broker": mc.config.Load().MQTT.Broker,
 		}).Set(1)
 
-		// Subscribe to topics
-		if err := mc.subscribeToTopics(spanCtx); err != nil { //nolint:contextcheck
+		if mc.config.Load().MQTT.TLS.Enabled {
+			mc.updateCertificateMetrics()
+		}
+
+		// Subscribe to topics. With leader election only the leader does,
+		// once it is elected.
+		topics := active.MQTT.Topics
+		if active.MQTT.LeaderElection.Enabled {
+			topics = nil
+		}
+
+		if err := mc.subscribeToTopics(spanCtx, topics); err != nil { //nolint:contextcheck
 			slog.Error("Failed to subscribe to topics", "error", err)
 
 			if collectorSpan != nil {
@@ -151,7 +221,7 @@ func (mc *MQTTCollector) run(ctx context.Context) {
 			}
 
 			mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
-				"broker":     mc.config.MQTT.Broker,
+				"broker":     mc.config.Load().MQTT.Broker,
 				"error_type": "subscribe",
 			}).Inc()
 
@@ -160,6 +230,8 @@ func (mc *MQTTCollector) run(ctx context.Context) {
 				mc.client.Disconnect(250)
 			}
 
+			mc.connection.setDisconnected(err, 0, time.Now())
+
 			continue
 		}
 
@@ -169,33 +241,98 @@ func (mc *MQTTCollector) run(ctx context.Context) {
 			collectorSpan.End()
 		}
 
-		// Wait for connection to be lost or context cancellation
-		select {
-		case <-spanCtx.Done():
-			slog.Info("Shutting down MQTT collector")
+		// The probe runs for the lifetime of this connection only
+		probeCtx, stopProbe := context.WithCancel(ctx)
+		if active.MQTT.Probe.Enabled {
+			go mc.runProbe(probeCtx, mc.client)
+		}
 
-			if collectorSpan != nil {
-				collectorSpan.AddEvent("shutdown_requested")
-				collectorSpan.End()
-			}
+		stopElection := mc.startLeaderElection(ctx, mc.client)
+		stopStatus := mc.startStatus(ctx, mc.client)
 
-			if mc.client != nil && mc.client.IsConnected() {
-				mc.client.Disconnect(250)
-			}
+		// Wait for connection to be lost or context cancellation, applying
+		// reloaded configurations in the meantime
+	connected:
+		for {
+			select {
+			case <-spanCtx.Done():
+				stopProbe()
+				stopElection()
+				stopStatus()
+				slog.Info("Shutting down MQTT collector")
 
-			return
-		case <-mc.connectionLost:
-			slog.Info("Connection lost, attempting to reconnect", "broker", mc.config.MQTT.Broker)
+				if collectorSpan != nil {
+					collectorSpan.AddEvent("shutdown_requested")
+					collectorSpan.End()
+				}
 
-			if collectorSpan != nil {
-				collectorSpan.AddEvent("connection_lost", attribute.String("broker", mc.config.MQTT.Broker))
-				collectorSpan.End()
-			}
-			// Clean up the old client
-			if mc.client != nil {
-				mc.client.Disconnect(250)
+				mc.goOffline(mc.client, active)
+
+				if mc.client != nil && mc.client.IsConnected() {
+					mc.client.Disconnect(250)
+				}
+
+				return
+			case <-mc.connectionLost:
+				stopProbe()
+				slog.Info("Connection lost, attempting to reconnect", "broker", mc.config.Load().MQTT.Broker)
+
+				if collectorSpan != nil {
+					collectorSpan.AddEvent("connection_lost", attribute.String("broker", mc.config.Load().MQTT.Broker))
+					collectorSpan.End()
+				}
+				// Clean up the old client
+				if mc.client != nil {
+					mc.client.Disconnect(250)
+				}
+
+				// The broker releases the leader lock or publishes the
+				// offline status with the Will
+				stopElection()
+				stopStatus()
+				// Continue the loop to reconnect
+				break connected
+			case <-mc.reloaded:
+				next := mc.config.Load()
+
+				if connectionChanged(active, next) {
+					stopProbe()
+					stopElection()
+					stopStatus()
+					slog.Info("Connection settings changed, reconnecting", "broker", next.MQTT.Broker)
+
+					// The status topic may change with the new connection
+					mc.goOffline(mc.client, active)
+
+					if mc.client != nil {
+						mc.client.Disconnect(250)
+					}
+
+					mc.connection.setDisconnected(nil, 0, time.Now())
+
+					break connected
+				}
+
+				// A reload that lost or missed topics only took effect in
+				// part, so it doesn't count as successful
+				if !mc.standby() {
+					if err := mc.updateSubscriptions(ctx, active, next); err != nil {
+						slog.Error("Failed to update subscriptions of the reloaded configuration", "error", err)
+						mc.metrics.ConfigLastReloadSuccessful.Set(0)
+					}
+				}
+
+				if probeChanged(active, next) {
+					stopProbe()
+
+					probeCtx, stopProbe = context.WithCancel(ctx)
+					if next.MQTT.Probe.Enabled {
+						go mc.runProbe(probeCtx, mc.client)
+					}
+				}
+
+				active = next
 			}
-			// Continue the loop to reconnect
 		}
 	}
 }
@@ -212,12 +349,14 @@ func (mc *MQTTCollector) connect(ctx context.Context) error {
 		span = tracer.NewCollectorSpan(ctx, "mqtt-collector", "connect")
 
 		span.SetAttributes(
-			attribute.String("mqtt.broker", mc.config.MQTT.Broker),
-			attribute.String("mqtt.client_id", mc.config.MQTT.ClientID),
-			attribute.Bool("mqtt.clean_session", mc.config.MQTT.CleanSession),
-			attribute.Int64("mqtt.keep_alive_seconds", int64(mc.config.MQTT.KeepAlive.Duration.Seconds())),
-			attribute.Int64("mqtt.connect_timeout_seconds", int64(mc.config.MQTT.ConnectTimeout.Duration.Seconds())),
-			attribute.Bool("mqtt.has_username", mc.config.MQTT.Username != ""),
+			attribute.String("mqtt.broker", mc.config.Load().MQTT.Broker),
+			attribute.String("mqtt.client_id", mc.config.Load().MQTT.ConnectClientID()),
+			attribute.Bool("mqtt.clean_session", mc.config.Load().MQTT.CleanSession),
+			attribute.String("mqtt.session_store", mc.config.Load().MQTT.SessionStore),
+			attribute.Int64("mqtt.keep_alive_seconds", int64(mc.config.Load().MQTT.KeepAlive.Duration.Seconds())),
+			attribute.Int64("mqtt.connect_timeout_seconds", int64(mc.config.Load().MQTT.ConnectTimeout.Duration.Seconds())),
+			attribute.Bool("mqtt.has_username", mc.config.Load().MQTT.Username != ""),
+			attribute.Bool("mqtt.tls", mc.config.Load().MQTT.TLS.Enabled),
 		)
 
 		spanCtx = span.Context()
@@ -228,28 +367,64 @@ func (mc *MQTTCollector) connect(ctx context.Context) error {
 
 	configStart := time.Now()
 
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", mc.config.MQTT.Broker))
-	opts.SetClientID(mc.config.MQTT.ClientID)
+	tlsConfig, err := newTLSConfig(mc.config.Load().MQTT.TLS, mc.onCertificates)
+	if err != nil {
+		if span != nil {
+			span.RecordError(err, attribute.String("operation", "tls_config"))
+		}
+
+		return fmt.Errorf("failed to configure tls: %w", err)
+	}
+
+	opts := newClientOptions(connectionSettings{
+		broker:         mc.config.Load().MQTT.Broker,
+		clientID:       mc.config.Load().MQTT.ConnectClientID(),
+		username:       mc.config.Load().MQTT.Username,
+		password:       mc.config.Load().MQTT.Password.Value(),
+		tls:            tlsConfig,
+		keepAlive:      mc.config.Load().MQTT.KeepAlive.Duration,
+		connectTimeout: mc.config.Load().MQTT.ConnectTimeout.Duration,
+	})
+	opts.SetCleanSession(mc.config.Load().MQTT.CleanSession)
+
+	store, err := newSessionStore(mc.config.Load().MQTT)
+	if err != nil {
+		if span != nil {
+			span.RecordError(err, attribute.String("operation", "session_store"))
+		}
 
-	if mc.config.MQTT.Username != "" {
-		opts.SetUsername(mc.config.MQTT.Username)
-		opts.SetPassword(mc.config.MQTT.Password.Value())
+		return err
 	}
 
-	opts.SetCleanSession(mc.config.MQTT.CleanSession)
-	opts.SetKeepAlive(mc.config.MQTT.KeepAlive.Duration)
-	opts.SetConnectTimeout(mc.config.MQTT.ConnectTimeout.Duration)
+	if store != nil {
+		opts.SetStore(store)
+		// Messages are only acknowledged once processed, so that the broker
+		// redelivers those still queued when the exporter stops
+		opts.SetAutoAckDisabled(true)
+	}
 
-	// Enhanced connection robustness settings
+	// Enhanced connection robustness settings. Failed connection attempts
+	// are retried by run with backoff rather than by paho, whose retries
+	// would hide the error from the metrics and /ready.
 	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetConnectRetry(false)
 	opts.SetMaxReconnectInterval(30 * time.Second)
 	opts.SetPingTimeout(10 * time.Second)
 	opts.SetWriteTimeout(10 * time.Second)
 	opts.SetResumeSubs(true) // Resume subscriptions after reconnection
 
+	// Releases the leader lock when the broker loses the connection
+	if mc.config.Load().MQTT.LeaderElection.Enabled {
+		opts.SetBinaryWill(mc.config.Load().MQTT.LeaderElection.Topic, leaderRelease(mc.config.Load()), 1, true)
+	}
+
+	// Marks the exporter offline when the broker loses the connection. A
+	// connection has a single Will, and releasing the leader lock takes
+	// precedence.
+	if mc.config.Load().MQTT.Status.Enabled && !mc.config.Load().MQTT.LeaderElection.Enabled {
+		opts.SetWill(mc.config.Load().MQTT.Status.Topic, mc.config.Load().MQTT.Status.Offline, 1, true)
+	}
+
 	configDuration := time.Since(configStart)
 
 	if span != nil {
@@ -270,7 +445,7 @@ func (mc *MQTTCollector) connect(ctx context.Context) error {
 	connectStart := time.Now()
 
 	// Create context with timeout using span context if available
-	timeoutCtx, cancel := context.WithTimeout(spanCtx, mc.config.MQTT.ConnectTimeout.Duration)
+	timeoutCtx, cancel := context.WithTimeout(spanCtx, mc.config.Load().MQTT.ConnectTimeout.Duration)
 	defer cancel()
 
 	if token := mc.client.Connect(); token.Wait() && token.Error() != nil {
@@ -297,7 +472,7 @@ func (mc *MQTTCollector) connect(ctx context.Context) error {
 			attribute.Bool("connect.success", true),
 		)
 		span.AddEvent("connection_established",
-			attribute.String("broker", mc.config.MQTT.Broker),
+			attribute.String("broker", mc.config.Load().MQTT.Broker),
 		)
 	}
 
@@ -306,7 +481,9 @@ func (mc *MQTTCollector) connect(ctx context.Context) error {
 	return nil
 }
 
-func (mc *MQTTCollector) subscribeToTopics(ctx context.Context) error {
+// subscribeToTopics subscribes to each of topics, stopping at the first
+// subscription that fails
+func (mc *MQTTCollector) subscribeToTopics(ctx context.Context, topics []string) error {
 	tracer := mc.app.GetTracer()
 
 	var (
@@ -314,16 +491,12 @@ func (mc *MQTTCollector) subscribeToTopics(ctx context.Context) error {
 		spanCtx context.Context //nolint:contextcheck // Extracting context from span for child operations
 	)
 
-	// Build list of topics to subscribe to
-	topics := make([]string, len(mc.config.MQTT.Topics))
-	copy(topics, mc.config.MQTT.Topics)
-
 	if tracer != nil && tracer.IsEnabled() {
 		span = tracer.NewCollectorSpan(ctx, "mqtt-collector", "subscribe-to-topics")
 
 		span.SetAttributes(
 			attribute.Int("mqtt.topics_count", len(topics)),
-			attribute.Int("mqtt.qos", int(mc.config.MQTT.QoS)),
+			attribute.Int("mqtt.qos", int(mc.config.Load().MQTT.QoS)),
 		)
 
 		spanCtx = span.Context()
@@ -344,13 +517,18 @@ func (mc *MQTTCollector) subscribeToTopics(ctx context.Context) error {
 
 			topicSpan.SetAttributes(
 				attribute.String("mqtt.topic", topic),
-				attribute.Int("mqtt.qos", int(mc.config.MQTT.QoS)),
+				attribute.Int("mqtt.qos", int(mc.config.Load().MQTT.QoS)),
 			)
 
 			defer topicSpan.End()
 		}
 
-		if token := mc.client.Subscribe(topic, byte(mc.config.MQTT.QoS), nil); token.Wait() && token.Error() != nil { //nolint:gosec // G115: QoS is always 0, 1, or 2; no overflow possible
+		// Subscriptions are tracked by topic, but the broker reports on the
+		// filter, which is shared by the replicas with shared subscriptions
+		filter := mc.config.Load().MQTT.SubscriptionFilter(topic)
+
+		token := mc.client.Subscribe(filter, byte(mc.config.Load().MQTT.QoS), nil) //nolint:gosec // G115: QoS is always 0, 1, or 2; no overflow possible
+		if token.Wait() && token.Error() != nil {
 			subscribeDuration := time.Since(subscribeStart)
 
 			if topicSpan != nil {
@@ -361,10 +539,33 @@ func (mc *MQTTCollector) subscribeToTopics(ctx context.Context) error {
 				topicSpan.RecordError(token.Error(), attribute.String("operation", "mqtt_subscribe"))
 			}
 
+			mc.connection.setSubscription(topic, token.Error(), time.Now())
+
 			return fmt.Errorf("failed to subscribe to topic %s: %w", topic, token.Error())
 		}
 
 		subscribeDuration := time.Since(subscribeStart)
+
+		// A subscription the broker rejects, for example because of its
+		// ACLs, does not fail the token. Other topics can still be
+		// monitored, so it only keeps the collector from being ready.
+		if subscribeToken, ok := token.(*MQTT.SubscribeToken); ok && subscribeToken.Result()[filter] == subscribeFailure {
+			err := fmt.Errorf("broker rejected the subscription to topic %s", topic)
+
+			slog.Warn("Subscription rejected by broker", "topic", topic)
+			mc.connection.setSubscription(topic, err, time.Now())
+
+			topicsFailed++
+
+			if topicSpan != nil {
+				topicSpan.RecordError(err, attribute.String("operation", "mqtt_subscribe"))
+			}
+
+			continue
+		}
+
+		mc.connection.setSubscription(topic, nil, time.Now())
+
 		topicsSubscribed++
 
 		if topicSpan != nil {
@@ -377,7 +578,7 @@ func (mc *MQTTCollector) subscribeToTopics(ctx context.Context) error {
 			)
 		}
 
-		slog.Info("Subscribed to topic", "topic", topic)
+		slog.Info("Subscribed to topic", "topic", topic, "filter", filter)
 	}
 
 	if span != nil {
@@ -393,28 +594,56 @@ func (mc *MQTTCollector) subscribeToTopics(ctx context.Context) error {
 	return nil
 }
 
+// onCertificates records the broker certificate chain after each TLS
+// handshake
+func (mc *MQTTCollector) onCertificates(chain []*x509.Certificate) {
+	mc.mu.Lock()
+	mc.certificates = chain
+	mc.mu.Unlock()
+}
+
+// updateCertificateMetrics replaces the certificate expiry metrics with the
+// chain presented by the broker on the last handshake
+func (mc *MQTTCollector) updateCertificateMetrics() {
+	mc.mu.RLock()
+	chain := mc.certificates
+	mc.mu.RUnlock()
+
+	mc.metrics.MQTTBrokerCertNotAfter.Reset()
+
+	for _, certificate := range chain {
+		mc.metrics.MQTTBrokerCertNotAfter.With(prometheus.Labels{
+			"broker":  mc.config.Load().MQTT.Broker,
+			"subject": certificate.Subject.String(),
+			"issuer":  certificate.Issuer.String(),
+			"serial":  hex.EncodeToString(certificate.SerialNumber.Bytes()),
+		}).Set(float64(certificate.NotAfter.Unix()))
+	}
+}
+
 func (mc *MQTTCollector) onConnect(client MQTT.Client) {
-	slog.Info("MQTT connection established", "broker", mc.config.MQTT.Broker)
+	slog.Info("MQTT connection established", "broker", mc.config.Load().MQTT.Broker)
 	mc.metrics.MQTTConnectionStatus.With(prometheus.Labels{
-		"broker": mc.config.MQTT.Broker,
+		"broker": mc.config.Load().MQTT.Broker,
 	}).Set(1)
 }
 
 func (mc *MQTTCollector) onConnectionLost(client MQTT.Client, err error) {
 	slog.Error("MQTT connection lost",
-		"broker", mc.config.MQTT.Broker,
+		"broker", mc.config.Load().MQTT.Broker,
 		"error", err,
 	)
 	mc.metrics.MQTTConnectionStatus.With(prometheus.Labels{
-		"broker": mc.config.MQTT.Broker,
+		"broker": mc.config.Load().MQTT.Broker,
 	}).Set(0)
 	mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
-		"broker":     mc.config.MQTT.Broker,
+		"broker":     mc.config.Load().MQTT.Broker,
 		"error_type": "connection_lost",
 	}).Inc()
 	mc.metrics.MQTTReconnectsTotal.With(prometheus.Labels{
-		"broker": mc.config.MQTT.Broker,
+		"broker": mc.config.Load().MQTT.Broker,
 	}).Inc()
+	mc.connection.setDisconnected(err, 0, time.Now())
 
 	// Signal that connection was lost to trigger reconnection
 	select {
@@ -423,43 +652,146 @@ func (mc *MQTTCollector) onConnectionLost(client MQTT.Client, err error) {
 		// Channel is full, connection lost signal already pending
 	}
 
-	slog.Info("MQTT reconnection attempt initiated", "broker", mc.config.MQTT.Broker)
+	slog.Info("MQTT reconnection attempt initiated", "broker", mc.config.Load().MQTT.Broker)
 }
 
+// onMessageReceived is the paho message handler. It only queues the message
+// so that slow processing never holds up the client's network loop.
 func (mc *MQTTCollector) onMessageReceived(client MQTT.Client, msg MQTT.Message) {
+	queued := queuedMessage{msg: msg, receivedAt: time.Now()}
+
+	mc.record(queued)
+	mc.handle(queued)
+}
+
+// handle processes a message inline or hands it to the processing workers
+func (mc *MQTTCollector) handle(queued queuedMessage) {
+	queued.handledAt = time.Now()
+
+	if mc.queue == nil {
+		mc.processAndAck(queued)
+		return
+	}
+
+	mc.queue.enqueue(queued)
+}
+
+// HandleMessage runs msg through the same pipeline as the messages received
+// from the broker, so that mappings can be tested without one. When the
+// collector has processing workers, the message is processed asynchronously.
+func (mc *MQTTCollector) HandleMessage(msg MQTT.Message) {
+	mc.handle(queuedMessage{msg: msg, receivedAt: time.Now()})
+}
+
+// SetRecorder makes the collector write every message it receives from the
+// broker to a capture file, which it closes when it stops
+func (mc *MQTTCollector) SetRecorder(recorder *capture.Writer) {
+	mc.recorder = recorder
+}
+
+// record writes a received message to the capture file, if recording. The
+// first failure, including the capture reaching its size limit, stops
+// recording.
+func (mc *MQTTCollector) record(queued queuedMessage) {
+	if mc.recorder == nil || mc.recordStopped.Load() {
+		return
+	}
+
+	err := mc.recorder.Write(capture.NewRecord(queued.msg, queued.receivedAt))
+	if err == nil || !mc.recordStopped.CompareAndSwap(false, true) {
+		return
+	}
+
+	if errors.Is(err, capture.ErrFull) {
+		slog.Info("Capture file is full, stopped recording", "messages", mc.recorder.Messages())
+	} else {
+		slog.Error("Failed to record message, stopped recording", "error", err)
+	}
+}
+
+// processAndAck processes a message and then acknowledges it. paho only
+// leaves acknowledging to the collector with the file session store; with
+// automatic acknowledgement the second Ack is a no-op.
+func (mc *MQTTCollector) processAndAck(queued queuedMessage) {
+	mc.process(queued)
+	queued.msg.Ack()
+}
+
+// processMessage updates every metric derived from a received message
+func (mc *MQTTCollector) processMessage(queued queuedMessage) {
+	msg := queued.msg
+	receivedAt := queued.receivedAt
 	topic := msg.Topic()
 	payload := msg.Payload()
+	retained := msg.Retained()
 
 	slog.Debug("Received MQTT message",
 		"topic", topic,
 		"payload_length", len(payload),
 		"qos", msg.Qos(),
+		"retained", retained,
 	)
 
-	// Create a span for each message processing
+	// The collector's own status is not traffic from the broker
+	if mc.ownStatus(topic) {
+		return
+	}
+
+	// Create a span for the messages selected by the tracing configuration.
+	// With a slow threshold the span is only recorded once processing has
+	// finished and turned out to be slow. Spans join the producer's trace
+	// when the message carries its trace context.
 	tracer := mc.app.GetTracer()
+	traceCtx := context.Background()
+	sampled := false
+
+	if tracer != nil && tracer.IsEnabled() && !mc.config.Load().MQTT.Tracing.ConnectionOnly {
+		traceCtx = mc.messageTraceContext(payload)
+		sampled = mc.traceMessage(topic, trace.SpanContextFromContext(traceCtx))
+	}
+
+	slowOnly := mc.config.Load().MQTT.Tracing.SlowThreshold.Duration > 0
 
 	var messageSpan *tracing.CollectorSpan
 
-	if tracer != nil && tracer.IsEnabled() {
-		messageSpan = tracer.NewCollectorSpan(context.Background(), "mqtt-collector", "process-message")
+	if sampled && !slowOnly {
+		messageSpan = tracer.NewCollectorSpan(traceCtx, "mqtt-collector", "process-message")
 
 		// Add message attributes to the span
 		messageSpan.SetAttributes(
 			attribute.String("mqtt.topic", topic),
 			attribute.Int("mqtt.payload_length", len(payload)),
 			attribute.Int("mqtt.qos", int(msg.Qos())),
+			attribute.Bool("mqtt.retained", retained),
 		)
 
 		defer messageSpan.End()
 	}
 
+	// The broker replays retained messages on every (re)subscribe, so they
+	// can optionally be left out of the message counters.
+	countMessage := !retained || !mc.config.Load().MQTT.SkipRetained
+
 	// Update topic counter with tracing
 	updateCounterStart := time.Now()
 
 	mc.mu.Lock()
-	mc.topics[topic]++
-	messageCount := mc.topics[topic]
+	state := mc.topicStateLocked(topic)
+
+	if countMessage {
+		state.messages++
+		state.bytes += int64(len(payload))
+	}
+
+	state.lastSeen = receivedAt
+	state.retained = retained
+	state.size = len(payload)
+
+	if mc.config.Load().Web.Topics.CapturePayloads {
+		state.payload = append(state.payload[:0], payload[:min(len(payload), mc.config.Load().Web.Topics.PayloadLimit)]...)
+	}
+
+	messageCount := state.messages
 	mc.mu.Unlock()
 
 	updateCounterDuration := time.Since(updateCounterStart)
@@ -483,7 +815,7 @@ func (mc *MQTTCollector) onMessageReceived(client MQTT.Client, msg MQTT.Message)
 		metricsCtx = context.Background()
 	}
 
-	mc.updateMetrics(metricsCtx, topic, payload)
+	mc.updateMetrics(metricsCtx, msg, receivedAt, countMessage)
 
 	updateMetricsDuration := time.Since(updateMetricsStart)
 
@@ -499,42 +831,96 @@ func (mc *MQTTCollector) onMessageReceived(client MQTT.Client, msg MQTT.Message)
 			attribute.Int("message_count", int(messageCount)),
 		)
 	}
+
+	processingDuration := time.Since(queued.handledAt)
+	mc.metrics.MQTTMessageProcessingDuration.Observe(processingDuration.Seconds())
+
+	if sampled && slowOnly && processingDuration >= mc.config.Load().MQTT.Tracing.SlowThreshold.Duration {
+		mc.traceSlowMessage(traceCtx, msg, queued.handledAt, processingDuration)
+	}
+}
+
+// topicStateLocked returns the state for topic, creating it on first use.
+// mc.mu must be held.
+func (mc *MQTTCollector) topicStateLocked(topic string) *topicState {
+	state, ok := mc.topics[topic]
+	if !ok {
+		state = &topicState{}
+		mc.topics[topic] = state
+	}
+
+	return state
 }
 
 // updateMetrics updates Prometheus metrics with tracing
-func (mc *MQTTCollector) updateMetrics(ctx context.Context, topic string, payload []byte) {
+func (mc *MQTTCollector) updateMetrics(ctx context.Context, msg MQTT.Message, receivedAt time.Time, countMessage bool) {
+	topic := msg.Topic()
+	payload := msg.Payload()
+
 	tracer := mc.app.GetTracer()
 
 	var span *tracing.CollectorSpan
 
-	if tracer != nil && tracer.IsEnabled() {
+	// Only messages with a process-message span get an update-metrics span
+	if tracer != nil && tracer.IsEnabled() && trace.SpanContextFromContext(ctx).IsValid() {
 		span = tracer.NewCollectorSpan(ctx, "mqtt-collector", "update-metrics")
 
 		span.SetAttributes(
 			attribute.String("mqtt.topic", topic),
 			attribute.Int("mqtt.payload_length", len(payload)),
+			attribute.Bool("mqtt.retained", msg.Retained()),
+			attribute.Bool("mqtt.duplicate", msg.Duplicate()),
 		)
 
 		defer span.End()
 	}
 
 	updateStart := time.Now()
+	metricsCount := 0
+
+	if msg.Retained() {
+		mc.metrics.MQTTRetainedMessageCount.With(prometheus.Labels{
+			"topic": topic,
+		}).Inc()
+
+		metricsCount++
+	}
 
 	// Increment counters
-	mc.metrics.MQTTMessageCount.With(prometheus.Labels{
-		"topic": topic,
-	}).Inc()
-	mc.metrics.MQTTMessageBytes.With(prometheus.Labels{
-		"topic": topic,
-	}).Add(float64(len(payload)))
-	mc.metrics.MQTTTopicLastMessage.With(prometheus.Labels{
-		"topic": topic,
-	}).Set(float64(time.Now().Unix()))
+	if countMessage {
+		mc.metrics.MQTTMessageCount.With(
+			mc.metrics.MessageLabels(topic, msg.Qos(), msg.Duplicate()),
+		).Inc()
+		mc.metrics.MQTTMessageBytes.With(prometheus.Labels{
+			"topic": topic,
+		}).Add(float64(len(payload)))
+
+		metricsCount += 2
+	}
+
+	// A retained message may have been published long ago, so it says
+	// nothing about when the topic was last active.
+	if !msg.Retained() {
+		mc.metrics.MQTTTopicLastMessage.With(prometheus.Labels{
+			"topic": topic,
+		}).Set(float64(receivedAt.Unix()))
+
+		mc.recordHeartbeat(topic, receivedAt)
+
+		metricsCount++
+	}
+
+	results, errs := mc.applyMappings(msg, receivedAt)
+	availability := mc.updateAvailability(msg, receivedAt)
+
+	mc.publishTail(msg, receivedAt, results, errs)
 
 	if span != nil {
 		span.SetAttributes(
 			attribute.Float64("metrics.update_duration_seconds", time.Since(updateStart).Seconds()),
-			attribute.Int("metrics.count", 3),
+			attribute.Int("metrics.count", metricsCount),
+			attribute.Int("mappings.matched", len(results)),
+			attribute.Bool("availability.matched", availability),
 		)
 		span.AddEvent("metrics_updated",
 			attribute.String("topic", topic),
@@ -543,13 +929,120 @@ func (mc *MQTTCollector) updateMetrics(ctx context.Context, topic string, payloa
 	}
 }
 
+// applyMappings extracts payload values and the device-side timestamp for
+// every mapping matching the message topic
+func (mc *MQTTCollector) applyMappings(msg MQTT.Message, receivedAt time.Time) ([]mapping.Result, []error) {
+	results, errs := mc.mappings.Load().Apply(msg.Topic(), msg.Payload())
+
+	for _, err := range errs {
+		var mappingErr *mapping.Error
+		if errors.As(err, &mappingErr) {
+			mc.metrics.MQTTPayloadErrors.With(prometheus.Labels{
+				"mapping": mappingErr.Mapping,
+				"reason":  mappingErr.Reason,
+			}).Inc()
+		}
+
+		slog.Debug("Failed to apply payload mapping", "topic", msg.Topic(), "error", err)
+	}
+
+	for _, result := range results {
+		var valueTimestamp time.Time
+		if result.Mapping.ExportTimestamp {
+			valueTimestamp = result.Timestamp
+		}
+
+		for _, value := range result.Values {
+			mc.metrics.MQTTPayloadValues.Set(result.Mapping.Name, msg.Topic(), value.Field, value.Value, valueTimestamp)
+		}
+
+		// A retained message replays an old sequence number on every
+		// subscribe, which would look like a reorder or a reset.
+		if result.HasSequence && !msg.Retained() {
+			mc.observeSequence(msg.Topic(), result)
+		}
+
+		// The latency of a retained message would only measure how long it
+		// sat on the broker.
+		if result.Timestamp.IsZero() || msg.Retained() {
+			continue
+		}
+
+		latency := receivedAt.Sub(result.Timestamp)
+		if latency < 0 {
+			mc.metrics.MQTTPayloadErrors.With(prometheus.Labels{
+				"mapping": result.Mapping.Name,
+				"reason":  mapping.ReasonFutureTimestamp,
+			}).Inc()
+
+			continue
+		}
+
+		mc.metrics.MQTTMessageLatency.With(prometheus.Labels{
+			"mapping": result.Mapping.Name,
+		}).Observe(latency.Seconds())
+	}
+
+	return results, errs
+}
+
+// observeSequence tracks the payload sequence number of each mapping and
+// device on a topic and counts gaps, reorders and resets
+func (mc *MQTTCollector) observeSequence(topic string, result mapping.Result) {
+	key := sequenceKey{mapping: result.Mapping.Name, device: result.Device}
+
+	mc.mu.Lock()
+	topicState := mc.topicStateLocked(topic)
+	if topicState.sequences == nil {
+		topicState.sequences = make(map[sequenceKey]*sequenceState)
+	}
+
+	sequence, ok := topicState.sequences[key]
+	if !ok {
+		sequence = &sequenceState{}
+		topicState.sequences[key] = sequence
+	}
+
+	event, lost := sequence.observe(result.Sequence, result.Mapping.ReorderWindow)
+	mc.mu.Unlock()
+
+	labels := prometheus.Labels{
+		"mapping": result.Mapping.Name,
+		"topic":   topic,
+	}
+
+	if lost > 0 {
+		mc.metrics.MQTTSequenceGaps.With(labels).Add(float64(lost))
+	}
+
+	switch event {
+	case sequenceReorder:
+		mc.metrics.MQTTSequenceReorders.With(labels).Inc()
+	case sequenceReset:
+		mc.metrics.MQTTSequenceResets.With(labels).Inc()
+	case sequenceFirst, sequenceInOrder, sequenceGap, sequenceDuplicate:
+	}
+}
+
 // Stop stops the collector
 func (mc *MQTTCollector) Stop() {
 	close(mc.done)
+	mc.resign(mc.client)
+	mc.goOffline(mc.client, mc.config.Load())
 
 	if mc.client != nil && mc.client.IsConnected() {
 		mc.client.Disconnect(250)
 	}
+
+	if mc.recorder != nil {
+		mc.recordStopped.Store(true)
+
+		if err := mc.recorder.Close(); err != nil {
+			slog.Error("Failed to close capture file", "error", err)
+		} else {
+			slog.Info("Closed capture file", "messages", mc.recorder.Messages())
+		}
+	}
 }
 
 // minDuration returns the minimum of two time.Duration values
@@ -1,13 +1,24 @@
 package collectors
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/d0ugal/mqtt-exporter/internal/config"
 	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	"github.com/d0ugal/promexporter/app"
 	promexporter_config "github.com/d0ugal/promexporter/config"
 	promexporter_metrics "github.com/d0ugal/promexporter/metrics"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TestMQTTConnectionErrors_LabelsMatchRegistry guards against the label-name
@@ -16,7 +27,7 @@ import (
 // prometheus.Labels.With() panics here.
 func TestMQTTConnectionErrors_LabelsMatchRegistry(t *testing.T) {
 	baseRegistry := promexporter_metrics.NewRegistry("mqtt_exporter_info_test")
-	mqttMetrics := metrics.NewMQTTRegistry(baseRegistry)
+	mqttMetrics := metrics.NewMQTTRegistry(baseRegistry, metrics.Options{})
 
 	assert.NotPanics(t, func() {
 		mqttMetrics.MQTTConnectionErrors.With(prometheus.Labels{
@@ -55,3 +66,413 @@ func TestMQTTPassword_RedactsInString(t *testing.T) {
 		t.Fatalf("String() unexpected: want [REDACTED], got %q", got)
 	}
 }
+
+// testMessage is a minimal MQTT.Message used to drive onMessageReceived
+// without a broker.
+type testMessage struct {
+	topic     string
+	payload   []byte
+	qos       byte
+	retained  bool
+	duplicate bool
+}
+
+func (m *testMessage) Duplicate() bool   { return m.duplicate }
+func (m *testMessage) Qos() byte         { return m.qos }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func newTestCollector(t testing.TB, cfg *config.Config) *MQTTCollector {
+	t.Helper()
+
+	baseRegistry := promexporter_metrics.NewRegistry("mqtt_exporter_info_test")
+	mqttMetrics := metrics.NewMQTTRegistry(baseRegistry, metrics.Options{
+		MessageQoSLabel: cfg.MQTT.MessageLabels.QoS,
+		MessageDupLabel: cfg.MQTT.MessageLabels.Dup,
+		Replica:         cfg.MQTT.ReplicaLabel(),
+	})
+
+	application := app.New("MQTT Exporter Test").
+		WithConfig(&cfg.BaseConfig).
+		WithMetrics(baseRegistry).
+		Build()
+
+	return NewMQTTCollector(cfg, mqttMetrics, application)
+}
+
+// TestOnMessageReceived_Retained checks that retained messages are counted
+// separately, never move the last message timestamp and are only left out
+// of the message counters when skip_retained is set.
+func TestOnMessageReceived_Retained(t *testing.T) {
+	for _, skipRetained := range []bool{false, true} {
+		cfg := &config.Config{}
+		cfg.Logging.Level = "error"
+		cfg.Logging.Format = "json"
+		cfg.MQTT.SkipRetained = skipRetained
+
+		mc := newTestCollector(t, cfg)
+
+		mc.onMessageReceived(nil, &testMessage{topic: "sensor/a", payload: []byte("21.5"), retained: true})
+
+		labels := prometheus.Labels{"topic": "sensor/a"}
+
+		assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTRetainedMessageCount.With(labels)))
+		assert.Equal(t, 0, testutil.CollectAndCount(mc.metrics.MQTTTopicLastMessage))
+
+		wantCount := float64(1)
+		if skipRetained {
+			wantCount = 0
+		}
+
+		assert.Equal(t, wantCount, testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(labels)), "skip_retained=%v", skipRetained)
+
+		mc.onMessageReceived(nil, &testMessage{topic: "sensor/a", payload: []byte("21.6")})
+
+		assert.Equal(t, wantCount+1, testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(labels)), "skip_retained=%v", skipRetained)
+		assert.Equal(t, 1, testutil.CollectAndCount(mc.metrics.MQTTTopicLastMessage))
+	}
+}
+
+// TestOnMessageReceived_QoSAndDupLabels checks that the opt-in qos and dup
+// labels on mqtt_messages_total are filled from the message.
+func TestOnMessageReceived_QoSAndDupLabels(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.MessageLabels.QoS = true
+	cfg.MQTT.MessageLabels.Dup = true
+
+	mc := newTestCollector(t, cfg)
+
+	mc.onMessageReceived(nil, &testMessage{topic: "billing/meter", qos: 1})
+	mc.onMessageReceived(nil, &testMessage{topic: "billing/meter", qos: 1, duplicate: true})
+	mc.onMessageReceived(nil, &testMessage{topic: "billing/meter", qos: 1, duplicate: true})
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{
+		"topic": "billing/meter", "qos": "1", "dup": "false",
+	})))
+	assert.Equal(t, float64(2), testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{
+		"topic": "billing/meter", "qos": "1", "dup": "true",
+	})))
+}
+
+// TestOnMessageReceived_MappingLatency checks that a mapping with a
+// timestamp field records the end-to-end latency and the extracted values.
+func TestOnMessageReceived_MappingLatency(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Mappings = []config.MappingConfig{{
+		Name:      "climate",
+		Topic:     "sensor/+/climate",
+		Fields:    []string{"temperature"},
+		Timestamp: config.TimestampConfig{Field: "ts", Format: "unix_ms"},
+	}}
+
+	mc := newTestCollector(t, cfg)
+
+	sent := time.Now().Add(-2 * time.Second).UnixMilli()
+	payload := fmt.Sprintf(`{"temperature": 19.25, "ts": %d}`, sent)
+
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/hall/climate", payload: []byte(payload)})
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/hall/climate", payload: []byte(payload), retained: true})
+
+	expected := `
+# HELP mqtt_payload_value Last value extracted from the payload by a mapping
+# TYPE mqtt_payload_value gauge
+mqtt_payload_value{field="temperature",mapping="climate",topic="sensor/hall/climate"} 19.25
+`
+	assert.NoError(t, testutil.CollectAndCompare(mc.metrics.MQTTPayloadValues, strings.NewReader(expected)))
+
+	// Only the live message is observed; the retained copy is stale.
+	assert.Equal(t, 1, testutil.CollectAndCount(mc.metrics.MQTTMessageLatency))
+
+	metric := &dto.Metric{}
+	assert.NoError(t, mc.metrics.MQTTMessageLatency.WithLabelValues("climate").(prometheus.Histogram).Write(metric))
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 2, metric.GetHistogram().GetSampleSum(), 0.5)
+}
+
+// TestOnMessageReceived_SequenceTracking checks the gap, reorder and reset
+// classification of payload sequence numbers.
+func TestOnMessageReceived_SequenceTracking(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Mappings = []config.MappingConfig{{
+		Name:     "telemetry",
+		Topic:    "device/+/telemetry",
+		Sequence: config.SequenceConfig{Field: "seq", ReorderWindow: 10},
+	}}
+
+	mc := newTestCollector(t, cfg)
+
+	for _, seq := range []int{100, 101, 104, 102, 104, 7} {
+		mc.onMessageReceived(nil, &testMessage{
+			topic:   "device/a/telemetry",
+			payload: []byte(fmt.Sprintf(`{"seq": %d}`, seq)),
+		})
+	}
+
+	// A retained message replays an old sequence number and is ignored.
+	mc.onMessageReceived(nil, &testMessage{topic: "device/a/telemetry", payload: []byte(`{"seq": 1}`), retained: true})
+
+	labels := prometheus.Labels{"mapping": "telemetry", "topic": "device/a/telemetry"}
+
+	// 102 arrived late, only 103 was lost once the counter restarted
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTSequenceGaps.With(labels)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTSequenceReorders.With(labels)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTSequenceResets.With(labels)))
+}
+
+// TestOnMessageReceived_SequenceKeys checks that two mappings on one topic
+// and the devices sharing a topic each keep their own sequence.
+func TestOnMessageReceived_SequenceKeys(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Mappings = []config.MappingConfig{
+		{Name: "firmware", Topic: "gateway/telemetry", Sequence: config.SequenceConfig{Field: "seq", ReorderWindow: 10}},
+		{Name: "radio", Topic: "gateway/telemetry", Sequence: config.SequenceConfig{Field: "radio.seq", Device: "radio.node"}},
+	}
+
+	mc := newTestCollector(t, cfg)
+
+	for _, payload := range []string{
+		`{"seq": 1, "radio": {"seq": 50, "node": "a"}}`,
+		`{"seq": 2, "radio": {"seq": 7, "node": 12}}`,
+		`{"seq": 3, "radio": {"seq": 51, "node": "a"}}`,
+		`{"seq": 4, "radio": {"seq": 9, "node": 12}}`,
+	} {
+		mc.onMessageReceived(nil, &testMessage{topic: "gateway/telemetry", payload: []byte(payload)})
+	}
+
+	firmware := prometheus.Labels{"mapping": "firmware", "topic": "gateway/telemetry"}
+	radio := prometheus.Labels{"mapping": "radio", "topic": "gateway/telemetry"}
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(mc.metrics.MQTTSequenceGaps.With(firmware)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTSequenceGaps.With(radio)), "node 12 skipped 8")
+	assert.Equal(t, 0, testutil.CollectAndCount(mc.metrics.MQTTSequenceReorders))
+	assert.Equal(t, 0, testutil.CollectAndCount(mc.metrics.MQTTSequenceResets))
+}
+
+// TestUpdateCertificateMetrics checks that the broker certificate chain
+// captured during the TLS handshake replaces the previous expiry metrics.
+func TestUpdateCertificateMetrics(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Broker = "broker:8883"
+
+	mc := newTestCollector(t, cfg)
+
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	certificate := &x509.Certificate{
+		SerialNumber: big.NewInt(0xbeef),
+		Subject:      pkix.Name{CommonName: "broker"},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		NotAfter:     notAfter,
+	}
+
+	mc.onCertificates([]*x509.Certificate{{SerialNumber: big.NewInt(1), NotAfter: time.Now()}})
+	mc.updateCertificateMetrics()
+	mc.onCertificates([]*x509.Certificate{certificate})
+	mc.updateCertificateMetrics()
+
+	assert.Equal(t, 1, testutil.CollectAndCount(mc.metrics.MQTTBrokerCertNotAfter))
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(mc.metrics.MQTTBrokerCertNotAfter.With(prometheus.Labels{
+		"broker":  "broker:8883",
+		"subject": "CN=broker",
+		"issuer":  "CN=Test CA",
+		"serial":  "beef",
+	})))
+}
+
+// TestOnMessageReceived_Availability checks device availability tracking
+// from online/offline status messages.
+func TestOnMessageReceived_Availability(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Availability = []config.AvailabilityConfig{{
+		Topic:   "home/+/status",
+		Online:  "online",
+		Offline: "offline",
+	}}
+
+	mc := newTestCollector(t, cfg)
+
+	for _, msg := range []*testMessage{
+		{topic: "home/plug/status", payload: []byte("online"), retained: true},
+		{topic: "home/plug/status", payload: []byte("offline")},
+		{topic: "home/plug/status", payload: []byte("offline")},
+		{topic: "home/plug/status", payload: []byte("online")},
+		{topic: "home/plug/status", payload: []byte("rebooting")},
+	} {
+		mc.onMessageReceived(nil, msg)
+	}
+
+	labels := prometheus.Labels{"device": "plug"}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTDeviceUp.With(labels)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(mc.metrics.MQTTDeviceFlaps.With(labels)))
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(mc.metrics.MQTTDeviceLastStateChange.With(labels)), 5)
+}
+
+// TestCheckHeartbeats checks that silent topics are reported, including
+// expected topics that never published, and that only the expected topics
+// of a wildcard filter are tracked.
+func TestCheckHeartbeats(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Heartbeats = []config.HeartbeatConfig{
+		{Topic: "sensor/+/temp", Interval: config.Duration{Duration: time.Minute}, Missed: 2, Expected: []string{"sensor/x/temp"}},
+		{Topic: "gateway/status", Interval: config.Duration{Duration: time.Minute}, Missed: 3},
+		{Topic: "meter/+/power", Interval: config.Duration{Duration: time.Minute}, Missed: 3, Expected: []string{"meter/a/power", "meter/b/power"}},
+	}
+
+	mc := newTestCollector(t, cfg)
+	mc.started = time.Now().Add(-10 * time.Minute)
+
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/x/temp", payload: []byte("20")})
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/y/temp", payload: []byte("21")})
+	mc.onMessageReceived(nil, &testMessage{topic: "meter/a/power", payload: []byte("230")})
+	mc.checkHeartbeats(time.Now())
+
+	expected := `
+# HELP mqtt_topic_silent Whether a topic missed its expected heartbeats (1 = silent, 0 = publishing)
+# TYPE mqtt_topic_silent gauge
+mqtt_topic_silent{pattern="gateway/status",topic="gateway/status"} 1
+mqtt_topic_silent{pattern="meter/+/power",topic="meter/a/power"} 0
+mqtt_topic_silent{pattern="meter/+/power",topic="meter/b/power"} 1
+mqtt_topic_silent{pattern="sensor/+/temp",topic="sensor/x/temp"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(mc.metrics.MQTTTopicSilent, strings.NewReader(expected)))
+
+	mc.checkHeartbeats(time.Now().Add(3 * time.Minute))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTTopicSilent.With(prometheus.Labels{
+		"pattern": "sensor/+/temp", "topic": "sensor/x/temp",
+	})))
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	assert.Len(t, mc.heartbeats[0].lastSeen, 1, "unexpected topics must not be tracked")
+}
+
+// TestSampleMessage checks that the first matching rule overrides the
+// default sample ratio and that connection_only disables message tracing.
+func TestSampleMessage(t *testing.T) {
+	none, all := 0.0, 1.0
+
+	cfg := &config.Config{}
+	cfg.MQTT.Tracing.SampleRatio = &all
+	cfg.MQTT.Tracing.Rules = []config.TracingRuleConfig{
+		{Topic: "sensor/noisy/#", SampleRatio: 0},
+		{Topic: "sensor/#", SampleRatio: 1},
+	}
+
+	mc := newTestCollector(t, cfg)
+
+	for range 100 {
+		assert.True(t, mc.sampleMessage("device/a"))
+		assert.True(t, mc.sampleMessage("sensor/a"))
+		assert.False(t, mc.sampleMessage("sensor/noisy/a"))
+	}
+
+	cfg.MQTT.Tracing.SampleRatio = &none
+
+	for range 100 {
+		assert.False(t, mc.sampleMessage("device/a"))
+		assert.True(t, mc.sampleMessage("sensor/a"))
+	}
+
+	cfg.MQTT.Tracing.ConnectionOnly = true
+
+	assert.False(t, mc.sampleMessage("sensor/a"))
+}
+
+// TestOnMessageReceived_OwnStatus checks that the collector doesn't count
+// its own status and summary messages.
+func TestOnMessageReceived_OwnStatus(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.MQTT.Status = config.StatusConfig{
+		Enabled:      true,
+		Topic:        "mqtt-exporter/status/test",
+		SummaryTopic: "mqtt-exporter/status/test/summary",
+	}
+
+	mc := newTestCollector(t, cfg)
+
+	mc.onMessageReceived(nil, &testMessage{topic: "mqtt-exporter/status/test", payload: []byte("online"), retained: true})
+	mc.onMessageReceived(nil, &testMessage{topic: "mqtt-exporter/status/test/summary", payload: []byte("{}"), retained: true})
+	mc.onMessageReceived(nil, &testMessage{topic: "mqtt-exporter/status/other", payload: []byte("online"), retained: true})
+
+	assert.Len(t, mc.topics, 1)
+	assert.Contains(t, mc.topics, "mqtt-exporter/status/other")
+	assert.Equal(t, 1, testutil.CollectAndCount(mc.metrics.MQTTRetainedMessageCount))
+}
+
+// TestTraceMessage checks that a producer's sampled trace context only
+// overrides the sample ratio with parent_based.
+func TestTraceMessage(t *testing.T) {
+	none := 0.0
+
+	cfg := &config.Config{}
+	cfg.MQTT.Tracing.SampleRatio = &none
+
+	mc := newTestCollector(t, cfg)
+
+	sampled := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	unsampled := sampled.WithTraceFlags(0)
+
+	assert.False(t, mc.traceMessage("sensor/a", sampled), "the sample ratio must apply to traced messages")
+
+	cfg.MQTT.Tracing.ParentBased = true
+	mc.config.Store(cfg)
+
+	assert.True(t, mc.traceMessage("sensor/a", sampled))
+	assert.False(t, mc.traceMessage("sensor/a", unsampled))
+	assert.False(t, mc.traceMessage("sensor/a", trace.SpanContext{}), "messages without trace context follow the sample ratio")
+}
+
+// TestMessageTraceContext checks that the W3C trace context is read from the
+// configured payload fields and ignored when it is missing or invalid.
+func TestMessageTraceContext(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.MQTT.Tracing.TraceparentField = "meta.traceparent"
+	cfg.MQTT.Tracing.TracestateField = "meta.tracestate"
+
+	mc := newTestCollector(t, cfg)
+
+	spanContext := trace.SpanContextFromContext(mc.messageTraceContext([]byte(
+		`{"value": 1, "meta": {"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "tracestate": "vendor=value"}}`,
+	)))
+
+	assert.True(t, spanContext.IsValid())
+	assert.True(t, spanContext.IsRemote())
+	assert.True(t, spanContext.IsSampled())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spanContext.SpanID().String())
+	assert.Equal(t, "vendor=value", spanContext.TraceState().String())
+
+	for _, payload := range []string{
+		`{"value": 1}`,
+		`{"meta": {"traceparent": "not-a-traceparent"}}`,
+		`{"meta": {"traceparent": 42}}`,
+		`21.5`,
+		`not json`,
+	} {
+		assert.False(t, trace.SpanContextFromContext(mc.messageTraceContext([]byte(payload))).IsValid(), payload)
+	}
+}
@@ -0,0 +1,190 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/promexporter/tracing"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// probePayload is published on the probe topic and routed back to us by the
+// broker
+type probePayload struct {
+	ID   uint64 `json:"id"`
+	Sent int64  `json:"sent"`
+}
+
+// probeResponse is a probe message received back from the broker
+type probeResponse struct {
+	id         uint64
+	receivedAt time.Time
+}
+
+// runProbe periodically publishes a message on the probe topic and measures
+// how long the broker takes to deliver it back. It stops when ctx is
+// cancelled, which happens whenever the connection is lost.
+func (mc *MQTTCollector) runProbe(ctx context.Context, client MQTT.Client) {
+	// The probe keeps the configuration it started with; it is restarted
+	// when a reload changes it.
+	cfg := mc.config.Load()
+	probe := cfg.MQTT.Probe
+	interval := cfg.Metrics.Collection.DefaultInterval.Duration
+	responses := make(chan probeResponse, 1)
+
+	token := client.Subscribe(probe.Topic, byte(cfg.MQTT.QoS), func(_ MQTT.Client, msg MQTT.Message) { //nolint:gosec // G115: QoS is always 0, 1, or 2; no overflow possible
+		var payload probePayload
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			slog.Debug("Ignoring invalid probe message", "topic", msg.Topic(), "error", err)
+			return
+		}
+
+		select {
+		case responses <- probeResponse{id: payload.ID, receivedAt: time.Now()}:
+		default:
+			// A stale response is still queued, the probe will discard it
+		}
+	})
+	if token.WaitTimeout(probe.Timeout.Duration) && token.Error() == nil {
+		slog.Info("Subscribed to probe topic", "topic", probe.Topic)
+	} else {
+		err := token.Error()
+		if err == nil {
+			err = fmt.Errorf("timed out after %s", probe.Timeout.Duration)
+		}
+
+		slog.Error("Failed to subscribe to probe topic", "topic", probe.Topic, "error", err)
+		mc.metrics.MQTTProbeSuccess.With(prometheus.Labels{
+			"broker": cfg.MQTT.Broker,
+		}).Set(0)
+
+		return
+	}
+
+	defer client.Unsubscribe(probe.Topic)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var id uint64
+
+	for {
+		id++
+		mc.probeOnce(ctx, client, cfg, id, responses)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeOnce publishes a single probe message and waits for it to come back
+func (mc *MQTTCollector) probeOnce(ctx context.Context, client MQTT.Client, cfg *config.Config, id uint64, responses <-chan probeResponse) {
+	probe := cfg.MQTT.Probe
+	broker := cfg.MQTT.Broker
+	tracer := mc.app.GetTracer()
+
+	var span *tracing.CollectorSpan
+
+	if tracer != nil && tracer.IsEnabled() {
+		span = tracer.NewCollectorSpan(ctx, "mqtt-collector", "probe")
+
+		span.SetAttributes(
+			attribute.String("mqtt.broker", broker),
+			attribute.String("mqtt.topic", probe.Topic),
+			attribute.Int64("probe.id", int64(id)), //nolint:gosec // G115: probe ids never get anywhere near MaxInt64
+		)
+
+		defer span.End()
+	}
+
+	payload, err := json.Marshal(probePayload{ID: id, Sent: time.Now().UnixNano()})
+	if err != nil {
+		slog.Error("Failed to encode probe message", "error", err)
+		return
+	}
+
+	sent := time.Now()
+
+	token := client.Publish(probe.Topic, byte(cfg.MQTT.QoS), false, payload) //nolint:gosec // G115: QoS is always 0, 1, or 2; no overflow possible
+	if !token.WaitTimeout(probe.Timeout.Duration) || token.Error() != nil {
+		err := token.Error()
+		if err == nil {
+			err = fmt.Errorf("publish timed out after %s", probe.Timeout.Duration)
+		}
+
+		slog.Warn("Failed to publish probe message", "topic", probe.Topic, "error", err)
+
+		if span != nil {
+			span.RecordError(err, attribute.String("operation", "probe_publish"))
+		}
+
+		mc.probeLost(broker)
+
+		return
+	}
+
+	timeout := time.NewTimer(probe.Timeout.Duration - time.Since(sent))
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout.C:
+			slog.Warn("Probe message was not delivered back in time",
+				"topic", probe.Topic,
+				"timeout", probe.Timeout.Duration,
+			)
+
+			if span != nil {
+				span.AddEvent("probe_lost")
+			}
+
+			mc.probeLost(broker)
+
+			return
+		case response := <-responses:
+			if response.id != id {
+				// A late response to an earlier probe that was already
+				// counted as lost
+				continue
+			}
+
+			rtt := response.receivedAt.Sub(sent)
+
+			mc.metrics.MQTTProbeRTT.With(prometheus.Labels{
+				"broker": broker,
+			}).Observe(rtt.Seconds())
+			mc.metrics.MQTTProbeSuccess.With(prometheus.Labels{
+				"broker": broker,
+			}).Set(1)
+
+			if span != nil {
+				span.SetAttributes(attribute.Float64("probe.rtt_seconds", rtt.Seconds()))
+				span.AddEvent("probe_received")
+			}
+
+			slog.Debug("Probe round trip completed", "topic", probe.Topic, "rtt", rtt)
+
+			return
+		}
+	}
+}
+
+func (mc *MQTTCollector) probeLost(broker string) {
+	mc.metrics.MQTTProbeSuccess.With(prometheus.Labels{
+		"broker": broker,
+	}).Set(0)
+	mc.metrics.MQTTProbeLost.With(prometheus.Labels{
+		"broker": broker,
+	}).Inc()
+}
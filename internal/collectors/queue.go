@@ -0,0 +1,200 @@
+package collectors
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// queuedMessage is a received message waiting to be processed. receivedAt
+// is when the message was received, which for replayed messages is when it
+// was recorded; handledAt is when it was handed in for processing, which the
+// processing duration is measured from.
+type queuedMessage struct {
+	msg        MQTT.Message
+	receivedAt time.Time
+	handledAt  time.Time
+}
+
+// messageQueue hands received messages from the paho callback to a pool of
+// workers. Every worker has its own bounded queue and messages are assigned
+// to workers by topic, so the messages of a topic are processed in the order
+// they arrived.
+type messageQueue struct {
+	shards   []chan queuedMessage
+	overflow string
+	metrics  *metrics.MQTTRegistry
+	done     <-chan struct{}
+	pending  sync.WaitGroup
+
+	// stopping is closed when the workers stop, which unblocks enqueue, and
+	// stopped is set once no more messages can be queued
+	stopping chan struct{}
+	stopOnce sync.Once
+	mu       sync.RWMutex
+	stopped  bool
+}
+
+// newMessageQueue creates the queue described by cfg, or returns nil when
+// no workers are configured and messages should be processed inline
+func newMessageQueue(cfg config.ProcessingConfig, metricsRegistry *metrics.MQTTRegistry, done <-chan struct{}) *messageQueue {
+	if cfg.Workers < 1 {
+		return nil
+	}
+
+	shards := make([]chan queuedMessage, cfg.Workers)
+	for i := range shards {
+		shards[i] = make(chan queuedMessage, max(cfg.QueueSize, 1))
+	}
+
+	return &messageQueue{
+		shards:   shards,
+		overflow: cfg.Overflow,
+		metrics:  metricsRegistry,
+		done:     done,
+		stopping: make(chan struct{}),
+	}
+}
+
+// start runs one worker per shard until ctx is cancelled or the queue is
+// stopped. The messages still queued then are dropped, so that wait doesn't
+// block on them.
+func (q *messageQueue) start(ctx context.Context, process func(queuedMessage)) {
+	stopped := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-q.done:
+		}
+
+		q.stop()
+		close(stopped)
+	}()
+
+	for _, shard := range q.shards {
+		go func() {
+			for {
+				select {
+				case <-stopped:
+					q.discard(shard)
+					return
+				case queued := <-shard:
+					q.metrics.MQTTQueueDepth.Dec()
+					process(queued)
+					q.pending.Done()
+				}
+			}
+		}()
+	}
+}
+
+// stop makes enqueue refuse messages from now on
+func (q *messageQueue) stop() {
+	q.stopOnce.Do(func() { close(q.stopping) })
+
+	// Waits for the messages being enqueued, which the workers then discard
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+}
+
+// discard drops the messages left in shard
+func (q *messageQueue) discard(shard chan queuedMessage) {
+	for {
+		select {
+		case <-shard:
+			q.metrics.MQTTQueueDepth.Dec()
+			q.drop()
+		default:
+			return
+		}
+	}
+}
+
+// enqueue adds a message to the queue of its topic's worker, applying the
+// overflow policy when that queue is full. It reports whether the message
+// was queued.
+func (q *messageQueue) enqueue(queued queuedMessage) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.stopped {
+		return false
+	}
+
+	shard := q.shards[q.shardIndex(queued.msg.Topic())]
+
+	q.pending.Add(1)
+	q.metrics.MQTTQueueDepth.Inc()
+
+	switch q.overflow {
+	case config.OverflowDropNewest:
+		if !offer(shard, queued) {
+			q.metrics.MQTTQueueDepth.Dec()
+			q.drop()
+
+			return false
+		}
+	case config.OverflowDropOldest:
+		for !offer(shard, queued) {
+			select {
+			case <-shard:
+				q.metrics.MQTTQueueDepth.Dec()
+				q.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case shard <- queued:
+			return true
+		case <-q.stopping:
+		case <-q.done:
+		}
+
+		q.metrics.MQTTQueueDepth.Dec()
+		q.pending.Done()
+
+		return false
+	}
+
+	return true
+}
+
+// offer adds a message to shard unless it is full
+func offer(shard chan queuedMessage, queued queuedMessage) bool {
+	select {
+	case shard <- queued:
+		return true
+	default:
+		return false
+	}
+}
+
+// drop counts a message that was discarded instead of processed
+func (q *messageQueue) drop() {
+	q.metrics.MQTTQueueDropped.Inc()
+	q.pending.Done()
+}
+
+// wait blocks until every queued message has been processed or dropped
+func (q *messageQueue) wait() {
+	q.pending.Wait()
+}
+
+func (q *messageQueue) shardIndex(topic string) int {
+	if len(q.shards) == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(topic))
+
+	return int(hash.Sum32() % uint32(len(q.shards))) //nolint:gosec // G115: the number of workers always fits in uint32
+}
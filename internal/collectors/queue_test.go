@@ -0,0 +1,207 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMessageQueue_Overflow fills a single worker's queue without running the
+// worker and checks which messages each overflow policy keeps.
+func TestMessageQueue_Overflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		kept     []string
+	}{
+		{overflow: config.OverflowDropNewest, kept: []string{"0", "1"}},
+		{overflow: config.OverflowDropOldest, kept: []string{"3", "4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			cfg := &config.Config{}
+			mc := newTestCollector(t, cfg)
+
+			queue := newMessageQueue(config.ProcessingConfig{Workers: 1, QueueSize: 2, Overflow: tt.overflow}, mc.metrics, mc.done)
+
+			for i := range 5 {
+				queue.enqueue(queuedMessage{msg: &testMessage{topic: "sensor/a", payload: fmt.Appendf(nil, "%d", i)}})
+			}
+
+			assert.InDelta(t, 3, testutil.ToFloat64(mc.metrics.MQTTQueueDropped), 0)
+			assert.InDelta(t, 2, testutil.ToFloat64(mc.metrics.MQTTQueueDepth), 0)
+
+			var kept []string
+
+			for range len(tt.kept) {
+				kept = append(kept, string((<-queue.shards[0]).msg.Payload()))
+			}
+
+			assert.Equal(t, tt.kept, kept)
+		})
+	}
+}
+
+// TestMessageQueue_TopicOrder checks that messages of the same topic are
+// processed in the order they were received, whichever worker handles them.
+func TestMessageQueue_TopicOrder(t *testing.T) {
+	cfg := &config.Config{}
+	mc := newTestCollector(t, cfg)
+
+	queue := newMessageQueue(config.ProcessingConfig{Workers: 4, QueueSize: 8, Overflow: config.OverflowBlock}, mc.metrics, mc.done)
+
+	var (
+		mu        sync.Mutex
+		processed = make(map[string][]string)
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue.start(ctx, func(queued queuedMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		processed[queued.msg.Topic()] = append(processed[queued.msg.Topic()], string(queued.msg.Payload()))
+	})
+
+	expected := make(map[string][]string)
+
+	for i := range 200 {
+		topicName := fmt.Sprintf("sensor/%d", i%10)
+		payload := fmt.Sprintf("%d", i)
+		expected[topicName] = append(expected[topicName], payload)
+
+		assert.True(t, queue.enqueue(queuedMessage{msg: &testMessage{topic: topicName, payload: []byte(payload)}, receivedAt: time.Now()}))
+	}
+
+	queue.wait()
+
+	assert.Equal(t, expected, processed)
+	assert.InDelta(t, 0, testutil.ToFloat64(mc.metrics.MQTTQueueDepth), 0)
+	assert.InDelta(t, 0, testutil.ToFloat64(mc.metrics.MQTTQueueDropped), 0)
+}
+
+// TestMessageQueue_Stop checks that messages still queued when the workers
+// stop are dropped, and later ones refused, so that waiting for the queue
+// doesn't block forever.
+func TestMessageQueue_Stop(t *testing.T) {
+	cfg := &config.Config{}
+	mc := newTestCollector(t, cfg)
+
+	queue := newMessageQueue(config.ProcessingConfig{Workers: 1, QueueSize: 8, Overflow: config.OverflowBlock}, mc.metrics, mc.done)
+
+	var processed atomic.Int32
+
+	processing := make(chan struct{}, 4)
+	release := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue.start(ctx, func(queuedMessage) {
+		processing <- struct{}{}
+		<-release
+		processed.Add(1)
+	})
+
+	for i := range 4 {
+		assert.True(t, queue.enqueue(queuedMessage{msg: &testMessage{topic: "sensor/a", payload: fmt.Appendf(nil, "%d", i)}}))
+	}
+
+	<-processing
+	cancel()
+	close(release)
+
+	waited := make(chan struct{})
+
+	go func() {
+		queue.wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "waiting for the stopped queue blocked")
+	}
+
+	assert.False(t, queue.enqueue(queuedMessage{msg: &testMessage{topic: "sensor/a"}}))
+	queue.wait()
+
+	// The worker may take another message before it sees the stop
+	assert.InDelta(t, 4, float64(processed.Load())+testutil.ToFloat64(mc.metrics.MQTTQueueDropped), 0)
+	assert.InDelta(t, 0, testutil.ToFloat64(mc.metrics.MQTTQueueDepth), 0)
+}
+
+// BenchmarkHandle measures how long the MQTT client's message callback is
+// held up, per message, when processing a mapped JSON message is slow,
+// inline and with worker pools of different sizes. msgs/s is the processing
+// throughput.
+func BenchmarkHandle(b *testing.B) {
+	for _, workers := range []int{0, 1, 4, 8} {
+		name := fmt.Sprintf("workers=%d", workers)
+		if workers == 0 {
+			name = "inline"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			cfg := &config.Config{}
+			cfg.Logging.Level = "error"
+			cfg.MQTT.Processing = config.ProcessingConfig{Workers: workers, QueueSize: 1000, Overflow: config.OverflowBlock}
+			cfg.MQTT.Mappings = []config.MappingConfig{{
+				Name:      "climate",
+				Topic:     "sensor/+/climate",
+				Fields:    []string{"temperature", "humidity"},
+				Timestamp: config.TimestampConfig{Field: "ts", Format: "auto"},
+			}}
+
+			mc := newTestCollector(b, cfg)
+
+			// Stands in for a slow mapping or exporter, without connecting
+			mc.process = func(queued queuedMessage) {
+				time.Sleep(50 * time.Microsecond)
+				mc.processMessage(queued)
+			}
+
+			if mc.queue != nil {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				mc.queue.start(ctx, mc.process)
+			}
+
+			messages := make([]queuedMessage, 100)
+			for i := range messages {
+				messages[i] = queuedMessage{msg: &testMessage{
+					topic:   fmt.Sprintf("sensor/%d/climate", i),
+					payload: fmt.Appendf(nil, `{"temperature": 21.%d, "humidity": 40, "ts": %d}`, i, time.Now().Unix()),
+				}, receivedAt: time.Now()}
+			}
+
+			b.ResetTimer()
+
+			for i := range b.N {
+				mc.handle(messages[i%len(messages)])
+			}
+
+			callbacks := b.Elapsed()
+
+			if mc.queue != nil {
+				mc.queue.wait()
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(callbacks.Nanoseconds())/float64(b.N), "callback-ns/op")
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
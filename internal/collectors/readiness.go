@@ -0,0 +1,219 @@
+package collectors
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// subscribeFailure is the SUBACK return code for a rejected subscription
+const subscribeFailure = 0x80
+
+// SubscriptionStatus is the state of a configured topic subscription
+type SubscriptionStatus struct {
+	Topic      string `json:"topic"`
+	Subscribed bool   `json:"subscribed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BrokerStatus is the state of the connection to a broker
+type BrokerStatus struct {
+	Broker         string               `json:"broker"`
+	Connected      bool                 `json:"connected"`
+	ConnectedSince *time.Time           `json:"connected_since,omitempty"`
+	LastError      string               `json:"last_error,omitempty"`
+	LastErrorTime  *time.Time           `json:"last_error_time,omitempty"`
+	BackoffSeconds float64              `json:"backoff_seconds"`
+	Standby        bool                 `json:"standby,omitempty"`
+	Subscriptions  []SubscriptionStatus `json:"subscriptions"`
+}
+
+// ReadinessStatus is the body of /ready
+type ReadinessStatus struct {
+	Ready   bool           `json:"ready"`
+	Brokers []BrokerStatus `json:"brokers"`
+}
+
+// connectionState tracks the broker connection and topic subscriptions for
+// /ready. It has its own lock so that readiness checks never contend with
+// message processing.
+type connectionState struct {
+	mu             sync.RWMutex
+	broker         string
+	topics         []string
+	connected      bool
+	connectedSince time.Time
+	subscriptions  map[string]error
+	lastError      error
+	lastErrorTime  time.Time
+	backoff        time.Duration
+	standby        bool
+}
+
+func newConnectionState(broker string, topics []string) *connectionState {
+	return &connectionState{
+		broker:        broker,
+		topics:        topics,
+		subscriptions: make(map[string]error),
+	}
+}
+
+// setConnected records a successful connection. Subscriptions have to be made
+// again on every connection.
+func (s *connectionState) setConnected(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connected = true
+	s.connectedSince = now
+	s.backoff = 0
+	clear(s.subscriptions)
+}
+
+// setDisconnected records a failed or lost connection and the delay before
+// the next attempt
+func (s *connectionState) setDisconnected(err error, backoff time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connected = false
+	s.backoff = backoff
+	clear(s.subscriptions)
+
+	if err != nil {
+		s.lastError = err
+		s.lastErrorTime = now
+	}
+}
+
+// setSubscription records the outcome of subscribing to topicName
+func (s *connectionState) setSubscription(topicName string, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscriptions[topicName] = err
+
+	if err != nil {
+		s.lastError = err
+		s.lastErrorTime = now
+	}
+}
+
+// setStandby records whether the collector is a standby of the leader
+// election, which doesn't subscribe to the topics until it is elected
+func (s *connectionState) setStandby(standby bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.standby = standby
+}
+
+// setTopics replaces the topics readiness depends on, keeping the status of
+// the ones that were already subscribed
+func (s *connectionState) setTopics(broker string, topics []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.broker = broker
+	s.topics = topics
+
+	for topicName := range s.subscriptions {
+		if !slices.Contains(topics, topicName) {
+			delete(s.subscriptions, topicName)
+		}
+	}
+}
+
+// status returns the readiness of the collector: it is ready once connected
+// and subscribed to every configured topic, or only connected when it is a
+// standby
+func (s *connectionState) status() ReadinessStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	broker := BrokerStatus{
+		Broker:         s.broker,
+		Connected:      s.connected,
+		BackoffSeconds: s.backoff.Seconds(),
+		Standby:        s.standby,
+		Subscriptions:  make([]SubscriptionStatus, 0, len(s.topics)),
+	}
+
+	if s.connected {
+		connectedSince := s.connectedSince
+		broker.ConnectedSince = &connectedSince
+	}
+
+	if s.lastError != nil {
+		lastErrorTime := s.lastErrorTime
+		broker.LastError = s.lastError.Error()
+		broker.LastErrorTime = &lastErrorTime
+	}
+
+	ready := s.connected
+
+	for _, topicName := range s.topics {
+		subscription := SubscriptionStatus{Topic: topicName}
+
+		err, attempted := s.subscriptions[topicName]
+
+		switch {
+		case !attempted && s.standby:
+			subscription.Error = "standby, subscribed once elected leader"
+		case !attempted:
+			subscription.Error = "not subscribed yet"
+		case err != nil:
+			subscription.Error = err.Error()
+		default:
+			subscription.Subscribed = true
+		}
+
+		ready = ready && (subscription.Subscribed || s.standby)
+		broker.Subscriptions = append(broker.Subscriptions, subscription)
+	}
+
+	return ReadinessStatus{
+		Ready:   ready,
+		Brokers: []BrokerStatus{broker},
+	}
+}
+
+// Readiness reports whether the collector is connected and subscribed to
+// every configured topic, with the details behind it
+func (mc *MQTTCollector) Readiness() ReadinessStatus {
+	return mc.connection.status()
+}
+
+// ReadinessHandler serves /ready, which returns 200 once the collector is
+// connected and subscribed and 503 otherwise, with a JSON ReadinessStatus
+type ReadinessHandler struct {
+	collector *MQTTCollector
+}
+
+// NewReadinessHandler creates the handler for /ready
+func NewReadinessHandler(collector *MQTTCollector) *ReadinessHandler {
+	return &ReadinessHandler{
+		collector: collector,
+	}
+}
+
+// ServeHTTP implements http.Handler for /ready
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := h.collector.Readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.Error("Failed to encode readiness status", "error", err)
+	}
+}
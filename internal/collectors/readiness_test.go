@@ -0,0 +1,82 @@
+package collectors
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getReadiness(t *testing.T, handler *ReadinessHandler) (int, ReadinessStatus) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+	var status ReadinessStatus
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+
+	return recorder.Code, status
+}
+
+// TestReadinessHandler walks the collector through a failed connection, a
+// partial subscription and a lost connection, and checks /ready after each.
+func TestReadinessHandler(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.MQTT.Broker = "localhost:1883"
+	cfg.MQTT.Topics = []string{"sensor/#", "device/#"}
+
+	mc := newTestCollector(t, cfg)
+	handler := NewReadinessHandler(mc)
+	now := time.Now()
+
+	code, status := getReadiness(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, status.Ready)
+	require.Len(t, status.Brokers, 1)
+	assert.Equal(t, "localhost:1883", status.Brokers[0].Broker)
+	assert.Len(t, status.Brokers[0].Subscriptions, 2)
+
+	mc.connection.setDisconnected(errors.New("connection refused"), 4*time.Second, now)
+
+	code, status = getReadiness(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "connection refused", status.Brokers[0].LastError)
+	assert.InDelta(t, 4, status.Brokers[0].BackoffSeconds, 0)
+
+	mc.connection.setConnected(now)
+	mc.connection.setSubscription("sensor/#", nil, now)
+	mc.connection.setSubscription("device/#", errors.New("broker rejected the subscription to topic device/#"), now)
+
+	code, status = getReadiness(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, status.Brokers[0].Connected)
+	assert.InDelta(t, 0, status.Brokers[0].BackoffSeconds, 0)
+	assert.Equal(t, []SubscriptionStatus{
+		{Topic: "sensor/#", Subscribed: true},
+		{Topic: "device/#", Error: "broker rejected the subscription to topic device/#"},
+	}, status.Brokers[0].Subscriptions)
+
+	mc.connection.setConnected(now)
+	mc.connection.setSubscription("sensor/#", nil, now)
+	mc.connection.setSubscription("device/#", nil, now)
+
+	code, status = getReadiness(t, handler)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Ready)
+	assert.NotNil(t, status.Brokers[0].ConnectedSince)
+
+	mc.onConnectionLost(nil, errors.New("EOF"))
+
+	code, status = getReadiness(t, handler)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, status.Brokers[0].Connected)
+	assert.Equal(t, "EOF", status.Brokers[0].LastError)
+	assert.False(t, status.Brokers[0].Subscriptions[0].Subscribed)
+}
@@ -0,0 +1,178 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/mapping"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reload switches the collector to a new, already validated configuration.
+// Mappings, heartbeats and everything read per message apply immediately.
+// Topic subscriptions and the probe are updated by the connection loop,
+// which only reconnects when the connection settings changed. A
+// configuration that changes settings only read at startup is rejected, so
+// that the running configuration always describes the running collector.
+func (mc *MQTTCollector) Reload(cfg *config.Config) error {
+	previous := mc.config.Load()
+
+	if settings := restartRequired(previous, cfg); len(settings) > 0 {
+		return fmt.Errorf("changing %s needs a restart", strings.Join(settings, ", "))
+	}
+
+	mappings := mapping.New(cfg.MQTT.Mappings)
+
+	mc.config.Store(cfg)
+	mc.mappings.Store(mappings)
+
+	mc.metrics.MQTTPayloadValues.Retain(keepPayloadValue(mappings))
+
+	mc.replaceHeartbeats(cfg.MQTT.Heartbeats)
+	mc.connection.setTopics(cfg.MQTT.Broker, cfg.MQTT.Topics)
+
+	select {
+	case mc.reloaded <- struct{}{}:
+	default:
+		// A reload is already pending, the connection loop will pick up
+		// the latest configuration
+	}
+
+	slog.Info("Configuration reloaded",
+		"topics", len(cfg.MQTT.Topics),
+		"mappings", mappings.Len(),
+		"heartbeats", len(cfg.MQTT.Heartbeats),
+	)
+
+	return nil
+}
+
+// keepPayloadValue reports whether a payload value belongs to a field of one
+// of mappings, so that values of removed mappings or fields are dropped
+func keepPayloadValue(mappings *mapping.Set) func(name, field string) bool {
+	return func(name, field string) bool {
+		for _, m := range mappings.Mappings() {
+			if m.Name == name && slices.Contains(m.Fields, field) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// restartRequired lists the settings that differ between two configurations
+// but are only read at startup
+func restartRequired(previous, next *config.Config) []string {
+	var settings []string
+
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			settings = append(settings, name)
+		}
+	}
+
+	check("server", previous.Server, next.Server)
+	check("mode", previous.Mode, next.Mode)
+	check("embedded_broker", previous.EmbeddedBroker, next.EmbeddedBroker)
+	check("logging", previous.Logging, next.Logging)
+	check("tracing", previous.Tracing, next.Tracing)
+	check("profiling", previous.Profiling, next.Profiling)
+	check("web.enabled", previous.Web.Enabled, next.Web.Enabled)
+	check("web.host", previous.Web.Host, next.Web.Host)
+	check("web.port", previous.Web.Port, next.Web.Port)
+	check("web.tail.enabled", previous.Web.Tail.Enabled, next.Web.Tail.Enabled)
+	check("mqtt.processing", previous.MQTT.Processing, next.MQTT.Processing)
+	check("mqtt.message_labels", previous.MQTT.MessageLabels, next.MQTT.MessageLabels)
+	check("mqtt.record", previous.MQTT.Record, next.MQTT.Record)
+	check("state", previous.State, next.State)
+	check("mqtt.replica", previous.MQTT.Replica, next.MQTT.Replica)
+	check("mqtt.shared_subscription", previous.MQTT.Shared, next.MQTT.Shared)
+	check("mqtt.leader_election", previous.MQTT.LeaderElection, next.MQTT.LeaderElection)
+
+	return settings
+}
+
+// connectionChanged reports whether two configurations connect differently,
+// which needs a new connection
+func connectionChanged(previous, next *config.Config) bool {
+	a, b := previous.MQTT, next.MQTT
+
+	return a.Broker != b.Broker ||
+		a.ClientID != b.ClientID ||
+		a.Username != b.Username ||
+		a.Password.Value() != b.Password.Value() ||
+		a.CleanSession != b.CleanSession ||
+		a.SessionStore != b.SessionStore ||
+		a.SessionDir != b.SessionDir ||
+		a.KeepAlive != b.KeepAlive ||
+		a.ConnectTimeout != b.ConnectTimeout ||
+		a.TLS != b.TLS ||
+		a.Status != b.Status
+}
+
+// probeChanged reports whether the round-trip probe has to be restarted
+func probeChanged(previous, next *config.Config) bool {
+	return previous.MQTT.Probe != next.MQTT.Probe ||
+		previous.MQTT.QoS != next.MQTT.QoS ||
+		previous.Metrics.Collection.DefaultInterval != next.Metrics.Collection.DefaultInterval
+}
+
+// updateSubscriptions unsubscribes from the topics that were removed and
+// subscribes to the ones that were added. A QoS change resubscribes every
+// topic. Failures are counted as connection errors and returned.
+func (mc *MQTTCollector) updateSubscriptions(ctx context.Context, previous, next *config.Config) error {
+	var (
+		removed, added []string
+		errs           []error
+	)
+
+	for _, topicName := range previous.MQTT.Topics {
+		if !slices.Contains(next.MQTT.Topics, topicName) {
+			removed = append(removed, topicName)
+		}
+	}
+
+	for _, topicName := range next.MQTT.Topics {
+		if previous.MQTT.QoS != next.MQTT.QoS || !slices.Contains(previous.MQTT.Topics, topicName) {
+			added = append(added, topicName)
+		}
+	}
+
+	if len(removed) > 0 {
+		filters := make([]string, 0, len(removed))
+		for _, topicName := range removed {
+			filters = append(filters, previous.MQTT.SubscriptionFilter(topicName))
+		}
+
+		if err := waitToken(mc.client.Unsubscribe(filters...), next.MQTT.ConnectTimeout.Duration); err != nil {
+			mc.countConnectionError(next, "unsubscribe")
+			errs = append(errs, fmt.Errorf("failed to unsubscribe from removed topics %v: %w", removed, err))
+		} else {
+			slog.Info("Unsubscribed from removed topics", "topics", removed)
+		}
+	}
+
+	if len(added) > 0 {
+		if err := mc.subscribeToTopics(ctx, added); err != nil {
+			mc.countConnectionError(next, "subscribe")
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// countConnectionError counts an error of errorType on the broker of cfg
+func (mc *MQTTCollector) countConnectionError(cfg *config.Config, errorType string) {
+	mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
+		"broker":     cfg.MQTT.Broker,
+		"error_type": errorType,
+	}).Inc()
+}
@@ -0,0 +1,168 @@
+package collectors
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reloadTestConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Broker = "localhost:1883"
+	cfg.MQTT.Topics = []string{"sensor/#"}
+	cfg.MQTT.Mappings = []config.MappingConfig{
+		{Name: "climate", Topic: "sensor/+/climate", Fields: []string{"temperature", "humidity"}},
+	}
+	cfg.MQTT.Heartbeats = []config.HeartbeatConfig{
+		{Topic: "sensor/+/climate", Interval: config.Duration{Duration: time.Minute}, Missed: 2, Expected: []string{"sensor/hall/climate"}},
+	}
+
+	return cfg
+}
+
+// TestReload checks that a reload swaps the mappings, drops the values of
+// removed mapping fields, keeps heartbeat history for unchanged patterns and
+// updates the subscriptions reported by /ready.
+func TestReload(t *testing.T) {
+	mc := newTestCollector(t, reloadTestConfig())
+	mc.started = time.Now().Add(-10 * time.Minute)
+
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/hall/climate", payload: []byte(`{"temperature": 19.5, "humidity": 40}`)})
+
+	next := reloadTestConfig()
+	next.MQTT.Topics = []string{"sensor/#", "meter/#"}
+	next.MQTT.Mappings = []config.MappingConfig{
+		{Name: "climate", Topic: "sensor/+/climate", Fields: []string{"temperature"}},
+		{Name: "power", Topic: "meter/+/power", Fields: []string{"watts"}},
+	}
+	next.MQTT.Heartbeats = append(next.MQTT.Heartbeats, config.HeartbeatConfig{
+		Topic: "meter/+/power", Interval: config.Duration{Duration: time.Minute}, Missed: 2, Expected: []string{"meter/a/power"},
+	})
+
+	require.NoError(t, mc.Reload(next))
+
+	expected := `
+# HELP mqtt_payload_value Last value extracted from the payload by a mapping
+# TYPE mqtt_payload_value gauge
+mqtt_payload_value{field="temperature",mapping="climate",topic="sensor/hall/climate"} 19.5
+`
+	assert.NoError(t, testutil.CollectAndCompare(mc.metrics.MQTTPayloadValues, strings.NewReader(expected)))
+
+	mc.onMessageReceived(nil, &testMessage{topic: "meter/a/power", payload: []byte(`{"watts": 230}`)})
+
+	expected = `
+# HELP mqtt_payload_value Last value extracted from the payload by a mapping
+# TYPE mqtt_payload_value gauge
+mqtt_payload_value{field="temperature",mapping="climate",topic="sensor/hall/climate"} 19.5
+mqtt_payload_value{field="watts",mapping="power",topic="meter/a/power"} 230
+`
+	assert.NoError(t, testutil.CollectAndCompare(mc.metrics.MQTTPayloadValues, strings.NewReader(expected)))
+
+	mc.checkHeartbeats(time.Now())
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(mc.metrics.MQTTTopicSilent.With(prometheus.Labels{
+		"pattern": "sensor/+/climate", "topic": "sensor/hall/climate",
+	})), "heartbeat history should survive the reload")
+	assert.Equal(t, float64(0), testutil.ToFloat64(mc.metrics.MQTTTopicSilent.With(prometheus.Labels{
+		"pattern": "meter/+/power", "topic": "meter/a/power",
+	})))
+
+	status := mc.Readiness()
+	require.Len(t, status.Brokers, 1)
+	require.Len(t, status.Brokers[0].Subscriptions, 2)
+	assert.Equal(t, "meter/#", status.Brokers[0].Subscriptions[1].Topic)
+
+	select {
+	case <-mc.reloaded:
+	default:
+		t.Fatal("reload did not signal the connection loop")
+	}
+
+	// A setting only read at startup rejects the whole configuration
+	restart := reloadTestConfig()
+	restart.MQTT.Processing.Workers = 4
+	restart.MQTT.Topics = []string{"meter/#"}
+
+	assert.ErrorContains(t, mc.Reload(restart), "changing mqtt.processing needs a restart")
+	assert.Equal(t, next, mc.config.Load())
+	assert.Len(t, mc.Readiness().Brokers[0].Subscriptions, 2)
+}
+
+// TestReloadChanges checks which settings need a reconnect, a probe restart
+// or a full restart.
+func TestReloadChanges(t *testing.T) {
+	previous := reloadTestConfig()
+
+	next := reloadTestConfig()
+	next.MQTT.Topics = []string{"meter/#"}
+	next.MQTT.Mappings = nil
+
+	assert.False(t, connectionChanged(previous, next))
+	assert.False(t, probeChanged(previous, next))
+	assert.Empty(t, restartRequired(previous, next))
+
+	next.MQTT.Broker = "broker.example.com:1883"
+	next.MQTT.Password = config.NewSensitiveString("secret")
+	next.MQTT.Probe.Enabled = true
+	next.MQTT.Processing.Workers = 8
+	next.Web.Port = 9090
+
+	assert.True(t, connectionChanged(previous, next))
+	assert.True(t, probeChanged(previous, next))
+	assert.Equal(t, []string{"web.port", "mqtt.processing"}, restartRequired(previous, next))
+}
+
+// failingClient is an MQTT client whose subscription changes fail
+type failingClient struct {
+	MQTT.Client
+}
+
+func (failingClient) Subscribe(string, byte, MQTT.MessageHandler) MQTT.Token { return failedToken{} }
+func (failingClient) Unsubscribe(...string) MQTT.Token                       { return failedToken{} }
+
+// failedToken is a completed token that failed
+type failedToken struct{}
+
+func (failedToken) Wait() bool                     { return true }
+func (failedToken) WaitTimeout(time.Duration) bool { return true }
+func (failedToken) Error() error                   { return errors.New("not connected") }
+
+func (failedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+
+	return done
+}
+
+// TestUpdateSubscriptions_Failure checks that failing to (un)subscribe the
+// topics of a reloaded configuration is returned and counted, rather than
+// only logged.
+func TestUpdateSubscriptions_Failure(t *testing.T) {
+	previous := reloadTestConfig()
+	mc := newTestCollector(t, previous)
+	mc.client = failingClient{}
+
+	next := reloadTestConfig()
+	next.MQTT.Topics = []string{"meter/#"}
+
+	err := mc.updateSubscriptions(t.Context(), previous, next)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "failed to unsubscribe from removed topics [sensor/#]")
+	assert.ErrorContains(t, err, "failed to subscribe to topic meter/#")
+
+	for _, errorType := range []string{"unsubscribe", "subscribe"} {
+		assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTConnectionErrors.With(prometheus.Labels{
+			"broker": "localhost:1883", "error_type": errorType,
+		})), errorType)
+	}
+}
@@ -0,0 +1,89 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/capture"
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	"github.com/d0ugal/mqtt-exporter/internal/version"
+	"github.com/d0ugal/promexporter/app"
+	promexporter_metrics "github.com/d0ugal/promexporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewOfflineCollector creates a collector that never connects to a broker,
+// with its own metrics registry, to be fed messages through HandleMessage
+// or Replay
+func NewOfflineCollector(cfg *config.Config) (*MQTTCollector, prometheus.Gatherer) {
+	baseRegistry := promexporter_metrics.NewRegistry("mqtt_exporter_info")
+	mqttRegistry := metrics.NewMQTTRegistry(baseRegistry, metrics.Options{
+		MessageQoSLabel: cfg.MQTT.MessageLabels.QoS,
+		MessageDupLabel: cfg.MQTT.MessageLabels.Dup,
+	})
+
+	application := app.New("MQTT Exporter").
+		WithConfig(&cfg.BaseConfig).
+		WithMetrics(baseRegistry).
+		WithVersionInfo(version.Version, version.Commit, version.BuildDate).
+		Build()
+
+	return NewMQTTCollector(cfg, mqttRegistry, application), baseRegistry.GetRegistry()
+}
+
+// Replay feeds the records of a capture through the processing pipeline,
+// including the processing workers, and returns once every message has been
+// processed. With speed 0 messages are replayed as fast as possible,
+// otherwise the gaps between them are kept, divided by speed. Messages are
+// processed as received at the time they were recorded, so that last message
+// timestamps and latencies against device timestamps match the capture.
+func (mc *MQTTCollector) Replay(ctx context.Context, reader *capture.Reader, speed float64) (int, error) {
+	// The workers keep going when ctx is cancelled, so that a message being
+	// enqueued is never stuck; they stop with the collector
+	if mc.queue != nil {
+		mc.queue.start(context.WithoutCancel(ctx), mc.processAndAck)
+	}
+
+	var (
+		replayed int
+		first    time.Time
+		started  time.Time
+	)
+
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			if mc.queue != nil {
+				mc.queue.wait()
+			}
+
+			return replayed, nil
+		}
+
+		if err != nil {
+			return replayed, err
+		}
+
+		if speed > 0 {
+			if replayed == 0 {
+				first, started = record.Time, time.Now()
+			}
+
+			offset := time.Duration(float64(record.Time.Sub(first)) / speed)
+
+			select {
+			case <-ctx.Done():
+				return replayed, ctx.Err()
+			case <-time.After(time.Until(started.Add(offset))):
+			}
+		} else if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+
+		mc.handle(queuedMessage{msg: record.Message(), receivedAt: record.Time})
+		replayed++
+	}
+}
@@ -0,0 +1,122 @@
+package collectors
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/capture"
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRecordAndReplay records messages received from the broker and replays
+// them through a collector with processing workers, which has to end up
+// with the same message counts.
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl.gz")
+
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+
+	recording := newTestCollector(t, cfg)
+
+	recorder, err := capture.Create(path, 3)
+	require.NoError(t, err)
+	recording.SetRecorder(recorder)
+
+	recording.onMessageReceived(nil, &testMessage{topic: "sensor/a", payload: []byte("1")})
+	recording.onMessageReceived(nil, &testMessage{topic: "sensor/b", payload: []byte("2"), retained: true})
+	recording.onMessageReceived(nil, &testMessage{topic: "sensor/a", payload: []byte("3")})
+	// Beyond max_messages, processed but not recorded
+	recording.onMessageReceived(nil, &testMessage{topic: "sensor/a", payload: []byte("4")})
+
+	// Messages handed in directly are not recorded
+	recording.HandleMessage(&testMessage{topic: "sensor/c", payload: []byte("5")})
+	recording.Stop()
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(recording.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/a"})))
+
+	replayCfg := &config.Config{}
+	replayCfg.Logging.Level = "error"
+	replayCfg.Logging.Format = "json"
+	replayCfg.MQTT.Processing = config.ProcessingConfig{Workers: 2, QueueSize: 1, Overflow: config.OverflowBlock}
+
+	replaying := newTestCollector(t, replayCfg)
+	defer replaying.Stop()
+
+	reader, err := capture.Open(path)
+	require.NoError(t, err)
+
+	defer func() { _ = reader.Close() }()
+
+	replayed, err := replaying.Replay(t.Context(), reader, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, replayed)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(replaying.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/a"})))
+	assert.Equal(t, float64(1), testutil.ToFloat64(replaying.metrics.MQTTRetainedMessageCount.With(prometheus.Labels{"topic": "sensor/b"})))
+	assert.Equal(t, 2, testutil.CollectAndCount(replaying.metrics.MQTTMessageCount))
+
+	// Replayed messages keep the time they were recorded at, while the
+	// processing duration is still measured from when they were replayed
+	oldPath := filepath.Join(t.TempDir(), "old.jsonl")
+	recorded := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writer, err := capture.Create(oldPath, 0)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(capture.Record{Time: recorded, Topic: "sensor/old", Payload: []byte("1")}))
+	require.NoError(t, writer.Close())
+
+	oldReader, err := capture.Open(oldPath)
+	require.NoError(t, err)
+
+	defer func() { _ = oldReader.Close() }()
+
+	_, err = replaying.Replay(t.Context(), oldReader, 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(recorded.Unix()), testutil.ToFloat64(replaying.metrics.MQTTTopicLastMessage.With(prometheus.Labels{"topic": "sensor/old"})))
+
+	metric := &dto.Metric{}
+	require.NoError(t, replaying.metrics.MQTTMessageProcessingDuration.Write(metric))
+	assert.Less(t, metric.GetHistogram().GetSampleSum(), time.Minute.Seconds())
+}
+
+// TestReplay_Speed checks that a replay at original speed keeps the gaps
+// between the recorded messages.
+func TestReplay_Speed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	writer, err := capture.Create(path, 0)
+	require.NoError(t, err)
+
+	recorded := time.Now()
+	require.NoError(t, writer.Write(capture.Record{Time: recorded, Topic: "sensor/a"}))
+	require.NoError(t, writer.Write(capture.Record{Time: recorded.Add(400 * time.Millisecond), Topic: "sensor/a"}))
+	require.NoError(t, writer.Close())
+
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+
+	mc := newTestCollector(t, cfg)
+
+	reader, err := capture.Open(path)
+	require.NoError(t, err)
+
+	defer func() { _ = reader.Close() }()
+
+	started := time.Now()
+	replayed, err := mc.Replay(t.Context(), reader, 4)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, replayed)
+	assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond)
+	assert.Less(t, time.Since(started), 400*time.Millisecond)
+}
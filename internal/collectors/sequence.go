@@ -0,0 +1,100 @@
+package collectors
+
+// sequenceEvent classifies a sequence number against the last one seen on
+// the same topic
+type sequenceEvent int
+
+const (
+	sequenceFirst sequenceEvent = iota
+	sequenceInOrder
+	sequenceDuplicate
+	sequenceGap
+	sequenceReorder
+	sequenceReset
+)
+
+// sequenceKey identifies a sequence on a topic. Mappings track their own
+// sequence field, and devices sharing a topic their own counter.
+type sequenceKey struct {
+	mapping string
+	device  string
+}
+
+// sequenceState tracks the highest sequence number seen on a topic, and the
+// skipped numbers that may still arrive within the reorder window
+type sequenceState struct {
+	last    int64
+	seen    bool
+	missing map[int64]struct{}
+}
+
+// observe records sequence and classifies it. It also returns how many
+// sequence numbers were lost: a skipped number only counts once it falls out
+// of the reorder window without arriving, and one that arrives late is a
+// reorder instead. A sequence number going back to one that was not skipped
+// is a duplicate within the window. Further back, or back to 0 or 1 where
+// counters start, it is the device restarting its counter, which loses the
+// numbers still missing.
+func (s *sequenceState) observe(sequence, reorderWindow int64) (sequenceEvent, int64) {
+	if !s.seen {
+		s.seen = true
+		s.last = sequence
+
+		return sequenceFirst, 0
+	}
+
+	switch {
+	case sequence == s.last+1:
+		s.last = sequence
+
+		return sequenceInOrder, s.expire(reorderWindow)
+	case sequence > s.last:
+		// The skipped numbers already out of the window are lost right away
+		oldest := sequence - reorderWindow
+		lost := max(0, oldest-s.last-1)
+
+		if s.missing == nil {
+			s.missing = make(map[int64]struct{})
+		}
+
+		for missed := max(s.last+1, oldest); missed < sequence; missed++ {
+			s.missing[missed] = struct{}{}
+		}
+
+		s.last = sequence
+
+		return sequenceGap, lost + s.expire(reorderWindow)
+	case sequence == s.last:
+		return sequenceDuplicate, 0
+	}
+
+	if _, ok := s.missing[sequence]; ok {
+		delete(s.missing, sequence)
+		return sequenceReorder, 0
+	}
+
+	if sequence > 1 && s.last-sequence <= reorderWindow {
+		return sequenceDuplicate, 0
+	}
+
+	lost := int64(len(s.missing))
+	clear(s.missing)
+	s.last = sequence
+
+	return sequenceReset, lost
+}
+
+// expire drops the skipped numbers that fell out of the reorder window and
+// returns how many there were
+func (s *sequenceState) expire(reorderWindow int64) int64 {
+	var lost int64
+
+	for missed := range s.missing {
+		if missed < s.last-reorderWindow {
+			delete(s.missing, missed)
+			lost++
+		}
+	}
+
+	return lost
+}
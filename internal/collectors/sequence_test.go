@@ -0,0 +1,57 @@
+package collectors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSequenceState checks that skipped numbers arriving late within the
+// reorder window are not counted as lost, and that a counter starting over
+// is a reset even when it had not got past the window yet.
+func TestSequenceState(t *testing.T) {
+	type observation struct {
+		sequence int64
+		event    sequenceEvent
+		lost     int64
+	}
+
+	for name, observations := range map[string][]observation{
+		"late arrivals are not lost": {
+			{0, sequenceFirst, 0},
+			{5, sequenceGap, 0},
+			{2, sequenceReorder, 0},
+			{2, sequenceDuplicate, 0},
+			// 6 to 9 are out of the window right away, 1, 3 and 4 fall out
+			// of it now
+			{20, sequenceGap, 7},
+			{15, sequenceReorder, 0},
+			// 10 falls out of the window, arriving now it is a reset that
+			// loses 11 to 14 and 16 to 19
+			{21, sequenceInOrder, 1},
+			{10, sequenceReset, 8},
+		},
+		"early counter restart": {
+			{1, sequenceFirst, 0},
+			{2, sequenceInOrder, 0},
+			{3, sequenceInOrder, 0},
+			{0, sequenceReset, 0},
+			{1, sequenceInOrder, 0},
+		},
+		"wrap": {
+			{65534, sequenceFirst, 0},
+			{65535, sequenceInOrder, 0},
+			{0, sequenceReset, 0},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			state := &sequenceState{}
+
+			for _, o := range observations {
+				event, lost := state.observe(o.sequence, 10)
+				assert.Equal(t, o.event, event, "sequence %d", o.sequence)
+				assert.Equal(t, o.lost, lost, "sequence %d", o.sequence)
+			}
+		})
+	}
+}
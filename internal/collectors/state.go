@@ -0,0 +1,165 @@
+package collectors
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/state"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stateCounters and stateGauges are the metrics saved in state snapshots, by
+// name
+func (mc *MQTTCollector) stateCounters() map[string]*prometheus.CounterVec {
+	return map[string]*prometheus.CounterVec{
+		"mqtt_messages_total":          mc.metrics.MQTTMessageCount,
+		"mqtt_message_bytes_total":     mc.metrics.MQTTMessageBytes,
+		"mqtt_retained_messages_total": mc.metrics.MQTTRetainedMessageCount,
+	}
+}
+
+func (mc *MQTTCollector) stateGauges() map[string]*prometheus.GaugeVec {
+	return map[string]*prometheus.GaugeVec{
+		"mqtt_topic_last_message_timestamp": mc.metrics.MQTTTopicLastMessage,
+	}
+}
+
+// Snapshot returns the per-topic state, message counters, last message
+// timestamps and last payload values, for saving to disk
+func (mc *MQTTCollector) Snapshot() *state.Snapshot {
+	snapshot := &state.Snapshot{
+		Time:     time.Now(),
+		Counters: make(map[string][]state.Series),
+		Gauges:   make(map[string][]state.Series),
+	}
+
+	mc.mu.RLock()
+	for name, topicState := range mc.topics {
+		snapshot.Topics = append(snapshot.Topics, state.Topic{
+			Topic:    name,
+			Messages: topicState.messages,
+			Bytes:    topicState.bytes,
+			LastSeen: topicState.lastSeen,
+			Retained: topicState.retained,
+			Size:     topicState.size,
+		})
+	}
+	mc.mu.RUnlock()
+
+	for name, counter := range mc.stateCounters() {
+		snapshot.Counters[name] = collectSeries(counter)
+	}
+
+	for name, gauge := range mc.stateGauges() {
+		snapshot.Gauges[name] = collectSeries(gauge)
+	}
+
+	mc.metrics.MQTTPayloadValues.Each(func(mapping, topic, field string, value float64, timestamp time.Time) {
+		snapshot.Values = append(snapshot.Values, state.Value{
+			Mapping:   mapping,
+			Topic:     topic,
+			Field:     field,
+			Value:     value,
+			Timestamp: timestamp,
+		})
+	})
+
+	return snapshot
+}
+
+// collectSeries returns the current series of a counter or gauge vector
+func collectSeries(collector prometheus.Collector) []state.Series {
+	ch := make(chan prometheus.Metric)
+
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	var series []state.Series
+
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+
+		labels := make(map[string]string, len(m.GetLabel()))
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+
+		value := m.GetCounter().GetValue()
+		if m.Gauge != nil {
+			value = m.GetGauge().GetValue()
+		}
+
+		series = append(series, state.Series{Labels: labels, Value: value})
+	}
+
+	return series
+}
+
+// Restore loads a snapshot saved by an earlier run. It must be called
+// before the collector is started. Series whose labels no longer match,
+// for example because the qos or dup label was turned on in between, and
+// values of mappings or fields that were removed are left out.
+func (mc *MQTTCollector) Restore(snapshot *state.Snapshot) {
+	mc.mu.Lock()
+	for _, saved := range snapshot.Topics {
+		topicState := mc.topicStateLocked(saved.Topic)
+		topicState.messages = saved.Messages
+		topicState.bytes = saved.Bytes
+		topicState.lastSeen = saved.LastSeen
+		topicState.retained = saved.Retained
+		topicState.size = saved.Size
+	}
+	mc.mu.Unlock()
+
+	skipped := 0
+
+	for name, counter := range mc.stateCounters() {
+		for _, series := range snapshot.Counters[name] {
+			metric, err := counter.GetMetricWith(series.Labels)
+			if err != nil || series.Value < 0 {
+				skipped++
+				continue
+			}
+
+			metric.Add(series.Value)
+		}
+	}
+
+	for name, gauge := range mc.stateGauges() {
+		for _, series := range snapshot.Gauges[name] {
+			metric, err := gauge.GetMetricWith(series.Labels)
+			if err != nil {
+				skipped++
+				continue
+			}
+
+			metric.Set(series.Value)
+		}
+	}
+
+	keep := keepPayloadValue(mc.mappings.Load())
+	values := 0
+
+	for _, value := range snapshot.Values {
+		if !keep(value.Mapping, value.Field) {
+			skipped++
+			continue
+		}
+
+		mc.metrics.MQTTPayloadValues.Set(value.Mapping, value.Topic, value.Field, value.Value, value.Timestamp)
+		values++
+	}
+
+	slog.Info("Restored state",
+		"saved_at", snapshot.Time,
+		"topics", len(snapshot.Topics),
+		"values", values,
+		"skipped", skipped,
+	)
+}
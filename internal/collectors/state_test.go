@@ -0,0 +1,94 @@
+package collectors
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stateTestConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.Mappings = []config.MappingConfig{
+		{Name: "climate", Topic: "sensor/+/climate", Fields: []string{"temperature", "humidity"}},
+	}
+
+	return cfg
+}
+
+// TestSnapshotRestore checks that a restored collector continues the
+// counters, last message timestamps and payload values of the snapshot it
+// was restored from, and keeps counting on top of them.
+func TestSnapshotRestore(t *testing.T) {
+	previous := newTestCollector(t, stateTestConfig())
+
+	previous.onMessageReceived(nil, &testMessage{topic: "sensor/hall/climate", payload: []byte(`{"temperature": 19.5, "humidity": 40}`)})
+	previous.onMessageReceived(nil, &testMessage{topic: "sensor/hall/climate", payload: []byte(`{"temperature": 20, "humidity": 41}`)})
+	previous.onMessageReceived(nil, &testMessage{topic: "sensor/door", payload: []byte("open"), retained: true})
+
+	snapshot := previous.Snapshot()
+
+	// The next run no longer maps humidity
+	cfg := stateTestConfig()
+	cfg.MQTT.Mappings[0].Fields = []string{"temperature"}
+
+	mc := newTestCollector(t, cfg)
+	mc.Restore(snapshot)
+
+	for _, topic := range []string{"sensor/hall/climate", "sensor/door"} {
+		labels := prometheus.Labels{"topic": topic}
+
+		assert.Equal(t,
+			testutil.ToFloat64(previous.metrics.MQTTMessageCount.With(labels)),
+			testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(labels)), topic)
+		assert.Equal(t,
+			testutil.ToFloat64(previous.metrics.MQTTMessageBytes.With(labels)),
+			testutil.ToFloat64(mc.metrics.MQTTMessageBytes.With(labels)), topic)
+		assert.Equal(t,
+			testutil.ToFloat64(previous.metrics.MQTTTopicLastMessage.With(labels)),
+			testutil.ToFloat64(mc.metrics.MQTTTopicLastMessage.With(labels)), topic)
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(mc.metrics.MQTTRetainedMessageCount.With(prometheus.Labels{"topic": "sensor/door"})))
+
+	expected := `
+# HELP mqtt_payload_value Last value extracted from the payload by a mapping
+# TYPE mqtt_payload_value gauge
+mqtt_payload_value{field="temperature",mapping="climate",topic="sensor/hall/climate"} 20
+`
+	assert.NoError(t, testutil.CollectAndCompare(mc.metrics.MQTTPayloadValues, strings.NewReader(expected)))
+
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/hall/climate", payload: []byte(`{"temperature": 21}`)})
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(mc.metrics.MQTTMessageCount.With(prometheus.Labels{"topic": "sensor/hall/climate"})))
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	require.Contains(t, mc.topics, "sensor/hall/climate")
+	assert.Equal(t, int64(3), mc.topics["sensor/hall/climate"].messages)
+	assert.True(t, mc.topics["sensor/door"].retained)
+	assert.WithinDuration(t, time.Now(), mc.topics["sensor/door"].lastSeen, time.Minute)
+}
+
+// TestRestore_LabelsChanged checks that counter series saved with other
+// labels are skipped rather than panicking or being merged.
+func TestRestore_LabelsChanged(t *testing.T) {
+	previous := newTestCollector(t, stateTestConfig())
+	previous.onMessageReceived(nil, &testMessage{topic: "billing/meter", qos: 1})
+
+	cfg := stateTestConfig()
+	cfg.MQTT.MessageLabels.QoS = true
+
+	mc := newTestCollector(t, cfg)
+	assert.NotPanics(t, func() { mc.Restore(previous.Snapshot()) })
+
+	assert.Equal(t, 0, testutil.CollectAndCount(mc.metrics.MQTTMessageCount))
+}
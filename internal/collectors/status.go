@@ -0,0 +1,165 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusSummary is the JSON summary the exporter publishes about itself
+type statusSummary struct {
+	ClientID      string        `json:"client_id"`
+	Replica       string        `json:"replica,omitempty"`
+	Time          time.Time     `json:"time"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Topics        int           `json:"topics"`
+	Messages      int64         `json:"messages"`
+	MessageRate   float64       `json:"messages_per_second"`
+	Errors        summaryErrors `json:"errors"`
+}
+
+// summaryErrors are the totals of the error counters since the exporter
+// started
+type summaryErrors struct {
+	Connection float64 `json:"connection"`
+	Payload    float64 `json:"payload"`
+	Dropped    float64 `json:"dropped"`
+	ProbeLost  float64 `json:"probe_lost"`
+}
+
+// startStatus publishes the online status for the lifetime of a connection,
+// followed by a summary every summary interval, when the status is enabled.
+// The returned function stops the summaries.
+func (mc *MQTTCollector) startStatus(ctx context.Context, client MQTT.Client) func() {
+	cfg := mc.config.Load()
+	if !cfg.MQTT.Status.Enabled {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		mc.runStatus(ctx, client, cfg.MQTT.Status)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// runStatus publishes the online status, then a summary every interval
+func (mc *MQTTCollector) runStatus(ctx context.Context, client MQTT.Client, status config.StatusConfig) {
+	mc.publishStatus(client, status.Topic, []byte(status.Online))
+
+	if status.SummaryInterval.Duration == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(status.SummaryInterval.Duration)
+	defer ticker.Stop()
+
+	messages, since := mc.messageTotal(), time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			summary := mc.summary(now)
+			summary.MessageRate = float64(summary.Messages-messages) / now.Sub(since).Seconds()
+			messages, since = summary.Messages, now
+
+			payload, err := json.Marshal(summary)
+			if err != nil {
+				slog.Error("Failed to encode status summary", "error", err)
+				continue
+			}
+
+			mc.publishStatus(client, status.SummaryTopic, payload)
+		}
+	}
+}
+
+// goOffline publishes the offline status of cfg before the collector closes
+// the connection, as the broker only publishes the Will when the connection
+// is lost
+func (mc *MQTTCollector) goOffline(client MQTT.Client, cfg *config.Config) {
+	if !cfg.MQTT.Status.Enabled || client == nil || !client.IsConnectionOpen() {
+		return
+	}
+
+	mc.publishStatus(client, cfg.MQTT.Status.Topic, []byte(cfg.MQTT.Status.Offline))
+}
+
+// publishStatus publishes a retained status message at QoS 1
+func (mc *MQTTCollector) publishStatus(client MQTT.Client, topicName string, payload []byte) {
+	timeout := mc.config.Load().MQTT.ConnectTimeout.Duration
+
+	if err := waitToken(client.Publish(topicName, 1, true, payload), timeout); err != nil {
+		slog.Warn("Failed to publish status", "topic", topicName, "error", err)
+	}
+}
+
+// ownStatus reports whether topicName is one the collector publishes its
+// status or summary on, which a subscription to # delivers back to it
+func (mc *MQTTCollector) ownStatus(topicName string) bool {
+	status := mc.config.Load().MQTT.Status
+	return status.Enabled && (topicName == status.Topic || topicName == status.SummaryTopic)
+}
+
+// summary returns the summary of the collector at now, without the message
+// rate, which depends on the previous summary
+func (mc *MQTTCollector) summary(now time.Time) statusSummary {
+	cfg := mc.config.Load()
+
+	mc.mu.RLock()
+	started := mc.started
+	topics := len(mc.topics)
+	mc.mu.RUnlock()
+
+	return statusSummary{
+		ClientID:      cfg.MQTT.ConnectClientID(),
+		Replica:       cfg.MQTT.ReplicaLabel(),
+		Time:          now.UTC(),
+		UptimeSeconds: now.Sub(started).Seconds(),
+		Topics:        topics,
+		Messages:      mc.messageTotal(),
+		Errors: summaryErrors{
+			Connection: sumSeries(mc.metrics.MQTTConnectionErrors),
+			Payload:    sumSeries(mc.metrics.MQTTPayloadErrors),
+			Dropped:    sumSeries(mc.metrics.MQTTQueueDropped),
+			ProbeLost:  sumSeries(mc.metrics.MQTTProbeLost),
+		},
+	}
+}
+
+// messageTotal returns the number of messages received on every topic
+func (mc *MQTTCollector) messageTotal() int64 {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	var total int64
+	for _, topicState := range mc.topics {
+		total += topicState.messages
+	}
+
+	return total
+}
+
+// sumSeries returns the sum of the series of a counter or gauge
+func sumSeries(collector prometheus.Collector) float64 {
+	var total float64
+	for _, series := range collectSeries(collector) {
+		total += series.Value
+	}
+
+	return total
+}
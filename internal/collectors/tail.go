@@ -0,0 +1,239 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/mapping"
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// tailKeepAlive is how often /tail sends a comment to keep idle connections
+// open through proxies
+const tailKeepAlive = 15 * time.Second
+
+// TailEvent is a received message as streamed by /tail
+type TailEvent struct {
+	Topic            string      `json:"topic"`
+	QoS              byte        `json:"qos"`
+	Retained         bool        `json:"retained"`
+	Size             int         `json:"size"`
+	Payload          string      `json:"payload"`
+	PayloadTruncated bool        `json:"payload_truncated,omitempty"`
+	ReceivedAt       time.Time   `json:"received_at"`
+	Values           []TailValue `json:"values,omitempty"`
+	Errors           []string    `json:"errors,omitempty"`
+}
+
+// TailValue is a value a mapping extracted from a streamed message
+type TailValue struct {
+	Mapping string  `json:"mapping"`
+	Field   string  `json:"field"`
+	Value   float64 `json:"value"`
+}
+
+// tailSubscriber is a /tail client. Events that do not fit in its buffer are
+// dropped and counted rather than waited for.
+type tailSubscriber struct {
+	filter  string
+	events  chan TailEvent
+	dropped atomic.Int64
+}
+
+// tailHub fans received messages out to the /tail clients
+type tailHub struct {
+	mu          sync.RWMutex
+	subscribers map[*tailSubscriber]struct{}
+	active      atomic.Int32
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{
+		subscribers: make(map[*tailSubscriber]struct{}),
+	}
+}
+
+func (h *tailHub) subscribe(filter string, buffer int) *tailSubscriber {
+	subscriber := &tailSubscriber{
+		filter: filter,
+		events: make(chan TailEvent, buffer),
+	}
+
+	h.mu.Lock()
+	h.subscribers[subscriber] = struct{}{}
+	h.active.Add(1)
+	h.mu.Unlock()
+
+	return subscriber
+}
+
+func (h *tailHub) unsubscribe(subscriber *tailSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, subscriber)
+	h.active.Add(-1)
+	h.mu.Unlock()
+}
+
+// wants reports whether any client's filter matches topicName
+func (h *tailHub) wants(topicName string) bool {
+	if h.active.Load() == 0 {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for subscriber := range h.subscribers {
+		if topic.Match(subscriber.filter, topicName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publish hands event to every matching client without ever blocking
+func (h *tailHub) publish(event TailEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for subscriber := range h.subscribers {
+		if !topic.Match(subscriber.filter, event.Topic) {
+			continue
+		}
+
+		select {
+		case subscriber.events <- event:
+		default:
+			subscriber.dropped.Add(1)
+		}
+	}
+}
+
+// publishTail streams a processed message to the /tail clients watching its
+// topic, if there are any
+func (mc *MQTTCollector) publishTail(msg MQTT.Message, receivedAt time.Time, results []mapping.Result, errs []error) {
+	if !mc.tail.wants(msg.Topic()) {
+		return
+	}
+
+	payload := msg.Payload()
+	limit := min(len(payload), mc.config.Load().Web.Tail.PayloadLimit)
+
+	event := TailEvent{
+		Topic:            msg.Topic(),
+		QoS:              msg.Qos(),
+		Retained:         msg.Retained(),
+		Size:             len(payload),
+		Payload:          string(payload[:limit]),
+		PayloadTruncated: limit < len(payload),
+		ReceivedAt:       receivedAt,
+	}
+
+	for _, result := range results {
+		for _, value := range result.Values {
+			event.Values = append(event.Values, TailValue{
+				Mapping: result.Mapping.Name,
+				Field:   value.Field,
+				Value:   value.Value,
+			})
+		}
+	}
+
+	for _, err := range errs {
+		event.Errors = append(event.Errors, err.Error())
+	}
+
+	mc.tail.publish(event)
+}
+
+// TailStreamer serves /tail, which streams the messages matching a topic
+// filter as Server-Sent Events
+type TailStreamer struct {
+	collector *MQTTCollector
+}
+
+// NewTailStreamer creates the handler for /tail
+func NewTailStreamer(collector *MQTTCollector) *TailStreamer {
+	return &TailStreamer{
+		collector: collector,
+	}
+}
+
+// ServeHTTP implements http.Handler for /tail?filter=sensor/+/temp. Every
+// message is sent as a "message" event with a JSON TailEvent. When the
+// client falls behind, a "dropped" event reports how many messages it
+// missed.
+func (s *TailStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	if err := topic.ValidateFilter(filter); err != nil {
+		http.Error(w, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber := s.collector.tail.subscribe(filter, s.collector.config.Load().Web.Tail.Buffer)
+	defer s.collector.tail.unsubscribe(subscriber)
+
+	slog.Debug("Tail client connected", "filter", filter, "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Debug("Tail client disconnected", "filter", filter, "remote_addr", r.RemoteAddr)
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-subscriber.events:
+			if dropped := subscriber.dropped.Swap(0); dropped > 0 {
+				if err := writeEvent(w, "dropped", map[string]int64{"dropped": dropped}); err != nil {
+					return
+				}
+			}
+
+			if err := writeEvent(w, "message", event); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a Server-Sent Event with a JSON payload
+func writeEvent(w http.ResponseWriter, name string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encoded)
+
+	return err
+}
@@ -0,0 +1,105 @@
+package collectors
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTailHub_SlowSubscriber checks that a subscriber that does not read
+// never blocks publishing and that its missed events are counted.
+func TestTailHub_SlowSubscriber(t *testing.T) {
+	hub := newTailHub()
+	slow := hub.subscribe("#", 1)
+	other := hub.subscribe("other/#", 1)
+
+	done := make(chan struct{})
+
+	go func() {
+		for range 3 {
+			hub.publish(TailEvent{Topic: "sensor/a"})
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+
+	assert.Len(t, slow.events, 1)
+	assert.Equal(t, int64(2), slow.dropped.Load())
+	assert.Empty(t, other.events)
+	assert.True(t, hub.wants("sensor/a"))
+
+	hub.unsubscribe(slow)
+	hub.unsubscribe(other)
+
+	assert.False(t, hub.wants("sensor/a"))
+}
+
+// TestTailStreamer streams a mapped message through /tail and checks the
+// event, including the values extracted by the mapping.
+func TestTailStreamer(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Web.Tail = config.TailConfig{Enabled: true, PayloadLimit: 256, Buffer: 10}
+	cfg.MQTT.Mappings = []config.MappingConfig{{
+		Name:   "climate",
+		Topic:  "sensor/+/climate",
+		Fields: []string{"temperature", "humidity"},
+	}}
+
+	mc := newTestCollector(t, cfg)
+
+	server := httptest.NewServer(NewTailStreamer(mc))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/tail?filter=sensor/%2B/climate", nil)
+	require.NoError(t, err)
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+
+	defer func() { _ = response.Body.Close() }()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	// The subscription is registered before the headers are sent
+	mc.onMessageReceived(nil, &testMessage{topic: "device/a", payload: []byte("ignored")})
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/a/climate", qos: 1, payload: []byte(`{"temperature": 21.5}`)})
+
+	reader := bufio.NewReader(response.Body)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: message\n", line)
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "data: "))
+
+	var event TailEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+
+	assert.Equal(t, "sensor/a/climate", event.Topic)
+	assert.Equal(t, byte(1), event.QoS)
+	assert.Equal(t, `{"temperature": 21.5}`, event.Payload)
+	assert.Equal(t, []TailValue{{Mapping: "climate", Field: "temperature", Value: 21.5}}, event.Values)
+	require.Len(t, event.Errors, 1)
+	assert.Contains(t, event.Errors[0], "humidity")
+}
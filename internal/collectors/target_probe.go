@@ -0,0 +1,311 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/promexporter/tracing"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// defaultProbeModule is used when /probe is called without a module and no
+// module named "default" is configured
+const defaultProbeModule = "default"
+
+// TargetProber serves the blackbox-style /probe endpoint. Every request
+// makes a fresh connection to the target broker and returns the result in a
+// dedicated registry. The probe modules are read from the collector's
+// configuration, so reloads apply to the next request.
+type TargetProber struct {
+	collector *MQTTCollector
+}
+
+// NewTargetProber creates the handler for /probe
+func NewTargetProber(collector *MQTTCollector) *TargetProber {
+	return &TargetProber{
+		collector: collector,
+	}
+}
+
+// targetProbeMetrics is the dedicated registry returned for a single probe
+type targetProbeMetrics struct {
+	registry        *prometheus.Registry
+	success         prometheus.Gauge
+	duration        prometheus.Gauge
+	connectDuration prometheus.Gauge
+	connackCode     prometheus.Gauge
+	certExpiry      prometheus.Gauge
+	roundTrip       prometheus.Gauge
+}
+
+func newTargetProbeMetrics() *targetProbeMetrics {
+	registry := prometheus.NewRegistry()
+	factory := promauto.With(registry)
+
+	return &targetProbeMetrics{
+		registry: registry,
+		success: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Whether the probe succeeded (1 = success, 0 = failure)",
+		}),
+		duration: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "How long the probe took to complete",
+		}),
+		connectDuration: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_mqtt_connect_duration_seconds",
+			Help: "How long the MQTT connection took to establish",
+		}),
+		connackCode: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_mqtt_connack_return_code",
+			Help: "Return code of the broker's CONNACK packet",
+		}),
+		certExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ssl_earliest_cert_expiry",
+			Help: "Unix timestamp at which the first certificate in the broker's chain expires",
+		}),
+		roundTrip: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_mqtt_round_trip_seconds",
+			Help: "Time between publishing on the module topic and receiving the message back",
+		}),
+	}
+}
+
+// ServeHTTP implements http.Handler for /probe?target=host:port&module=name
+func (p *TargetProber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		moduleName = defaultProbeModule
+	}
+
+	cfg := p.collector.config.Load()
+
+	module, ok := cfg.ProbeModules[moduleName]
+	if !ok {
+		if moduleName != defaultProbeModule {
+			http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+			return
+		}
+
+		module = config.ProbeModuleConfig{Timeout: config.Duration{Duration: 10 * time.Second}}
+	}
+
+	timeout := module.Timeout.Duration
+
+	// Leave Prometheus some headroom to receive the response
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+			scrapeTimeout := time.Duration((seconds - 0.5) * float64(time.Second))
+			if scrapeTimeout > 0 && scrapeTimeout < timeout {
+				timeout = scrapeTimeout
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	metrics := newTargetProbeMetrics()
+
+	start := time.Now()
+	success := p.probe(ctx, cfg.MQTT.ClientID, target, moduleName, module, metrics)
+
+	metrics.duration.Set(time.Since(start).Seconds())
+
+	if success {
+		metrics.success.Set(1)
+	}
+
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probe connects to target and, if the module names a topic, checks that a
+// published message is routed back. It reports whether every step succeeded.
+func (p *TargetProber) probe(ctx context.Context, clientID, target, moduleName string, module config.ProbeModuleConfig, metrics *targetProbeMetrics) bool {
+	tracer := p.collector.app.GetTracer()
+
+	var span *tracing.CollectorSpan
+
+	if tracer != nil && tracer.IsEnabled() {
+		span = tracer.NewCollectorSpan(ctx, "mqtt-collector", "target-probe")
+
+		span.SetAttributes(
+			attribute.String("probe.target", target),
+			attribute.String("probe.module", moduleName),
+		)
+
+		defer span.End()
+	}
+
+	logger := slog.With("target", target, "module", moduleName)
+
+	var (
+		certificatesMu sync.Mutex
+		certificates   []*x509.Certificate
+	)
+
+	tlsConfig, err := newTLSConfig(module.TLS, func(chain []*x509.Certificate) {
+		certificatesMu.Lock()
+		certificates = chain
+		certificatesMu.Unlock()
+	})
+	if err != nil {
+		logger.Error("Failed to build TLS configuration for probe", "error", err)
+		return false
+	}
+
+	deadline, _ := ctx.Deadline()
+	timeout := time.Until(deadline)
+
+	opts := newClientOptions(connectionSettings{
+		broker:         target,
+		clientID:       fmt.Sprintf("%s-probe-%d", clientID, time.Now().UnixNano()),
+		username:       module.Username,
+		password:       module.Password.Value(),
+		tls:            tlsConfig,
+		keepAlive:      timeout,
+		connectTimeout: timeout,
+	})
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+
+	client := MQTT.NewClient(opts)
+
+	// Also aborts a connection that is still being made when the probe
+	// times out, which would otherwise complete later and never be closed
+	defer client.Disconnect(0)
+
+	connectStart := time.Now()
+	token := client.Connect()
+
+	if !token.WaitTimeout(timeout) {
+		logger.Warn("Probe connection timed out", "timeout", timeout)
+
+		if span != nil {
+			span.AddEvent("connect_timeout")
+		}
+
+		return false
+	}
+
+	metrics.connectDuration.Set(time.Since(connectStart).Seconds())
+
+	if connectToken, ok := token.(*MQTT.ConnectToken); ok {
+		metrics.connackCode.Set(float64(connectToken.ReturnCode()))
+	}
+
+	if tlsConfig != nil {
+		certificatesMu.Lock()
+		if expiry, ok := earliestExpiry(certificates); ok {
+			metrics.registry.MustRegister(metrics.certExpiry)
+			metrics.certExpiry.Set(float64(expiry.Unix()))
+		}
+		certificatesMu.Unlock()
+	}
+
+	if err := token.Error(); err != nil {
+		logger.Warn("Probe connection failed", "error", err)
+
+		if span != nil {
+			span.RecordError(err, attribute.String("operation", "mqtt_connect"))
+		}
+
+		return false
+	}
+
+	if module.Topic == "" {
+		return true
+	}
+
+	metrics.registry.MustRegister(metrics.roundTrip)
+
+	roundTrip, err := probeRoundTrip(ctx, client, module)
+	if err != nil {
+		logger.Warn("Probe round trip failed", "topic", module.Topic, "error", err)
+
+		if span != nil {
+			span.RecordError(err, attribute.String("operation", "round_trip"))
+		}
+
+		return false
+	}
+
+	metrics.roundTrip.Set(roundTrip.Seconds())
+
+	return true
+}
+
+// probeRoundTrip subscribes to the module topic, publishes on it and waits
+// until the broker delivers the message back. Other messages on the topic,
+// such as a retained one or another probe's, are ignored.
+func probeRoundTrip(ctx context.Context, client MQTT.Client, module config.ProbeModuleConfig) (time.Duration, error) {
+	deadline, _ := ctx.Deadline()
+	qos := byte(module.QoS) //nolint:gosec // G115: QoS is always 0, 1, or 2; no overflow possible
+	received := make(chan time.Time, 1)
+
+	nonce := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	token := client.Subscribe(module.Topic, qos, func(_ MQTT.Client, msg MQTT.Message) {
+		if !bytes.Equal(msg.Payload(), nonce) {
+			return
+		}
+
+		select {
+		case received <- time.Now():
+		default:
+		}
+	})
+	if !token.WaitTimeout(time.Until(deadline)) {
+		return 0, fmt.Errorf("subscribe timed out")
+	} else if err := token.Error(); err != nil {
+		return 0, fmt.Errorf("subscribe failed: %w", err)
+	}
+
+	sent := time.Now()
+
+	token = client.Publish(module.Topic, qos, false, nonce)
+	if !token.WaitTimeout(time.Until(deadline)) {
+		return 0, fmt.Errorf("publish timed out")
+	} else if err := token.Error(); err != nil {
+		return 0, fmt.Errorf("publish failed: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0, fmt.Errorf("message was not delivered back: %w", ctx.Err())
+	case receivedAt := <-received:
+		return receivedAt.Sub(sent), nil
+	}
+}
+
+// earliestExpiry returns the earliest NotAfter in a certificate chain
+func earliestExpiry(chain []*x509.Certificate) (time.Time, bool) {
+	var earliest time.Time
+
+	for _, certificate := range chain {
+		if earliest.IsZero() || certificate.NotAfter.Before(earliest) {
+			earliest = certificate.NotAfter
+		}
+	}
+
+	return earliest, !earliest.IsZero()
+}
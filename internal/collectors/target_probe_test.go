@@ -0,0 +1,122 @@
+package collectors
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTargetProber(t *testing.T) *TargetProber {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Logging.Level = "error"
+	cfg.Logging.Format = "json"
+	cfg.MQTT.ClientID = "mqtt-exporter-test"
+
+	return NewTargetProber(newTestCollector(t, cfg))
+}
+
+func TestTargetProber_BadRequests(t *testing.T) {
+	prober := newTestTargetProber(t)
+
+	for _, url := range []string{"/probe", "/probe?target=localhost:1883&module=missing"} {
+		recorder := httptest.NewRecorder()
+		prober.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, url)
+	}
+}
+
+// TestTargetProber_Unreachable checks that a failed connection is reported
+// through probe_success rather than an HTTP error.
+func TestTargetProber_Unreachable(t *testing.T) {
+	prober := newTestTargetProber(t)
+
+	// Grab a free port and close it again so nothing is listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	target := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	recorder := httptest.NewRecorder()
+	prober.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/probe?target="+target, nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.Contains(recorder.Body.String(), "probe_success 0"), recorder.Body.String())
+}
+
+// TestTargetProber_RoundTrip checks a successful probe of a broker, with a
+// message routed back on the module topic.
+func TestTargetProber_RoundTrip(t *testing.T) {
+	b := startTestBroker(t, integrationConfig(t))
+	defer b.Stop()
+
+	prober := newTestTargetProber(t)
+
+	// Modules added by a reload apply to the next probe
+	cfg := *prober.collector.config.Load()
+	cfg.ProbeModules = map[string]config.ProbeModuleConfig{
+		"routing": {Timeout: config.Duration{Duration: 5 * time.Second}, Topic: "mqtt-exporter/probe/routing", QoS: 1},
+	}
+	require.NoError(t, prober.collector.Reload(&cfg))
+
+	for _, module := range []string{"", "routing"} {
+		recorder := httptest.NewRecorder()
+		prober.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/probe?target="+b.Address()+"&module="+module, nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		body := recorder.Body.String()
+		assert.Contains(t, body, "probe_success 1", module)
+		assert.Contains(t, body, "probe_mqtt_connack_return_code 0", module)
+		assert.Equal(t, module != "", strings.Contains(body, "probe_mqtt_round_trip_seconds"), module)
+	}
+}
+
+// unroutedClient is an MQTT client whose broker holds a retained message on
+// every topic but doesn't route published messages back
+type unroutedClient struct {
+	MQTT.Client
+}
+
+func (c unroutedClient) Subscribe(topic string, _ byte, handler MQTT.MessageHandler) MQTT.Token {
+	handler(c, &testMessage{topic: topic, payload: []byte("1700000000000000000"), retained: true})
+	return completedToken{}
+}
+
+func (unroutedClient) Publish(string, byte, bool, any) MQTT.Token { return completedToken{} }
+
+// completedToken is a completed token that succeeded
+type completedToken struct{}
+
+func (completedToken) Wait() bool                     { return true }
+func (completedToken) WaitTimeout(time.Duration) bool { return true }
+func (completedToken) Error() error                   { return nil }
+
+func (completedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+
+	return done
+}
+
+// TestProbeRoundTrip_OtherMessages checks that only the probe's own message
+// completes the round trip, not a retained message already on the topic.
+func TestProbeRoundTrip_OtherMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := probeRoundTrip(ctx, unroutedClient{}, config.ProbeModuleConfig{Topic: "probe/roundtrip", QoS: 1})
+	assert.ErrorContains(t, err, "message was not delivered back")
+}
@@ -0,0 +1,235 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
+)
+
+const (
+	defaultTopicsLimit = 100
+	maxTopicsLimit     = 1000
+)
+
+// TopicInfo is what /topics reports about a topic
+type TopicInfo struct {
+	Topic            string    `json:"topic"`
+	Messages         int64     `json:"messages"`
+	Bytes            int64     `json:"bytes"`
+	LastSeen         time.Time `json:"last_seen"`
+	Retained         bool      `json:"retained"`
+	Size             int       `json:"size"`
+	Payload          *string   `json:"payload,omitempty"`
+	PayloadTruncated bool      `json:"payload_truncated,omitempty"`
+}
+
+// TopicPage is a page of the topics matching a filter
+type TopicPage struct {
+	Filter string      `json:"filter"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Topics []TopicInfo `json:"topics"`
+}
+
+// Topics returns every topic seen so far that matches filter, sorted by
+// name. The last payload is only included when payload capture is enabled.
+func (mc *MQTTCollector) Topics(filter string) []TopicInfo {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	topics := make([]TopicInfo, 0, len(mc.topics))
+
+	for name, state := range mc.topics {
+		if !topic.Match(filter, name) {
+			continue
+		}
+
+		info := TopicInfo{
+			Topic:    name,
+			Messages: state.messages,
+			Bytes:    state.bytes,
+			LastSeen: state.lastSeen,
+			Retained: state.retained,
+			Size:     state.size,
+		}
+
+		if mc.config.Load().Web.Topics.CapturePayloads {
+			payload := string(state.payload)
+			info.Payload = &payload
+			info.PayloadTruncated = len(state.payload) < state.size
+		}
+
+		topics = append(topics, info)
+	}
+
+	slices.SortFunc(topics, func(a, b TopicInfo) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+
+	return topics
+}
+
+// TopicBrowser serves /topics, the list of topics the collector has seen, as
+// JSON or as an HTML page
+type TopicBrowser struct {
+	collector *MQTTCollector
+}
+
+// NewTopicBrowser creates the handler for /topics
+func NewTopicBrowser(collector *MQTTCollector) *TopicBrowser {
+	return &TopicBrowser{
+		collector: collector,
+	}
+}
+
+// ServeHTTP implements http.Handler for
+// /topics?filter=sensor/#&offset=0&limit=100&format=json|html
+func (b *TopicBrowser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := query.Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	if err := topic.ValidateFilter(filter); err != nil {
+		http.Error(w, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	offset, err := queryInt(query, "offset", 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryInt(query, "limit", defaultTopicsLimit)
+	if err != nil || limit < 1 || limit > maxTopicsLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxTopicsLimit), http.StatusBadRequest)
+		return
+	}
+
+	// Offsets past the end are clamped so that offset+limit can't overflow,
+	// here or in the page links.
+	topics := b.collector.Topics(filter)
+	offset = min(offset, len(topics))
+	page := TopicPage{
+		Filter: filter,
+		Total:  len(topics),
+		Offset: offset,
+		Limit:  limit,
+		Topics: topics[offset : offset+min(limit, len(topics)-offset)],
+	}
+
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		if err := topicsTemplate.Execute(w, page); err != nil {
+			slog.Error("Failed to render topics page", "error", err)
+		}
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		slog.Error("Failed to encode topics", "error", err)
+	}
+}
+
+// queryInt parses an optional integer query parameter
+func queryInt(query url.Values, name string, fallback int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// wantsHTML reports whether the client asked for the HTML view, either with
+// format=html or, for browsers, through the Accept header
+func wantsHTML(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "html":
+		return true
+	case "json":
+		return false
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// pageURL returns the /topics URL for another page of the same filter
+func pageURL(page TopicPage, offset int) string {
+	query := url.Values{}
+	query.Set("filter", page.Filter)
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(page.Limit))
+	query.Set("format", "html")
+
+	return "?" + query.Encode()
+}
+
+var topicsTemplate = template.Must(template.New("topics").Funcs(template.FuncMap{
+	"previous": func(page TopicPage) string {
+		return pageURL(page, max(page.Offset-page.Limit, 0))
+	},
+	"next": func(page TopicPage) string {
+		return pageURL(page, page.Offset+page.Limit)
+	},
+	"hasNext": func(page TopicPage) bool {
+		return page.Offset+page.Limit < page.Total
+	},
+	"timestamp": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>MQTT Exporter - Topics</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.payload { font-family: monospace; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Topics</h1>
+<form method="get">
+<input type="hidden" name="format" value="html">
+<input type="hidden" name="limit" value="{{.Limit}}">
+<label>Filter <input type="text" name="filter" value="{{.Filter}}"></label>
+<button type="submit">Apply</button>
+</form>
+<p>{{.Total}} topics{{if .Topics}}, showing {{len .Topics}} from {{.Offset}}{{end}}</p>
+<table>
+<tr><th>Topic</th><th>Messages</th><th>Bytes</th><th>Last seen</th><th>Retained</th><th>Payload</th></tr>
+{{range .Topics}}<tr>
+<td>{{.Topic}}</td>
+<td>{{.Messages}}</td>
+<td>{{.Bytes}}</td>
+<td>{{timestamp .LastSeen}}</td>
+<td>{{.Retained}}</td>
+<td class="payload">{{if .Payload}}{{.Payload}}{{if .PayloadTruncated}}…{{end}}{{end}}</td>
+</tr>
+{{end}}</table>
+<p>
+{{if gt .Offset 0}}<a href="{{previous .}}">Previous</a>{{end}}
+{{if hasNext .}}<a href="{{next .}}">Next</a>{{end}}
+</p>
+</body>
+</html>
+`))
@@ -0,0 +1,111 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTopics(t *testing.T, browser *TopicBrowser, target string) TopicPage {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	browser.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var page TopicPage
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+
+	return page
+}
+
+// TestTopicBrowser_FilterAndPagination checks the topic list, its wildcard
+// filter and pagination, and that payloads are left out unless captured.
+func TestTopicBrowser_FilterAndPagination(t *testing.T) {
+	cfg := &config.Config{}
+	mc := newTestCollector(t, cfg)
+	browser := NewTopicBrowser(mc)
+
+	for _, name := range []string{"sensor/c/temp", "sensor/a/temp", "sensor/b/temp", "sensor/a/humidity"} {
+		mc.onMessageReceived(nil, &testMessage{topic: name, payload: []byte("21.5")})
+	}
+
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/a/temp", payload: []byte("22"), retained: true})
+
+	page := getTopics(t, browser, "/topics")
+	assert.Equal(t, 4, page.Total)
+	assert.Equal(t, "#", page.Filter)
+	require.Len(t, page.Topics, 4)
+	assert.Equal(t, "sensor/a/humidity", page.Topics[0].Topic)
+
+	temp := page.Topics[1]
+	assert.Equal(t, "sensor/a/temp", temp.Topic)
+	assert.Equal(t, int64(2), temp.Messages)
+	assert.Equal(t, int64(6), temp.Bytes)
+	assert.True(t, temp.Retained)
+	assert.False(t, temp.LastSeen.IsZero())
+	assert.Nil(t, temp.Payload)
+
+	page = getTopics(t, browser, "/topics?filter=sensor/%2B/temp&offset=1&limit=1")
+	assert.Equal(t, 3, page.Total)
+	require.Len(t, page.Topics, 1)
+	assert.Equal(t, "sensor/b/temp", page.Topics[0].Topic)
+
+	page = getTopics(t, browser, "/topics?offset=10")
+	assert.Equal(t, 4, page.Total)
+	assert.Empty(t, page.Topics)
+
+	page = getTopics(t, browser, fmt.Sprintf("/topics?offset=%d", math.MaxInt))
+	assert.Equal(t, 4, page.Offset)
+	assert.Empty(t, page.Topics)
+
+	recorder := httptest.NewRecorder()
+	browser.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics?format=html&offset=%d", math.MaxInt), nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "Next")
+
+	for _, target := range []string{"/topics?filter=sensor/%23/temp", "/topics?limit=0", "/topics?offset=-1"} {
+		recorder := httptest.NewRecorder()
+		browser.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, target)
+	}
+}
+
+// TestTopicBrowser_Payloads checks that captured payloads are truncated and
+// that the HTML view escapes them.
+func TestTopicBrowser_Payloads(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Web.Topics = config.TopicBrowserConfig{CapturePayloads: true, PayloadLimit: 8}
+	mc := newTestCollector(t, cfg)
+	browser := NewTopicBrowser(mc)
+
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/a", payload: []byte("<b>21.5</b>")})
+	mc.onMessageReceived(nil, &testMessage{topic: "sensor/b", payload: []byte("short")})
+
+	page := getTopics(t, browser, "/topics")
+	require.Len(t, page.Topics, 2)
+	require.NotNil(t, page.Topics[0].Payload)
+	assert.Equal(t, "<b>21.5<", *page.Topics[0].Payload)
+	assert.True(t, page.Topics[0].PayloadTruncated)
+	assert.Equal(t, 11, page.Topics[0].Size)
+	require.NotNil(t, page.Topics[1].Payload)
+	assert.Equal(t, "short", *page.Topics[1].Payload)
+	assert.False(t, page.Topics[1].PayloadTruncated)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/topics", nil)
+	request.Header.Set("Accept", "text/html")
+	browser.ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, recorder.Body.String(), "&lt;b&gt;21.5&lt;…")
+	assert.Contains(t, recorder.Body.String(), "<td>sensor/b</td>")
+}
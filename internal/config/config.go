@@ -1,12 +1,17 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
 	promexporter_config "github.com/d0ugal/promexporter/config"
 	"gopkg.in/yaml.v3"
 )
@@ -15,27 +20,392 @@ import (
 type Duration = promexporter_config.Duration
 
 type Config struct {
-	promexporter_config.BaseConfig
+	promexporter_config.BaseConfig `yaml:",inline"`
 
-	MQTT MQTTConfig `yaml:"mqtt"`
+	Mode           string                       `yaml:"mode"`
+	EmbeddedBroker EmbeddedBrokerConfig         `yaml:"embedded_broker"`
+	MQTT           MQTTConfig                   `yaml:"mqtt"`
+	Web            WebConfig                    `yaml:"web"`
+	ProbeModules   map[string]ProbeModuleConfig `yaml:"probe_modules"`
+	Reload         ReloadConfig                 `yaml:"reload"`
+	State          StateConfig                  `yaml:"state"`
+}
+
+// Modes the exporter runs in. In client mode it connects to an existing
+// broker; in embedded broker mode it is the broker, and subscribes to itself.
+const (
+	ModeClient         = "client"
+	ModeEmbeddedBroker = "embedded-broker"
+)
+
+// EmbeddedBrokerConfig configures the broker run in embedded broker mode.
+// Without users any client can connect; with users only they and the
+// exporter itself, with the mqtt username and password, can.
+type EmbeddedBrokerConfig struct {
+	Address string             `yaml:"address"`
+	Users   []BrokerUserConfig `yaml:"users,omitempty"`
+}
+
+// BrokerUserConfig is a user allowed to connect to the embedded broker
+type BrokerUserConfig struct {
+	Username string          `yaml:"username"`
+	Password SensitiveString `yaml:"password"`
+}
+
+// ReloadConfig configures reloading the configuration file while running.
+// SIGHUP and POST /-/reload always reload it; with Watch set, the file is
+// also checked for changes every WatchInterval.
+type ReloadConfig struct {
+	Watch         bool     `yaml:"watch"`
+	WatchInterval Duration `yaml:"watch_interval"`
+}
+
+// StateConfig saves the per-topic counters, last message timestamps and
+// last payload values to File every Interval and when the exporter stops,
+// and restores them at startup, so that counters are not reset by restarts.
+// Disabled when File is empty.
+type StateConfig struct {
+	File     string   `yaml:"file"`
+	Interval Duration `yaml:"interval"`
+}
+
+// SensitiveString wraps the promexporter SensitiveString so that it can be
+// loaded from YAML. It is still redacted whenever it is displayed.
+type SensitiveString struct {
+	promexporter_config.SensitiveString
+}
+
+// NewSensitiveString creates a new SensitiveString with the given value
+func NewSensitiveString(value string) SensitiveString {
+	return SensitiveString{SensitiveString: promexporter_config.NewSensitiveString(value)}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *SensitiveString) UnmarshalYAML(value *yaml.Node) error {
+	var raw string
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	*s = NewSensitiveString(raw)
+
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler, writing the redacted value. Unset
+// values stay empty so that they do not read back as a secret.
+func (s SensitiveString) MarshalYAML() (interface{}, error) {
+	if s.IsEmpty() {
+		return "", nil
+	}
+
+	return s.String(), nil
+}
+
+// TLSConfig configures TLS for a broker connection
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// WebConfig configures the additional HTTP server for the exporter's own
+// endpoints, which runs next to the promexporter server. It always serves
+// /ready; Enabled adds the other endpoints, which expose the topics and
+// payloads seen, make outbound connections or change state.
+type WebConfig struct {
+	Enabled bool               `yaml:"enabled"`
+	Host    string             `yaml:"host"`
+	Port    int                `yaml:"port"`
+	Topics  TopicBrowserConfig `yaml:"topics"`
+	Tail    TailConfig         `yaml:"tail"`
+}
+
+// TailConfig configures the /tail endpoint, which streams received messages
+// and their payloads, so it has to be enabled explicitly. Every client can
+// fall Buffer messages behind before messages are dropped for it.
+type TailConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	PayloadLimit int  `yaml:"payload_limit"`
+	Buffer       int  `yaml:"buffer"`
+}
+
+// TopicBrowserConfig configures the /topics endpoint. Payloads may contain
+// personal data, so the last payload of each topic is only kept when
+// CapturePayloads is set, truncated to PayloadLimit bytes.
+type TopicBrowserConfig struct {
+	CapturePayloads bool `yaml:"capture_payloads"`
+	PayloadLimit    int  `yaml:"payload_limit"`
+}
+
+// ProbeModuleConfig describes how the /probe endpoint connects to a target
+type ProbeModuleConfig struct {
+	Username string          `yaml:"username"`
+	Password SensitiveString `yaml:"password"`
+	TLS      TLSConfig       `yaml:"tls"`
+	Timeout  Duration        `yaml:"timeout"`
+	// Topic, if set, is subscribed to and published on to check routing
+	Topic string `yaml:"topic"`
+	QoS   int    `yaml:"qos"`
 }
 
 type MQTTConfig struct {
-	Broker         string                              `yaml:"broker"`
-	ClientID       string                              `yaml:"client_id"`
-	Username       string                              `yaml:"username"`
-	Password       promexporter_config.SensitiveString `yaml:"password"`
-	Topics         []string                            `yaml:"topics"`
-	QoS            int                                 `yaml:"qos"`
-	CleanSession   bool                                `yaml:"clean_session"`
-	KeepAlive      Duration                            `yaml:"keep_alive"`
-	ConnectTimeout Duration                            `yaml:"connect_timeout"`
+	Broker         string               `yaml:"broker"`
+	ClientID       string               `yaml:"client_id"`
+	Username       string               `yaml:"username"`
+	Password       SensitiveString      `yaml:"password"`
+	Topics         []string             `yaml:"topics"`
+	QoS            int                  `yaml:"qos"`
+	CleanSession   bool                 `yaml:"clean_session"`
+	SessionStore   string               `yaml:"session_store"`
+	SessionDir     string               `yaml:"session_dir"`
+	KeepAlive      Duration             `yaml:"keep_alive"`
+	ConnectTimeout Duration             `yaml:"connect_timeout"`
+	SkipRetained   bool                 `yaml:"skip_retained"`
+	MessageLabels  MessageLabelsConfig  `yaml:"message_labels"`
+	Mappings       []MappingConfig      `yaml:"mappings"`
+	Probe          ProbeConfig          `yaml:"probe"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Availability   []AvailabilityConfig `yaml:"availability"`
+	Heartbeats     []HeartbeatConfig    `yaml:"heartbeats"`
+	Processing     ProcessingConfig     `yaml:"processing"`
+	Tracing        MessageTracingConfig `yaml:"tracing"`
+	Record         RecordConfig         `yaml:"record"`
+	Replica        string               `yaml:"replica"`
+	Shared         SharedConfig         `yaml:"shared_subscription"`
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+	Status         StatusConfig         `yaml:"status"`
+}
+
+// MessageTracingConfig controls which received messages are traced when
+// tracing is enabled. SampleRatio (default 1) is the fraction of messages
+// traced, unless the first rule matching the topic sets another ratio. With
+// SlowThreshold set, only sampled messages whose processing took at least
+// that long are traced. ConnectionOnly disables message tracing and keeps the
+// connection lifecycle spans. TraceparentField and TracestateField are the
+// dotted paths of the W3C trace context in JSON payloads; message spans join
+// the producer's trace when they are set. With ParentBased, messages
+// carrying a trace context follow the producer's sampling decision instead
+// of the sample ratio and rules.
+type MessageTracingConfig struct {
+	ConnectionOnly   bool                `yaml:"connection_only"`
+	SampleRatio      *float64            `yaml:"sample_ratio,omitempty"`
+	SlowThreshold    Duration            `yaml:"slow_threshold"`
+	Rules            []TracingRuleConfig `yaml:"rules"`
+	TraceparentField string              `yaml:"traceparent_field"`
+	TracestateField  string              `yaml:"tracestate_field"`
+	ParentBased      bool                `yaml:"parent_based"`
+}
+
+// TracingRuleConfig sets the sample ratio of the topics matching Topic
+type TracingRuleConfig struct {
+	Topic       string  `yaml:"topic"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// SharedConfig runs the exporter as one replica of a group. Every replica
+// subscribes to the topics as the shared subscription $share/<Group>/<topic>,
+// so the broker delivers each message to only one replica of the group.
+type SharedConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Group   string `yaml:"group"`
+}
+
+// LeaderElectionConfig runs the exporter as one replica of an active/standby
+// group. The replicas elect a leader with a retained lock on Topic, which
+// the leader releases through its Will when it loses its connection and
+// renews every third of Lease. Only the leader subscribes to the topics; the
+// standbys stay connected and take over when the lock is released or not
+// renewed within Lease.
+type LeaderElectionConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Topic   string   `yaml:"topic"`
+	Lease   Duration `yaml:"lease"`
+}
+
+// StatusConfig publishes the exporter's own status for MQTT-native
+// monitoring. Online is published retained on Topic when the exporter
+// connects, and Offline when it stops or, as its Will, by the broker when it
+// loses the connection. With leader election the Will releases the leader
+// lock instead, as a connection has a single Will, so a lost connection
+// leaves the status online. With SummaryInterval set, a JSON summary of the
+// topics seen, the message rate and the errors is published on SummaryTopic
+// every interval.
+type StatusConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	Topic           string   `yaml:"topic"`
+	Online          string   `yaml:"online"`
+	Offline         string   `yaml:"offline"`
+	SummaryTopic    string   `yaml:"summary_topic"`
+	SummaryInterval Duration `yaml:"summary_interval"`
+}
+
+// DefaultClientID is the MQTT client ID used when none is configured
+const DefaultClientID = "mqtt-exporter"
+
+// Replicated reports whether the exporter runs as one of several replicas,
+// with shared subscriptions or leader election. Every replica connects with
+// its client ID suffixed with Replica, and its metrics get a replica label.
+func (m *MQTTConfig) Replicated() bool {
+	return m.Shared.Enabled || m.LeaderElection.Enabled
+}
+
+// ConnectClientID returns the client ID the exporter connects with. Replicas
+// suffix the client ID with the replica, so that replicas sharing a
+// configuration don't take over each other's connection.
+func (m *MQTTConfig) ConnectClientID() string {
+	if m.Replicated() {
+		return m.ClientID + "-" + m.Replica
+	}
+
+	return m.ClientID
+}
+
+// SubscriptionFilter returns the filter the exporter subscribes to for
+// topic, which is shared by the group with shared subscriptions
+func (m *MQTTConfig) SubscriptionFilter(topic string) string {
+	if m.Shared.Enabled {
+		return "$share/" + m.Shared.Group + "/" + topic
+	}
+
+	return topic
+}
+
+// ReplicaLabel returns the value of the replica label of the metrics, or ""
+// when the exporter is not replicated and the metrics have no such label
+func (m *MQTTConfig) ReplicaLabel() string {
+	if m.Replicated() {
+		return m.Replica
+	}
+
+	return ""
+}
+
+// Session stores keep the in-flight QoS 1 and 2 messages of the MQTT
+// session. The file store keeps them in SessionDir across restarts, which
+// together with clean_session false lets the broker hand over what it
+// queued while the exporter was down.
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreFile   = "file"
+)
+
+// Overflow policies for the processing queue
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+)
+
+// RecordConfig writes every received message to a capture file that the
+// replay subcommand can feed back through the pipeline. File names ending in
+// .gz are gzip compressed. MaxMessages stops recording after that many
+// messages, 0 records until the exporter stops.
+type RecordConfig struct {
+	File        string `yaml:"file"`
+	MaxMessages int    `yaml:"max_messages"`
+}
+
+// ProcessingConfig sizes the worker pool that processes received messages.
+// With no workers, the default, messages are processed inline by the MQTT
+// client in the order they arrived. Messages are spread over the workers by
+// topic, so the messages of a topic are always processed in order.
+// QueueSize is the number of messages each worker can have waiting, and
+// Overflow decides what happens when a worker's queue is full.
+type ProcessingConfig struct {
+	Workers   int    `yaml:"workers"`
+	QueueSize int    `yaml:"queue_size"`
+	Overflow  string `yaml:"overflow"`
+}
+
+// HeartbeatConfig declares how often the topics matching Topic are expected
+// to publish. A topic is silent once nothing arrived for Missed intervals.
+// Expected lists concrete topics that are tracked even before they publish.
+type HeartbeatConfig struct {
+	Topic    string   `yaml:"topic"`
+	Interval Duration `yaml:"interval"`
+	Missed   int      `yaml:"missed"`
+	Expected []string `yaml:"expected"`
+}
+
+// AvailabilityConfig tracks devices announcing their state on the topics
+// matching Topic, typically a retained status message with a Last Will. The
+// device name is made of the topic levels matched by the wildcards.
+type AvailabilityConfig struct {
+	Topic   string `yaml:"topic"`
+	Online  string `yaml:"online"`
+	Offline string `yaml:"offline"`
+}
+
+// ProbeConfig configures the round-trip probe, which publishes a message on
+// Topic every metrics.collection.default_interval and waits for the broker
+// to deliver it back
+type ProbeConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Topic   string   `yaml:"topic"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+// MessageLabelsConfig opts in to extra labels on mqtt_messages_total. Each
+// label multiplies the number of series per topic, so they are off by default.
+type MessageLabelsConfig struct {
+	QoS bool `yaml:"qos"`
+	Dup bool `yaml:"dup"`
+}
+
+// MappingConfig extracts values from the JSON payloads of the topics matching
+// Topic (an MQTT topic filter)
+type MappingConfig struct {
+	Name      string          `yaml:"name"`
+	Topic     string          `yaml:"topic"`
+	Fields    []string        `yaml:"fields"`
+	Timestamp TimestampConfig `yaml:"timestamp"`
+	Sequence  SequenceConfig  `yaml:"sequence"`
+}
+
+// TimestampConfig names the payload field carrying the device-side timestamp
+type TimestampConfig struct {
+	Field string `yaml:"field"`
+	// Format is one of auto, unix, unix_ms or rfc3339
+	Format string `yaml:"format"`
+	// Export attaches the device timestamp to the extracted values
+	Export bool `yaml:"export"`
+}
+
+// SequenceConfig names the payload field carrying a per-topic sequence number
+type SequenceConfig struct {
+	Field string `yaml:"field"`
+	// ReorderWindow is how far behind the last sequence number a skipped one
+	// may still arrive as a reordered message rather than being lost, and
+	// how far a sequence number may go backwards without being a counter
+	// reset
+	ReorderWindow int `yaml:"reorder_window"`
+	// Device names the payload field identifying the device, for topics
+	// shared by devices that each keep their own sequence
+	Device string `yaml:"device"`
 }
 
 // LoadConfig loads configuration with priority: env vars > yaml file > defaults.
 // The yaml file is optional; if path is empty or the file does not exist it is
 // silently skipped. Environment variables are always applied on top.
 func LoadConfig(path string) (*Config, error) {
+	cfg, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Parse loads the configuration like LoadConfig but does not validate it
+func Parse(path string) (*Config, error) {
 	var cfg Config
 
 	if path != "" {
@@ -56,11 +426,43 @@ func LoadConfig(path string) (*Config, error) {
 	applyEnvVars(&cfg)
 	setDefaults(&cfg)
 
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	return &cfg, nil
+}
+
+// Marshal encodes the configuration as YAML in the format LoadConfig reads,
+// with passwords and tracing headers redacted
+func Marshal(cfg *Config) ([]byte, error) {
+	redacted := *cfg
+
+	if len(cfg.Tracing.Headers) > 0 {
+		redacted.Tracing.Headers = make(map[string]string, len(cfg.Tracing.Headers))
+		for name, value := range cfg.Tracing.Headers {
+			redacted.Tracing.Headers[name] = NewSensitiveString(value).String()
+		}
 	}
 
-	return &cfg, nil
+	var node yaml.Node
+	if err := node.Encode(&redacted); err != nil {
+		return nil, err
+	}
+
+	flattenDurations(&node)
+
+	return yaml.Marshal(&node)
+}
+
+// flattenDurations rewrites the {duration: 30s} mappings yaml.v3 produces for
+// Duration, which has no MarshalYAML, into plain "30s" scalars
+func flattenDurations(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode && len(node.Content) == 2 &&
+		node.Content[0].Value == "duration" && node.Content[1].Kind == yaml.ScalarNode {
+		*node = *node.Content[1]
+		return
+	}
+
+	for _, child := range node.Content {
+		flattenDurations(child)
+	}
 }
 
 // applyEnvVars overlays MQTT-exporter environment variables onto cfg.
@@ -91,6 +493,82 @@ func applyEnvVars(cfg *Config) {
 		}
 	}
 
+	if webEnabledStr := os.Getenv("MQTT_EXPORTER_WEB_ENABLED"); webEnabledStr != "" {
+		if webEnabled, err := strconv.ParseBool(webEnabledStr); err == nil {
+			cfg.Web.Enabled = webEnabled
+		}
+	}
+
+	if webHost := os.Getenv("MQTT_EXPORTER_WEB_HOST"); webHost != "" {
+		cfg.Web.Host = webHost
+	}
+
+	if webPortStr := os.Getenv("MQTT_EXPORTER_WEB_PORT"); webPortStr != "" {
+		if webPort, err := strconv.Atoi(webPortStr); err == nil {
+			cfg.Web.Port = webPort
+		}
+	}
+
+	if capturePayloadsStr := os.Getenv("MQTT_EXPORTER_WEB_TOPICS_CAPTURE_PAYLOADS"); capturePayloadsStr != "" {
+		if capturePayloads, err := strconv.ParseBool(capturePayloadsStr); err == nil {
+			cfg.Web.Topics.CapturePayloads = capturePayloads
+		}
+	}
+
+	if payloadLimitStr := os.Getenv("MQTT_EXPORTER_WEB_TOPICS_PAYLOAD_LIMIT"); payloadLimitStr != "" {
+		if payloadLimit, err := strconv.Atoi(payloadLimitStr); err == nil {
+			cfg.Web.Topics.PayloadLimit = payloadLimit
+		}
+	}
+
+	if tailEnabledStr := os.Getenv("MQTT_EXPORTER_WEB_TAIL_ENABLED"); tailEnabledStr != "" {
+		if tailEnabled, err := strconv.ParseBool(tailEnabledStr); err == nil {
+			cfg.Web.Tail.Enabled = tailEnabled
+		}
+	}
+
+	if tailPayloadLimitStr := os.Getenv("MQTT_EXPORTER_WEB_TAIL_PAYLOAD_LIMIT"); tailPayloadLimitStr != "" {
+		if tailPayloadLimit, err := strconv.Atoi(tailPayloadLimitStr); err == nil {
+			cfg.Web.Tail.PayloadLimit = tailPayloadLimit
+		}
+	}
+
+	if tailBufferStr := os.Getenv("MQTT_EXPORTER_WEB_TAIL_BUFFER"); tailBufferStr != "" {
+		if tailBuffer, err := strconv.Atoi(tailBufferStr); err == nil {
+			cfg.Web.Tail.Buffer = tailBuffer
+		}
+	}
+
+	if watchStr := os.Getenv("MQTT_EXPORTER_RELOAD_WATCH"); watchStr != "" {
+		if watch, err := strconv.ParseBool(watchStr); err == nil {
+			cfg.Reload.Watch = watch
+		}
+	}
+
+	if watchIntervalStr := os.Getenv("MQTT_EXPORTER_RELOAD_WATCH_INTERVAL"); watchIntervalStr != "" {
+		if watchInterval, err := time.ParseDuration(watchIntervalStr); err == nil {
+			cfg.Reload.WatchInterval = Duration{Duration: watchInterval}
+		}
+	}
+
+	if stateFile := os.Getenv("MQTT_EXPORTER_STATE_FILE"); stateFile != "" {
+		cfg.State.File = stateFile
+	}
+
+	if stateIntervalStr := os.Getenv("MQTT_EXPORTER_STATE_INTERVAL"); stateIntervalStr != "" {
+		if stateInterval, err := time.ParseDuration(stateIntervalStr); err == nil {
+			cfg.State.Interval = Duration{Duration: stateInterval}
+		}
+	}
+
+	if mode := os.Getenv("MQTT_EXPORTER_MODE"); mode != "" {
+		cfg.Mode = mode
+	}
+
+	if brokerAddress := os.Getenv("MQTT_EXPORTER_EMBEDDED_BROKER_ADDRESS"); brokerAddress != "" {
+		cfg.EmbeddedBroker.Address = brokerAddress
+	}
+
 	if broker := os.Getenv("MQTT_EXPORTER_MQTT_BROKER"); broker != "" {
 		cfg.MQTT.Broker = broker
 	}
@@ -104,7 +582,7 @@ func applyEnvVars(cfg *Config) {
 	}
 
 	if password := os.Getenv("MQTT_EXPORTER_MQTT_PASSWORD"); password != "" {
-		cfg.MQTT.Password = promexporter_config.NewSensitiveString(password)
+		cfg.MQTT.Password = NewSensitiveString(password)
 	}
 
 	if topicsStr := os.Getenv("MQTT_EXPORTER_MQTT_TOPICS"); topicsStr != "" {
@@ -123,6 +601,72 @@ func applyEnvVars(cfg *Config) {
 		}
 	}
 
+	if sessionStore := os.Getenv("MQTT_EXPORTER_MQTT_SESSION_STORE"); sessionStore != "" {
+		cfg.MQTT.SessionStore = sessionStore
+	}
+
+	if sessionDir := os.Getenv("MQTT_EXPORTER_MQTT_SESSION_DIR"); sessionDir != "" {
+		cfg.MQTT.SessionDir = sessionDir
+	}
+
+	if sharedStr := os.Getenv("MQTT_EXPORTER_MQTT_SHARED_SUBSCRIPTION_ENABLED"); sharedStr != "" {
+		if shared, err := strconv.ParseBool(sharedStr); err == nil {
+			cfg.MQTT.Shared.Enabled = shared
+		}
+	}
+
+	if group := os.Getenv("MQTT_EXPORTER_MQTT_SHARED_SUBSCRIPTION_GROUP"); group != "" {
+		cfg.MQTT.Shared.Group = group
+	}
+
+	if leaderStr := os.Getenv("MQTT_EXPORTER_MQTT_LEADER_ELECTION_ENABLED"); leaderStr != "" {
+		if leader, err := strconv.ParseBool(leaderStr); err == nil {
+			cfg.MQTT.LeaderElection.Enabled = leader
+		}
+	}
+
+	if leaderTopic := os.Getenv("MQTT_EXPORTER_MQTT_LEADER_ELECTION_TOPIC"); leaderTopic != "" {
+		cfg.MQTT.LeaderElection.Topic = leaderTopic
+	}
+
+	if leaseStr := os.Getenv("MQTT_EXPORTER_MQTT_LEADER_ELECTION_LEASE"); leaseStr != "" {
+		if lease, err := time.ParseDuration(leaseStr); err == nil {
+			cfg.MQTT.LeaderElection.Lease = Duration{Duration: lease}
+		}
+	}
+
+	if replica := os.Getenv("MQTT_EXPORTER_MQTT_REPLICA"); replica != "" {
+		cfg.MQTT.Replica = replica
+	}
+
+	if statusStr := os.Getenv("MQTT_EXPORTER_MQTT_STATUS_ENABLED"); statusStr != "" {
+		if status, err := strconv.ParseBool(statusStr); err == nil {
+			cfg.MQTT.Status.Enabled = status
+		}
+	}
+
+	if statusTopic := os.Getenv("MQTT_EXPORTER_MQTT_STATUS_TOPIC"); statusTopic != "" {
+		cfg.MQTT.Status.Topic = statusTopic
+	}
+
+	if online := os.Getenv("MQTT_EXPORTER_MQTT_STATUS_ONLINE"); online != "" {
+		cfg.MQTT.Status.Online = online
+	}
+
+	if offline := os.Getenv("MQTT_EXPORTER_MQTT_STATUS_OFFLINE"); offline != "" {
+		cfg.MQTT.Status.Offline = offline
+	}
+
+	if summaryTopic := os.Getenv("MQTT_EXPORTER_MQTT_STATUS_SUMMARY_TOPIC"); summaryTopic != "" {
+		cfg.MQTT.Status.SummaryTopic = summaryTopic
+	}
+
+	if summaryIntervalStr := os.Getenv("MQTT_EXPORTER_MQTT_STATUS_SUMMARY_INTERVAL"); summaryIntervalStr != "" {
+		if summaryInterval, err := time.ParseDuration(summaryIntervalStr); err == nil {
+			cfg.MQTT.Status.SummaryInterval = Duration{Duration: summaryInterval}
+		}
+	}
+
 	if keepAliveStr := os.Getenv("MQTT_EXPORTER_MQTT_KEEP_ALIVE"); keepAliveStr != "" {
 		if keepAlive, err := time.ParseDuration(keepAliveStr); err == nil {
 			cfg.MQTT.KeepAlive = Duration{Duration: keepAlive}
@@ -134,6 +678,122 @@ func applyEnvVars(cfg *Config) {
 			cfg.MQTT.ConnectTimeout = Duration{Duration: connectTimeout}
 		}
 	}
+
+	if skipRetainedStr := os.Getenv("MQTT_EXPORTER_MQTT_SKIP_RETAINED"); skipRetainedStr != "" {
+		if skipRetained, err := strconv.ParseBool(skipRetainedStr); err == nil {
+			cfg.MQTT.SkipRetained = skipRetained
+		}
+	}
+
+	if qosLabelStr := os.Getenv("MQTT_EXPORTER_MQTT_MESSAGE_LABELS_QOS"); qosLabelStr != "" {
+		if qosLabel, err := strconv.ParseBool(qosLabelStr); err == nil {
+			cfg.MQTT.MessageLabels.QoS = qosLabel
+		}
+	}
+
+	if dupLabelStr := os.Getenv("MQTT_EXPORTER_MQTT_MESSAGE_LABELS_DUP"); dupLabelStr != "" {
+		if dupLabel, err := strconv.ParseBool(dupLabelStr); err == nil {
+			cfg.MQTT.MessageLabels.Dup = dupLabel
+		}
+	}
+
+	if tlsEnabledStr := os.Getenv("MQTT_EXPORTER_MQTT_TLS_ENABLED"); tlsEnabledStr != "" {
+		if tlsEnabled, err := strconv.ParseBool(tlsEnabledStr); err == nil {
+			cfg.MQTT.TLS.Enabled = tlsEnabled
+		}
+	}
+
+	if caFile := os.Getenv("MQTT_EXPORTER_MQTT_TLS_CA_FILE"); caFile != "" {
+		cfg.MQTT.TLS.CAFile = caFile
+	}
+
+	if certFile := os.Getenv("MQTT_EXPORTER_MQTT_TLS_CERT_FILE"); certFile != "" {
+		cfg.MQTT.TLS.CertFile = certFile
+	}
+
+	if keyFile := os.Getenv("MQTT_EXPORTER_MQTT_TLS_KEY_FILE"); keyFile != "" {
+		cfg.MQTT.TLS.KeyFile = keyFile
+	}
+
+	if insecureStr := os.Getenv("MQTT_EXPORTER_MQTT_TLS_INSECURE_SKIP_VERIFY"); insecureStr != "" {
+		if insecure, err := strconv.ParseBool(insecureStr); err == nil {
+			cfg.MQTT.TLS.InsecureSkipVerify = insecure
+		}
+	}
+
+	if probeEnabledStr := os.Getenv("MQTT_EXPORTER_MQTT_PROBE_ENABLED"); probeEnabledStr != "" {
+		if probeEnabled, err := strconv.ParseBool(probeEnabledStr); err == nil {
+			cfg.MQTT.Probe.Enabled = probeEnabled
+		}
+	}
+
+	if probeTopic := os.Getenv("MQTT_EXPORTER_MQTT_PROBE_TOPIC"); probeTopic != "" {
+		cfg.MQTT.Probe.Topic = probeTopic
+	}
+
+	if probeTimeoutStr := os.Getenv("MQTT_EXPORTER_MQTT_PROBE_TIMEOUT"); probeTimeoutStr != "" {
+		if probeTimeout, err := time.ParseDuration(probeTimeoutStr); err == nil {
+			cfg.MQTT.Probe.Timeout = Duration{Duration: probeTimeout}
+		}
+	}
+
+	if workersStr := os.Getenv("MQTT_EXPORTER_MQTT_PROCESSING_WORKERS"); workersStr != "" {
+		if workers, err := strconv.Atoi(workersStr); err == nil {
+			cfg.MQTT.Processing.Workers = workers
+		}
+	}
+
+	if queueSizeStr := os.Getenv("MQTT_EXPORTER_MQTT_PROCESSING_QUEUE_SIZE"); queueSizeStr != "" {
+		if queueSize, err := strconv.Atoi(queueSizeStr); err == nil {
+			cfg.MQTT.Processing.QueueSize = queueSize
+		}
+	}
+
+	if overflow := os.Getenv("MQTT_EXPORTER_MQTT_PROCESSING_OVERFLOW"); overflow != "" {
+		cfg.MQTT.Processing.Overflow = overflow
+	}
+
+	if recordFile := os.Getenv("MQTT_EXPORTER_MQTT_RECORD_FILE"); recordFile != "" {
+		cfg.MQTT.Record.File = recordFile
+	}
+
+	if maxMessagesStr := os.Getenv("MQTT_EXPORTER_MQTT_RECORD_MAX_MESSAGES"); maxMessagesStr != "" {
+		if maxMessages, err := strconv.Atoi(maxMessagesStr); err == nil {
+			cfg.MQTT.Record.MaxMessages = maxMessages
+		}
+	}
+
+	if connectionOnlyStr := os.Getenv("MQTT_EXPORTER_MQTT_TRACING_CONNECTION_ONLY"); connectionOnlyStr != "" {
+		if connectionOnly, err := strconv.ParseBool(connectionOnlyStr); err == nil {
+			cfg.MQTT.Tracing.ConnectionOnly = connectionOnly
+		}
+	}
+
+	if sampleRatioStr := os.Getenv("MQTT_EXPORTER_MQTT_TRACING_SAMPLE_RATIO"); sampleRatioStr != "" {
+		if sampleRatio, err := strconv.ParseFloat(sampleRatioStr, 64); err == nil {
+			cfg.MQTT.Tracing.SampleRatio = &sampleRatio
+		}
+	}
+
+	if slowThresholdStr := os.Getenv("MQTT_EXPORTER_MQTT_TRACING_SLOW_THRESHOLD"); slowThresholdStr != "" {
+		if slowThreshold, err := time.ParseDuration(slowThresholdStr); err == nil {
+			cfg.MQTT.Tracing.SlowThreshold = Duration{Duration: slowThreshold}
+		}
+	}
+
+	if traceparentField := os.Getenv("MQTT_EXPORTER_MQTT_TRACING_TRACEPARENT_FIELD"); traceparentField != "" {
+		cfg.MQTT.Tracing.TraceparentField = traceparentField
+	}
+
+	if tracestateField := os.Getenv("MQTT_EXPORTER_MQTT_TRACING_TRACESTATE_FIELD"); tracestateField != "" {
+		cfg.MQTT.Tracing.TracestateField = tracestateField
+	}
+
+	if parentBasedStr := os.Getenv("MQTT_EXPORTER_MQTT_TRACING_PARENT_BASED"); parentBasedStr != "" {
+		if parentBased, err := strconv.ParseBool(parentBasedStr); err == nil {
+			cfg.MQTT.Tracing.ParentBased = parentBased
+		}
+	}
 }
 
 // setDefaults sets default values for configuration
@@ -158,12 +818,84 @@ func setDefaults(config *Config) {
 		config.Metrics.Collection.DefaultInterval = promexporter_config.Duration{Duration: time.Second * 30}
 	}
 
+	if config.Web.Host == "" {
+		config.Web.Host = config.Server.Host
+	}
+
+	if config.Reload.WatchInterval.Duration == 0 {
+		config.Reload.WatchInterval = Duration{Duration: time.Second * 10}
+	}
+
+	if config.State.Interval.Duration == 0 {
+		config.State.Interval = Duration{Duration: time.Minute}
+	}
+
+	if config.Web.Topics.PayloadLimit == 0 {
+		config.Web.Topics.PayloadLimit = 256
+	}
+
+	if config.Web.Tail.PayloadLimit == 0 {
+		config.Web.Tail.PayloadLimit = 256
+	}
+
+	if config.Web.Tail.Buffer == 0 {
+		config.Web.Tail.Buffer = 100
+	}
+
+	if config.Web.Port == 0 {
+		config.Web.Port = 8081
+	}
+
+	for name, module := range config.ProbeModules {
+		if module.Timeout.Duration == 0 {
+			module.Timeout = Duration{Duration: time.Second * 10}
+		}
+
+		config.ProbeModules[name] = module
+	}
+
+	if config.Mode == "" {
+		config.Mode = ModeClient
+	}
+
+	if config.Mode == ModeEmbeddedBroker {
+		if config.EmbeddedBroker.Address == "" {
+			config.EmbeddedBroker.Address = ":1883"
+		}
+
+		if config.MQTT.Broker == "" {
+			config.MQTT.Broker = EmbeddedBrokerURL(config.EmbeddedBroker.Address)
+		}
+	}
+
 	if config.MQTT.Broker == "" {
 		config.MQTT.Broker = "tcp://localhost:1883"
 	}
 
 	if config.MQTT.ClientID == "" {
-		config.MQTT.ClientID = "mqtt-exporter"
+		config.MQTT.ClientID = DefaultClientID
+	}
+
+	if config.MQTT.SessionStore == "" {
+		config.MQTT.SessionStore = SessionStoreMemory
+	}
+
+	// Replicas run from the same configuration, so the host name tells
+	// them apart unless one is set, for example from the pod name
+	if config.MQTT.Replicated() && config.MQTT.Replica == "" {
+		config.MQTT.Replica, _ = os.Hostname()
+	}
+
+	if config.MQTT.Shared.Enabled && config.MQTT.Shared.Group == "" {
+		config.MQTT.Shared.Group = DefaultClientID
+	}
+
+	if config.MQTT.LeaderElection.Topic == "" {
+		config.MQTT.LeaderElection.Topic = "mqtt-exporter/leader/" + config.MQTT.ClientID
+	}
+
+	if config.MQTT.LeaderElection.Lease.Duration == 0 {
+		config.MQTT.LeaderElection.Lease = Duration{Duration: 30 * time.Second}
 	}
 
 	if len(config.MQTT.Topics) == 0 {
@@ -177,31 +909,121 @@ func setDefaults(config *Config) {
 	if config.MQTT.ConnectTimeout.Duration == 0 {
 		config.MQTT.ConnectTimeout = Duration{Duration: time.Second * 30}
 	}
+
+	if config.MQTT.Probe.Topic == "" {
+		config.MQTT.Probe.Topic = "mqtt-exporter/probe/" + config.MQTT.ConnectClientID()
+	}
+
+	if config.MQTT.Probe.Timeout.Duration == 0 {
+		config.MQTT.Probe.Timeout = Duration{Duration: time.Second * 10}
+	}
+
+	if config.MQTT.Status.Topic == "" {
+		config.MQTT.Status.Topic = "mqtt-exporter/status/" + config.MQTT.ConnectClientID()
+	}
+
+	if config.MQTT.Status.Online == "" {
+		config.MQTT.Status.Online = "online"
+	}
+
+	if config.MQTT.Status.Offline == "" {
+		config.MQTT.Status.Offline = "offline"
+	}
+
+	if config.MQTT.Status.SummaryTopic == "" {
+		config.MQTT.Status.SummaryTopic = config.MQTT.Status.Topic + "/summary"
+	}
+
+	if config.MQTT.Processing.QueueSize == 0 {
+		config.MQTT.Processing.QueueSize = 1000
+	}
+
+	if config.MQTT.Processing.Overflow == "" {
+		config.MQTT.Processing.Overflow = OverflowBlock
+	}
+
+	if config.MQTT.Tracing.SampleRatio == nil {
+		sampleRatio := 1.0
+		config.MQTT.Tracing.SampleRatio = &sampleRatio
+	}
+
+	for i := range config.MQTT.Availability {
+		availability := &config.MQTT.Availability[i]
+
+		if availability.Online == "" {
+			availability.Online = "online"
+		}
+
+		if availability.Offline == "" {
+			availability.Offline = "offline"
+		}
+	}
+
+	for i := range config.MQTT.Heartbeats {
+		if config.MQTT.Heartbeats[i].Missed == 0 {
+			config.MQTT.Heartbeats[i].Missed = 3
+		}
+	}
+
+	for i := range config.MQTT.Mappings {
+		mapping := &config.MQTT.Mappings[i]
+
+		if mapping.Name == "" {
+			mapping.Name = mapping.Topic
+		}
+
+		if mapping.Timestamp.Field != "" && mapping.Timestamp.Format == "" {
+			mapping.Timestamp.Format = "auto"
+		}
+
+		if mapping.Sequence.Field != "" && mapping.Sequence.ReorderWindow == 0 {
+			mapping.Sequence.ReorderWindow = 10
+		}
+	}
 }
 
-// Validate performs comprehensive validation of the configuration
+// Validate performs comprehensive validation of the configuration. Every
+// problem is reported, joined with errors.Join, rather than only the first.
 func (c *Config) Validate() error {
-	// Validate server configuration
-	if err := c.validateServerConfig(); err != nil {
-		return fmt.Errorf("server config: %w", err)
+	var errs []error
+
+	errs = append(errs, prefixErrors("server config", c.validateServerConfig())...)
+	errs = append(errs, prefixErrors("logging config", c.validateLoggingConfig())...)
+	errs = append(errs, prefixErrors("metrics config", c.validateMetricsConfig())...)
+	errs = append(errs, prefixErrors("embedded broker config", c.validateEmbeddedBrokerConfig())...)
+	errs = append(errs, prefixErrors("mqtt config", c.validateMQTTConfig())...)
+	errs = append(errs, prefixErrors("web config", c.validateWebConfig())...)
+
+	if c.Reload.Watch && c.Reload.WatchInterval.Seconds() < 1 {
+		errs = append(errs, fmt.Errorf("reload watch_interval must be at least 1 second, got %s", c.Reload.WatchInterval.Duration))
 	}
 
-	// Validate logging configuration
-	if err := c.validateLoggingConfig(); err != nil {
-		return fmt.Errorf("logging config: %w", err)
+	if c.State.File != "" && c.State.Interval.Seconds() < 1 {
+		errs = append(errs, fmt.Errorf("state interval must be at least 1 second, got %s", c.State.Interval.Duration))
 	}
 
-	// Validate metrics configuration
-	if err := c.validateMetricsConfig(); err != nil {
-		return fmt.Errorf("metrics config: %w", err)
+	errs = append(errs, prefixErrors("probe modules", c.validateProbeModulesConfig())...)
+
+	return errors.Join(errs...)
+}
+
+// prefixErrors prefixes every error in err, which may have been joined with
+// errors.Join, so that each one still says where it comes from
+func prefixErrors(prefix string, err error) []error {
+	if err == nil {
+		return nil
 	}
 
-	// Validate MQTT configuration
-	if err := c.validateMQTTConfig(); err != nil {
-		return fmt.Errorf("mqtt config: %w", err)
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, err := range joined.Unwrap() {
+			errs = append(errs, prefixErrors(prefix, err)...)
+		}
+
+		return errs
 	}
 
-	return nil
+	return []error{fmt.Errorf("%s: %w", prefix, err)}
 }
 
 func (c *Config) validateServerConfig() error {
@@ -213,6 +1035,8 @@ func (c *Config) validateServerConfig() error {
 }
 
 func (c *Config) validateLoggingConfig() error {
+	var errs []error
+
 	validLevels := map[string]bool{
 		"debug": true,
 		"info":  true,
@@ -220,7 +1044,7 @@ func (c *Config) validateLoggingConfig() error {
 		"error": true,
 	}
 	if !validLevels[c.Logging.Level] {
-		return fmt.Errorf("invalid logging level: %s", c.Logging.Level)
+		errs = append(errs, fmt.Errorf("invalid logging level: %s", c.Logging.Level))
 	}
 
 	validFormats := map[string]bool{
@@ -228,10 +1052,10 @@ func (c *Config) validateLoggingConfig() error {
 		"text": true,
 	}
 	if !validFormats[c.Logging.Format] {
-		return fmt.Errorf("invalid logging format: %s", c.Logging.Format)
+		errs = append(errs, fmt.Errorf("invalid logging format: %s", c.Logging.Format))
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (c *Config) validateMetricsConfig() error {
@@ -246,30 +1070,410 @@ func (c *Config) validateMetricsConfig() error {
 	return nil
 }
 
+func (c *Config) validateEmbeddedBrokerConfig() error {
+	switch c.Mode {
+	case ModeClient:
+		return nil
+	case ModeEmbeddedBroker:
+	default:
+		return fmt.Errorf("mode must be %s or %s, got %q", ModeClient, ModeEmbeddedBroker, c.Mode)
+	}
+
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.EmbeddedBroker.Address); err != nil {
+		errs = append(errs, fmt.Errorf("invalid address %q: %w", c.EmbeddedBroker.Address, err))
+	}
+
+	usernames := make(map[string]bool, len(c.EmbeddedBroker.Users))
+
+	for i, user := range c.EmbeddedBroker.Users {
+		if user.Username == "" || user.Password.IsEmpty() {
+			errs = append(errs, fmt.Errorf("user %d: username and password are required", i))
+		}
+
+		if usernames[user.Username] {
+			errs = append(errs, fmt.Errorf("user %d: duplicate username %q", i, user.Username))
+		}
+
+		usernames[user.Username] = true
+	}
+
+	// The exporter has to be able to connect to its own broker
+	if len(c.EmbeddedBroker.Users) > 0 && (c.MQTT.Username == "" || c.MQTT.Password.IsEmpty()) {
+		errs = append(errs, fmt.Errorf("users require the mqtt username and password the exporter connects with"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// EmbeddedBrokerURL returns the URL the exporter connects to its embedded
+// broker listening on address with. Wildcard hosts connect over loopback.
+func EmbeddedBrokerURL(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "tcp://" + address
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	return "tcp://" + net.JoinHostPort(host, port)
+}
+
 func (c *Config) validateMQTTConfig() error {
+	var errs []error
+
 	if c.MQTT.Broker == "" {
-		return fmt.Errorf("mqtt broker is required")
+		errs = append(errs, fmt.Errorf("mqtt broker is required"))
 	}
 
 	if c.MQTT.ClientID == "" {
-		return fmt.Errorf("mqtt client id is required")
+		errs = append(errs, fmt.Errorf("mqtt client id is required"))
 	}
 
 	if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
-		return fmt.Errorf("mqtt qos must be between 0 and 2, got %d", c.MQTT.QoS)
+		errs = append(errs, fmt.Errorf("mqtt qos must be between 0 and 2, got %d", c.MQTT.QoS))
 	}
 
 	if c.MQTT.KeepAlive.Seconds() < 0 {
-		return fmt.Errorf("mqtt keep alive must be non-negative, got %d", c.MQTT.KeepAlive.Seconds())
+		errs = append(errs, fmt.Errorf("mqtt keep alive must be non-negative, got %d", c.MQTT.KeepAlive.Seconds()))
 	}
 
 	if c.MQTT.ConnectTimeout.Seconds() < 1 {
-		return fmt.Errorf("mqtt connect timeout must be at least 1 second, got %d", c.MQTT.ConnectTimeout.Seconds())
+		errs = append(errs, fmt.Errorf("mqtt connect timeout must be at least 1 second, got %d", c.MQTT.ConnectTimeout.Seconds()))
+	}
+
+	errs = append(errs, prefixErrors("mqtt session", c.validateSessionConfig())...)
+	errs = append(errs, prefixErrors("mqtt replicas", c.validateReplicaConfig())...)
+	errs = append(errs, prefixErrors("mqtt tls", c.MQTT.TLS.validate())...)
+	errs = append(errs, prefixErrors("mqtt status", c.validateStatusConfig())...)
+
+	if c.MQTT.Probe.Enabled {
+		if topic.HasWildcards(c.MQTT.Probe.Topic) {
+			errs = append(errs, fmt.Errorf("mqtt probe topic must not contain wildcards, got %s", c.MQTT.Probe.Topic))
+		}
+
+		if c.MQTT.Probe.Timeout.Duration <= 0 || c.MQTT.Probe.Timeout.Duration > c.Metrics.Collection.DefaultInterval.Duration {
+			errs = append(errs, fmt.Errorf("mqtt probe timeout must be positive and at most the default interval (%s), got %s",
+				c.Metrics.Collection.DefaultInterval.Duration, c.MQTT.Probe.Timeout.Duration))
+		}
+	}
+
+	errs = append(errs, prefixErrors("mqtt processing", c.MQTT.Processing.validate())...)
+	errs = append(errs, prefixErrors("mqtt tracing", c.MQTT.Tracing.validate())...)
+
+	if c.MQTT.Record.MaxMessages < 0 {
+		errs = append(errs, fmt.Errorf("mqtt record max_messages must be non-negative, got %d", c.MQTT.Record.MaxMessages))
+	}
+
+	errs = append(errs, prefixErrors("mappings", c.validateMappingsConfig())...)
+
+	for i, heartbeat := range c.MQTT.Heartbeats {
+		if err := topic.ValidateFilter(heartbeat.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("heartbeat %d: %w", i, err))
+		}
+
+		if heartbeat.Interval.Seconds() < 1 {
+			errs = append(errs, fmt.Errorf("heartbeat %s: interval must be at least 1 second, got %s", heartbeat.Topic, heartbeat.Interval.Duration))
+		}
+
+		if heartbeat.Missed < 1 {
+			errs = append(errs, fmt.Errorf("heartbeat %s: missed must be at least 1, got %d", heartbeat.Topic, heartbeat.Missed))
+		}
+
+		// Every topic matching a wildcard filter would otherwise be tracked,
+		// without a bound, and the silence of topics that never published
+		// can only be reported when they are known
+		if topic.HasWildcards(heartbeat.Topic) && len(heartbeat.Expected) == 0 {
+			errs = append(errs, fmt.Errorf("heartbeat %s: a wildcard filter requires expected topics", heartbeat.Topic))
+		}
+
+		for _, expected := range heartbeat.Expected {
+			if topic.HasWildcards(expected) || !topic.Match(heartbeat.Topic, expected) {
+				errs = append(errs, fmt.Errorf("heartbeat %s: expected topic %q must be a concrete topic matching the filter", heartbeat.Topic, expected))
+			}
+		}
+	}
+
+	for i, availability := range c.MQTT.Availability {
+		if err := topic.ValidateFilter(availability.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("availability %d: %w", i, err))
+		}
+
+		if availability.Online == availability.Offline {
+			errs = append(errs, fmt.Errorf("availability %d: online and offline payloads must differ, both are %q", i, availability.Online))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateSessionConfig() error {
+	switch c.MQTT.SessionStore {
+	case SessionStoreMemory:
+		return nil
+	case SessionStoreFile:
+	default:
+		return fmt.Errorf("session_store must be %s or %s, got %q", SessionStoreMemory, SessionStoreFile, c.MQTT.SessionStore)
+	}
+
+	var errs []error
+
+	if c.MQTT.SessionDir == "" {
+		errs = append(errs, fmt.Errorf("session_dir is required with the %s session store", SessionStoreFile))
+	}
+
+	if c.MQTT.CleanSession {
+		errs = append(errs, fmt.Errorf("the %s session store requires clean_session false, a clean session discards it on every connect", SessionStoreFile))
+	}
+
+	// The broker keeps one session per client ID, so exporters sharing the
+	// default ID would take over each other's session and queued messages
+	if c.MQTT.ConnectClientID() == DefaultClientID {
+		errs = append(errs, fmt.Errorf("the %s session store requires a client_id unique to this exporter, not the default %q", SessionStoreFile, DefaultClientID))
+	}
+
+	// Dropped messages are never processed, so they would never be
+	// acknowledged either
+	if c.MQTT.Processing.Workers > 0 && c.MQTT.Processing.Overflow != OverflowBlock {
+		errs = append(errs, fmt.Errorf("the %s session store requires the %s processing overflow, got %q", SessionStoreFile, OverflowBlock, c.MQTT.Processing.Overflow))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateReplicaConfig() error {
+	if !c.MQTT.Replicated() {
+		return nil
+	}
+
+	var errs []error
+
+	if c.MQTT.Replica == "" {
+		errs = append(errs, fmt.Errorf("replica is required when the host name is unknown"))
+	}
+
+	if c.MQTT.Shared.Enabled && c.MQTT.LeaderElection.Enabled {
+		errs = append(errs, fmt.Errorf("shared_subscription and leader_election can't both be enabled"))
+	}
+
+	if c.MQTT.Shared.Enabled && (c.MQTT.Shared.Group == "" || strings.ContainsAny(c.MQTT.Shared.Group, "/+#")) {
+		errs = append(errs, fmt.Errorf("shared_subscription group must be set and must not contain /, + or #, got %q", c.MQTT.Shared.Group))
+	}
+
+	if c.MQTT.LeaderElection.Enabled {
+		if topic.HasWildcards(c.MQTT.LeaderElection.Topic) {
+			errs = append(errs, fmt.Errorf("leader_election topic must not contain wildcards, got %s", c.MQTT.LeaderElection.Topic))
+		}
+
+		if c.MQTT.LeaderElection.Lease.Seconds() < 3 {
+			errs = append(errs, fmt.Errorf("leader_election lease must be at least 3 seconds, got %s", c.MQTT.LeaderElection.Lease.Duration))
+		}
+
+		// The broker keeps the subscriptions of a persistent session, so a
+		// leader that stepped down would keep receiving the messages
+		if !c.MQTT.CleanSession {
+			errs = append(errs, fmt.Errorf("leader_election requires clean_session true"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateStatusConfig() error {
+	status := c.MQTT.Status
+	if !status.Enabled {
+		return nil
+	}
+
+	var errs []error
+
+	if topic.HasWildcards(status.Topic) {
+		errs = append(errs, fmt.Errorf("topic must not contain wildcards, got %s", status.Topic))
+	}
+
+	if status.Online == status.Offline {
+		errs = append(errs, fmt.Errorf("online and offline payloads must differ, both are %q", status.Online))
+	}
+
+	if status.SummaryInterval.Duration != 0 {
+		if status.SummaryInterval.Seconds() < 1 {
+			errs = append(errs, fmt.Errorf("summary_interval must be at least 1 second, got %s", status.SummaryInterval.Duration))
+		}
+
+		if topic.HasWildcards(status.SummaryTopic) || status.SummaryTopic == status.Topic {
+			errs = append(errs, fmt.Errorf("summary_topic must not contain wildcards or be the status topic, got %s", status.SummaryTopic))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateWebConfig() error {
+	var errs []error
+
+	// The web server always runs for /ready
+	if c.Web.Port < 1 || c.Web.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535, got %d", c.Web.Port))
+	}
+
+	if c.Web.Port == c.Server.Port {
+		errs = append(errs, fmt.Errorf("port must differ from the server port %d", c.Server.Port))
+	}
+
+	if !c.Web.Enabled {
+		return errors.Join(errs...)
+	}
+
+	if c.Web.Topics.PayloadLimit < 1 {
+		errs = append(errs, fmt.Errorf("topics payload_limit must be at least 1, got %d", c.Web.Topics.PayloadLimit))
+	}
+
+	if c.Web.Tail.PayloadLimit < 1 {
+		errs = append(errs, fmt.Errorf("tail payload_limit must be at least 1, got %d", c.Web.Tail.PayloadLimit))
+	}
+
+	if c.Web.Tail.Buffer < 1 {
+		errs = append(errs, fmt.Errorf("tail buffer must be at least 1, got %d", c.Web.Tail.Buffer))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateProbeModulesConfig() error {
+	var errs []error
+
+	for _, name := range slices.Sorted(maps.Keys(c.ProbeModules)) {
+		module := c.ProbeModules[name]
+
+		if module.Timeout.Duration < 0 {
+			errs = append(errs, fmt.Errorf("module %s: timeout must be non-negative, got %s", name, module.Timeout.Duration))
+		}
+
+		if module.QoS < 0 || module.QoS > 2 {
+			errs = append(errs, fmt.Errorf("module %s: qos must be between 0 and 2, got %d", name, module.QoS))
+		}
+
+		if module.Topic != "" && topic.HasWildcards(module.Topic) {
+			errs = append(errs, fmt.Errorf("module %s: topic must not contain wildcards, got %s", name, module.Topic))
+		}
+
+		errs = append(errs, prefixErrors(fmt.Sprintf("module %s: tls", name), module.TLS.validate())...)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *TLSConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
 	}
 
 	return nil
 }
 
+func (t *MessageTracingConfig) validate() error {
+	var errs []error
+
+	if t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		errs = append(errs, fmt.Errorf("sample_ratio must be between 0 and 1, got %g", *t.SampleRatio))
+	}
+
+	if t.TracestateField != "" && t.TraceparentField == "" {
+		errs = append(errs, fmt.Errorf("tracestate_field requires traceparent_field"))
+	}
+
+	if t.SlowThreshold.Duration < 0 {
+		errs = append(errs, fmt.Errorf("slow_threshold must not be negative, got %s", t.SlowThreshold.Duration))
+	}
+
+	for i, rule := range t.Rules {
+		if err := topic.ValidateFilter(rule.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+		}
+
+		if rule.SampleRatio < 0 || rule.SampleRatio > 1 {
+			errs = append(errs, fmt.Errorf("rule %s: sample_ratio must be between 0 and 1, got %g", rule.Topic, rule.SampleRatio))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *ProcessingConfig) validate() error {
+	var errs []error
+
+	if p.Workers < 0 {
+		errs = append(errs, fmt.Errorf("workers must be non-negative, got %d", p.Workers))
+	}
+
+	if p.QueueSize < 1 {
+		errs = append(errs, fmt.Errorf("queue_size must be at least 1, got %d", p.QueueSize))
+	}
+
+	switch p.Overflow {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		errs = append(errs, fmt.Errorf("overflow must be one of %s, %s or %s, got %q",
+			OverflowBlock, OverflowDropOldest, OverflowDropNewest, p.Overflow))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateMappingsConfig() error {
+	validTimestampFormats := map[string]bool{
+		"auto":    true,
+		"unix":    true,
+		"unix_ms": true,
+		"rfc3339": true,
+	}
+
+	var errs []error
+
+	names := make(map[string]bool, len(c.MQTT.Mappings))
+
+	for i, mapping := range c.MQTT.Mappings {
+		if err := topic.ValidateFilter(mapping.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d: %w", i, err))
+		}
+
+		if names[mapping.Name] {
+			errs = append(errs, fmt.Errorf("mapping %d: duplicate mapping name %q", i, mapping.Name))
+		}
+
+		names[mapping.Name] = true
+
+		if len(mapping.Fields) == 0 && mapping.Timestamp.Field == "" && mapping.Sequence.Field == "" {
+			errs = append(errs, fmt.Errorf("mapping %q: at least one field, a timestamp field or a sequence field is required", mapping.Name))
+		}
+
+		if slices.Contains(mapping.Fields, "") {
+			errs = append(errs, fmt.Errorf("mapping %q: field names must not be empty", mapping.Name))
+		}
+
+		if mapping.Timestamp.Field != "" && !validTimestampFormats[mapping.Timestamp.Format] {
+			errs = append(errs, fmt.Errorf("mapping %q: invalid timestamp format: %s", mapping.Name, mapping.Timestamp.Format))
+		}
+
+		if mapping.Timestamp.Export && mapping.Timestamp.Field == "" {
+			errs = append(errs, fmt.Errorf("mapping %q: timestamp export requires a timestamp field", mapping.Name))
+		}
+
+		if mapping.Sequence.ReorderWindow < 0 {
+			errs = append(errs, fmt.Errorf("mapping %q: sequence reorder window must be non-negative, got %d", mapping.Name, mapping.Sequence.ReorderWindow))
+		}
+
+		if mapping.Sequence.Device != "" && mapping.Sequence.Field == "" {
+			errs = append(errs, fmt.Errorf("mapping %q: sequence device requires a sequence field", mapping.Name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 // GetDefaultInterval returns the default collection interval
 func (c *Config) GetDefaultInterval() int {
 	return c.Metrics.Collection.DefaultInterval.Seconds()
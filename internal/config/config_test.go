@@ -0,0 +1,332 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadConfig_PasswordFromYAML guards against the broker and probe module
+// passwords failing to load from YAML, which the promexporter
+// SensitiveString does not support on its own.
+func TestLoadConfig_PasswordFromYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+mqtt:
+  broker: "localhost:1883"
+  password: "supersecretmqttpw"
+probe_modules:
+  secure:
+    username: "probe"
+    password: "probepw"
+`), 0o600))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "supersecretmqttpw", cfg.MQTT.Password.Value())
+	assert.Equal(t, "[REDACTED]", cfg.MQTT.Password.String())
+	assert.Equal(t, "probepw", cfg.ProbeModules["secure"].Password.Value())
+}
+
+// TestLoadConfig_Example makes sure the example configuration stays valid.
+func TestLoadConfig_Example(t *testing.T) {
+	_, err := LoadConfig("../../config.example.yaml")
+	require.NoError(t, err)
+}
+
+// TestLoadConfig_BaseSectionsFromYAML checks that the server, logging and
+// metrics sections shared with other promexporter exporters are read from
+// the file.
+func TestLoadConfig_BaseSectionsFromYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  port: 9000
+logging:
+  level: "debug"
+metrics:
+  collection:
+    default_interval: "1m"
+mqtt:
+  broker: "localhost:1883"
+`), 0o600))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, 9000, cfg.Server.Port)
+	assert.Equal(t, "debug", cfg.Logging.Level)
+	assert.Equal(t, time.Minute, cfg.Metrics.Collection.DefaultInterval.Duration)
+}
+
+// TestValidate_ReportsAllErrors checks that validation lists every problem
+// instead of stopping at the first one.
+func TestValidate_ReportsAllErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  port: 8081 # Taken by the web server, which always serves /ready
+logging:
+  level: "loud"
+mqtt:
+  broker: "localhost:1883"
+  qos: 3
+  processing:
+    workers: -1
+    overflow: "explode"
+`), 0o600))
+
+	cfg, err := Parse(path)
+	require.NoError(t, err)
+
+	err = cfg.Validate()
+	require.Error(t, err)
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	require.True(t, ok, "expected joined errors, got %T", err)
+	assert.Len(t, joined.Unwrap(), 5)
+	assert.Contains(t, err.Error(), "logging config: invalid logging level: loud")
+	assert.Contains(t, err.Error(), "web config: port must differ from the server port 8081")
+	assert.Contains(t, err.Error(), "mqtt config: mqtt qos must be between 0 and 2, got 3")
+	assert.Contains(t, err.Error(), "mqtt config: mqtt processing: workers must be non-negative, got -1")
+	assert.Contains(t, err.Error(), `mqtt config: mqtt processing: overflow must be one of block, drop_oldest or drop_newest, got "explode"`)
+}
+
+// TestValidate_Heartbeats checks that wildcard heartbeats must list the
+// topics they track.
+func TestValidate_Heartbeats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+mqtt:
+  broker: "localhost:1883"
+  heartbeats:
+    - topic: "sensor/+/temp"
+      interval: "60s"
+      missed: 3
+    - topic: "meter/+/power"
+      interval: "60s"
+      missed: 3
+      expected: ["meter/kitchen/power"]
+`), 0o600))
+
+	cfg, err := Parse(path)
+	require.NoError(t, err)
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "heartbeat sensor/+/temp: a wildcard filter requires expected topics")
+	assert.NotContains(t, err.Error(), "meter/+/power")
+}
+
+// TestMarshal checks that the effective configuration reads back the same,
+// apart from the redacted secrets.
+func TestMarshal(t *testing.T) {
+	cfg, err := LoadConfig("../../config.example.yaml")
+	require.NoError(t, err)
+
+	cfg.MQTT.Password = NewSensitiveString("supersecretmqttpw")
+	cfg.Tracing.Headers = map[string]string{"Authorization": "Bearer token"}
+
+	out, err := Marshal(cfg)
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(out), "supersecretmqttpw")
+	assert.NotContains(t, string(out), "Bearer token")
+	assert.Contains(t, string(out), "default_interval: 30s")
+	assert.Equal(t, "Bearer token", cfg.Tracing.Headers["Authorization"], "the configuration itself must not be redacted")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, out, 0o600))
+
+	reloaded, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	reloaded.MQTT.Password = cfg.MQTT.Password
+	reloaded.Tracing.Headers = cfg.Tracing.Headers
+	assert.Equal(t, cfg, reloaded)
+}
+
+// TestLoadConfig_EmbeddedBroker checks that embedded broker mode points the
+// exporter at its own broker, and that the exporter must have credentials
+// once the broker requires them.
+func TestLoadConfig_EmbeddedBroker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+mode: "embedded-broker"
+embedded_broker:
+  address: "0.0.0.0:1884"
+`), 0o600))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "tcp://127.0.0.1:1884", cfg.MQTT.Broker)
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+mode: "embedded-broker"
+embedded_broker:
+  users:
+    - username: "sensor"
+      password: "sensorpw"
+    - username: "sensor"
+`), 0o600))
+
+	cfg, err = Parse(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":1883", cfg.EmbeddedBroker.Address)
+	assert.Equal(t, "tcp://127.0.0.1:1883", cfg.MQTT.Broker)
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "embedded broker config: user 1: username and password are required")
+	assert.Contains(t, err.Error(), `embedded broker config: user 1: duplicate username "sensor"`)
+	assert.Contains(t, err.Error(), "embedded broker config: users require the mqtt username and password the exporter connects with")
+
+	cfg.Mode = "server"
+	assert.ErrorContains(t, cfg.Validate(), `mode must be client or embedded-broker, got "server"`)
+}
+
+// TestValidate_SessionStore checks that the file session store is only
+// accepted for a persistent session with a client ID of its own.
+func TestValidate_SessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+mqtt:
+  broker: "localhost:1883"
+  clean_session: true
+  session_store: "file"
+`), 0o600))
+
+	cfg, err := Parse(path)
+	require.NoError(t, err)
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mqtt session: session_dir is required with the file session store")
+	assert.Contains(t, err.Error(), "mqtt session: the file session store requires clean_session false")
+	assert.Contains(t, err.Error(), `mqtt session: the file session store requires a client_id unique to this exporter, not the default "mqtt-exporter"`)
+
+	cfg.MQTT.CleanSession = false
+	cfg.MQTT.ClientID = "mqtt-exporter-billing"
+	cfg.MQTT.SessionDir = t.TempDir()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MQTT.Processing = ProcessingConfig{Workers: 2, QueueSize: 10, Overflow: OverflowDropOldest}
+	assert.ErrorContains(t, cfg.Validate(), `mqtt session: the file session store requires the block processing overflow, got "drop_oldest"`)
+
+	cfg.MQTT.Processing.Overflow = OverflowBlock
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MQTT.SessionStore = "disk"
+	assert.ErrorContains(t, cfg.Validate(), `session_store must be memory or file, got "disk"`)
+}
+
+func TestLoadConfig_SharedSubscription(t *testing.T) {
+	t.Setenv("MQTT_EXPORTER_MQTT_SHARED_SUBSCRIPTION_ENABLED", "true")
+	t.Setenv("MQTT_EXPORTER_MQTT_REPLICA", "pod-1")
+
+	cfg, err := LoadConfig("")
+	require.NoError(t, err)
+
+	assert.Equal(t, SharedConfig{Enabled: true, Group: "mqtt-exporter"}, cfg.MQTT.Shared)
+	assert.Equal(t, "mqtt-exporter-pod-1", cfg.MQTT.ConnectClientID())
+	assert.Equal(t, "$share/mqtt-exporter/sensor/#", cfg.MQTT.SubscriptionFilter("sensor/#"))
+	assert.Equal(t, "pod-1", cfg.MQTT.ReplicaLabel())
+	assert.Equal(t, "mqtt-exporter/probe/mqtt-exporter-pod-1", cfg.MQTT.Probe.Topic)
+
+	// The replica suffix tells the sessions apart, so the default client ID
+	// is fine for the file session store
+	cfg.MQTT.SessionStore = SessionStoreFile
+	cfg.MQTT.SessionDir = t.TempDir()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MQTT.Shared.Group = "exporters/billing"
+	cfg.MQTT.Replica = ""
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `mqtt replicas: shared_subscription group must be set and must not contain /, + or #, got "exporters/billing"`)
+	assert.Contains(t, err.Error(), "mqtt replicas: replica is required")
+
+	cfg.MQTT.Shared.Enabled = false
+	assert.Equal(t, "mqtt-exporter", cfg.MQTT.ConnectClientID())
+	assert.Equal(t, "sensor/#", cfg.MQTT.SubscriptionFilter("sensor/#"))
+	assert.Empty(t, cfg.MQTT.ReplicaLabel())
+}
+
+func TestLoadConfig_LeaderElection(t *testing.T) {
+	t.Setenv("MQTT_EXPORTER_MQTT_LEADER_ELECTION_ENABLED", "true")
+	t.Setenv("MQTT_EXPORTER_MQTT_REPLICA", "pod-1")
+
+	cfg, err := Parse("")
+	require.NoError(t, err)
+
+	assert.Equal(t, LeaderElectionConfig{
+		Enabled: true,
+		Topic:   "mqtt-exporter/leader/mqtt-exporter",
+		Lease:   Duration{Duration: 30 * time.Second},
+	}, cfg.MQTT.LeaderElection)
+	assert.Equal(t, "mqtt-exporter-pod-1", cfg.MQTT.ConnectClientID())
+	assert.Equal(t, "sensor/#", cfg.MQTT.SubscriptionFilter("sensor/#"))
+	assert.Equal(t, "pod-1", cfg.MQTT.ReplicaLabel())
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mqtt replicas: leader_election requires clean_session true")
+
+	cfg.MQTT.CleanSession = true
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MQTT.LeaderElection.Topic = "mqtt-exporter/leader/#"
+	cfg.MQTT.LeaderElection.Lease = Duration{Duration: time.Second}
+	cfg.MQTT.Shared = SharedConfig{Enabled: true, Group: "exporters"}
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mqtt replicas: leader_election topic must not contain wildcards")
+	assert.Contains(t, err.Error(), "mqtt replicas: leader_election lease must be at least 3 seconds, got 1s")
+	assert.Contains(t, err.Error(), "mqtt replicas: shared_subscription and leader_election can't both be enabled")
+}
+
+// TestLoadConfig_Status checks the status defaults, which follow the client
+// ID, and that the status combines with leader election.
+func TestLoadConfig_Status(t *testing.T) {
+	t.Setenv("MQTT_EXPORTER_MQTT_STATUS_ENABLED", "true")
+	t.Setenv("MQTT_EXPORTER_MQTT_STATUS_SUMMARY_INTERVAL", "1m")
+	t.Setenv("MQTT_EXPORTER_MQTT_CLIENT_ID", "exporter-1")
+
+	cfg, err := Parse("")
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusConfig{
+		Enabled:         true,
+		Topic:           "mqtt-exporter/status/exporter-1",
+		Online:          "online",
+		Offline:         "offline",
+		SummaryTopic:    "mqtt-exporter/status/exporter-1/summary",
+		SummaryInterval: Duration{Duration: time.Minute},
+	}, cfg.MQTT.Status)
+	assert.NoError(t, cfg.Validate())
+
+	t.Setenv("MQTT_EXPORTER_MQTT_CLEAN_SESSION", "true")
+	t.Setenv("MQTT_EXPORTER_MQTT_REPLICA", "pod-1")
+	t.Setenv("MQTT_EXPORTER_MQTT_LEADER_ELECTION_ENABLED", "true")
+
+	cfg, err = Parse("")
+	require.NoError(t, err)
+	assert.Equal(t, "mqtt-exporter/status/exporter-1-pod-1", cfg.MQTT.Status.Topic)
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MQTT.Status.Offline = "online"
+	cfg.MQTT.Status.SummaryTopic = cfg.MQTT.Status.Topic
+	cfg.MQTT.Status.SummaryInterval = Duration{Duration: time.Millisecond}
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `mqtt status: online and offline payloads must differ, both are "online"`)
+	assert.Contains(t, err.Error(), "mqtt status: summary_interval must be at least 1 second, got 1ms")
+	assert.Contains(t, err.Error(), "mqtt status: summary_topic must not contain wildcards or be the status topic")
+}
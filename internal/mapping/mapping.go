@@ -0,0 +1,411 @@
+package mapping
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/topic"
+)
+
+// Reasons reported by Error, used as the reason label of
+// mqtt_payload_errors_total
+const (
+	ReasonInvalidJSON      = "invalid_json"
+	ReasonMissingField     = "missing_field"
+	ReasonInvalidValue     = "invalid_value"
+	ReasonInvalidTimestamp = "invalid_timestamp"
+	// ReasonFutureTimestamp is reported by the collector when the device
+	// timestamp is ahead of the receive time
+	ReasonFutureTimestamp = "future_timestamp"
+)
+
+// errMissingField is wrapped by Error when a field is absent from the payload
+var errMissingField = errors.New("field not found in payload")
+
+// Error describes why a value could not be extracted from a payload
+type Error struct {
+	Mapping string
+	Field   string
+	Reason  string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("mapping %s: %s: %v", e.Mapping, e.Reason, e.Err)
+	}
+
+	return fmt.Sprintf("mapping %s: field %s: %s: %v", e.Mapping, e.Field, e.Reason, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Mapping is a compiled payload mapping
+type Mapping struct {
+	Name            string
+	Topic           string
+	Fields          []string
+	TimestampField  string
+	TimestampFormat string
+	ExportTimestamp bool
+	SequenceField   string
+	ReorderWindow   int64
+	DeviceField     string
+}
+
+// Value is a single numeric value extracted from a payload
+type Value struct {
+	Field string
+	Value float64
+}
+
+// Result holds everything a mapping extracted from a single payload
+type Result struct {
+	Mapping *Mapping
+	Values  []Value
+	// Timestamp is the device-side timestamp, zero when the mapping has no
+	// timestamp field or it could not be parsed
+	Timestamp time.Time
+	// Sequence is the payload sequence number, valid when HasSequence is set
+	Sequence    int64
+	HasSequence bool
+	// Device identifies the device the sequence belongs to, "" when the
+	// mapping has no device field
+	Device string
+}
+
+// Set is the compiled list of payload mappings
+type Set struct {
+	mappings []*Mapping
+}
+
+// New compiles the mapping configuration. The configuration is expected to
+// have been validated by config.Validate.
+func New(cfgs []config.MappingConfig) *Set {
+	set := &Set{
+		mappings: make([]*Mapping, 0, len(cfgs)),
+	}
+
+	for _, cfg := range cfgs {
+		fields := make([]string, len(cfg.Fields))
+		copy(fields, cfg.Fields)
+
+		set.mappings = append(set.mappings, &Mapping{
+			Name:            cfg.Name,
+			Topic:           cfg.Topic,
+			Fields:          fields,
+			TimestampField:  cfg.Timestamp.Field,
+			TimestampFormat: cfg.Timestamp.Format,
+			ExportTimestamp: cfg.Timestamp.Export,
+			SequenceField:   cfg.Sequence.Field,
+			ReorderWindow:   int64(cfg.Sequence.ReorderWindow),
+			DeviceField:     cfg.Sequence.Device,
+		})
+	}
+
+	return set
+}
+
+// Compile compiles the mapping configuration like New and reports every
+// field path that can never match a payload, such as "battery..level"
+func Compile(cfgs []config.MappingConfig) (*Set, error) {
+	var errs []error
+
+	for _, cfg := range cfgs {
+		paths := slices.Clone(cfg.Fields)
+
+		if cfg.Timestamp.Field != "" {
+			paths = append(paths, cfg.Timestamp.Field)
+		}
+
+		if cfg.Sequence.Field != "" {
+			paths = append(paths, cfg.Sequence.Field)
+		}
+
+		if cfg.Sequence.Device != "" {
+			paths = append(paths, cfg.Sequence.Device)
+		}
+
+		for _, path := range paths {
+			if slices.Contains(strings.Split(path, "."), "") {
+				errs = append(errs, fmt.Errorf("mapping %q: field path %q has an empty segment", cfg.Name, path))
+			}
+		}
+	}
+
+	return New(cfgs), errors.Join(errs...)
+}
+
+// Len returns the number of mappings in the set
+func (s *Set) Len() int {
+	return len(s.mappings)
+}
+
+// Mappings returns the compiled mappings in configuration order
+func (s *Set) Mappings() []*Mapping {
+	return s.mappings
+}
+
+// Match returns the mappings whose topic filter matches topic
+func (s *Set) Match(topicName string) []*Mapping {
+	var matched []*Mapping
+
+	for _, m := range s.mappings {
+		if topic.Match(m.Topic, topicName) {
+			matched = append(matched, m)
+		}
+	}
+
+	return matched
+}
+
+// Apply runs every mapping matching topicName against payload. Extraction
+// is best effort: a missing or invalid field is reported as an error while
+// the other fields are still returned.
+func (s *Set) Apply(topicName string, payload []byte) ([]Result, []error) {
+	matched := s.Match(topicName)
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		errs := make([]error, 0, len(matched))
+		for _, m := range matched {
+			errs = append(errs, &Error{Mapping: m.Name, Reason: ReasonInvalidJSON, Err: err})
+		}
+
+		return nil, errs
+	}
+
+	var (
+		results = make([]Result, 0, len(matched))
+		errs    []error
+	)
+
+	for _, m := range matched {
+		result := Result{Mapping: m}
+
+		for _, field := range m.Fields {
+			value, err := m.value(document, field)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			result.Values = append(result.Values, Value{Field: field, Value: value})
+		}
+
+		if m.TimestampField != "" {
+			timestamp, err := m.timestamp(document)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				result.Timestamp = timestamp
+			}
+		}
+
+		if m.SequenceField != "" {
+			sequence, device, err := m.sequence(document)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				result.Sequence = sequence
+				result.HasSequence = true
+				result.Device = device
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, errs
+}
+
+// Field looks up a dotted path such as "battery.level" or "values.0" in a
+// decoded JSON document
+func Field(document any, path string) (any, bool) {
+	current := document
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]any:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+
+			current = value
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func (m *Mapping) value(document any, field string) (float64, error) {
+	raw, ok := Field(document, field)
+	if !ok {
+		return 0, &Error{Mapping: m.Name, Field: field, Reason: ReasonMissingField, Err: errMissingField}
+	}
+
+	value, err := toFloat(raw)
+	if err != nil {
+		return 0, &Error{Mapping: m.Name, Field: field, Reason: ReasonInvalidValue, Err: err}
+	}
+
+	return value, nil
+}
+
+func (m *Mapping) timestamp(document any) (time.Time, error) {
+	raw, ok := Field(document, m.TimestampField)
+	if !ok {
+		return time.Time{}, &Error{Mapping: m.Name, Field: m.TimestampField, Reason: ReasonMissingField, Err: errMissingField}
+	}
+
+	timestamp, err := ParseTimestamp(raw, m.TimestampFormat)
+	if err != nil {
+		return time.Time{}, &Error{Mapping: m.Name, Field: m.TimestampField, Reason: ReasonInvalidTimestamp, Err: err}
+	}
+
+	return timestamp, nil
+}
+
+// sequence returns the sequence number and, when the mapping has a device
+// field, the device it belongs to
+func (m *Mapping) sequence(document any) (int64, string, error) {
+	raw, ok := Field(document, m.SequenceField)
+	if !ok {
+		return 0, "", &Error{Mapping: m.Name, Field: m.SequenceField, Reason: ReasonMissingField, Err: errMissingField}
+	}
+
+	sequence, ok := toInt(raw)
+	if !ok {
+		return 0, "", &Error{Mapping: m.Name, Field: m.SequenceField, Reason: ReasonInvalidValue, Err: fmt.Errorf("sequence must be an integer, got %v", raw)}
+	}
+
+	if m.DeviceField == "" {
+		return sequence, "", nil
+	}
+
+	raw, ok = Field(document, m.DeviceField)
+	if !ok {
+		return 0, "", &Error{Mapping: m.Name, Field: m.DeviceField, Reason: ReasonMissingField, Err: errMissingField}
+	}
+
+	switch device := raw.(type) {
+	case string:
+		return sequence, device, nil
+	case json.Number:
+		return sequence, device.String(), nil
+	default:
+		return 0, "", &Error{Mapping: m.Name, Field: m.DeviceField, Reason: ReasonInvalidValue, Err: fmt.Errorf("device must be a string or a number, got %v", raw)}
+	}
+}
+
+// toFloat converts a decoded JSON value to a float. Booleans map to 1 and 0
+// and numeric strings are parsed.
+func toFloat(raw any) (float64, error) {
+	switch v := raw.(type) {
+	case json.Number:
+		return v.Float64()
+	case bool:
+		if v {
+			return 1, nil
+		}
+
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	default:
+		return 0, fmt.Errorf("unsupported value type %T", raw)
+	}
+}
+
+// toInt returns raw as an integer when it is an integral JSON number or
+// numeric string
+func toInt(raw any) (int64, bool) {
+	var text string
+
+	switch v := raw.(type) {
+	case json.Number:
+		text = v.String()
+	case string:
+		text = strings.TrimSpace(v)
+	default:
+		return 0, false
+	}
+
+	integer, err := strconv.ParseInt(text, 10, 64)
+
+	return integer, err == nil
+}
+
+// autoMillisecondsThreshold separates epoch seconds from epoch milliseconds
+// in the auto format: 1e11 seconds is in the year 5138, while 1e11
+// milliseconds is in 1973.
+const autoMillisecondsThreshold = 1e11
+
+// ParseTimestamp converts a decoded JSON value to a time using format, one
+// of auto, unix, unix_ms or rfc3339
+func ParseTimestamp(raw any, format string) (time.Time, error) {
+	if format == "rfc3339" || format == "auto" {
+		if s, ok := raw.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t, nil
+			} else if format == "rfc3339" {
+				return time.Time{}, err
+			}
+		} else if format == "rfc3339" {
+			return time.Time{}, fmt.Errorf("expected an RFC 3339 string, got %T", raw)
+		}
+	}
+
+	// Integer epochs are converted exactly; floats would lose the
+	// millisecond digits of a current timestamp.
+	if integer, ok := toInt(raw); ok && integer >= 0 {
+		if format == "unix_ms" || format == "auto" && integer >= autoMillisecondsThreshold {
+			return time.UnixMilli(integer), nil
+		}
+
+		return time.Unix(integer, 0), nil
+	}
+
+	epoch, err := toFloat(raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if math.IsNaN(epoch) || math.IsInf(epoch, 0) || epoch < 0 {
+		return time.Time{}, fmt.Errorf("invalid epoch timestamp %v", epoch)
+	}
+
+	if format == "unix_ms" || format == "auto" && epoch >= autoMillisecondsThreshold {
+		epoch /= 1000
+	}
+
+	seconds, fraction := math.Modf(epoch)
+
+	return time.Unix(int64(seconds), int64(fraction*float64(time.Second))), nil
+}
@@ -0,0 +1,92 @@
+package mapping
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetApply(t *testing.T) {
+	set := New([]config.MappingConfig{
+		{
+			Name:   "climate",
+			Topic:  "sensor/+/climate",
+			Fields: []string{"temperature", "battery.level", "missing"},
+			Timestamp: config.TimestampConfig{
+				Field:  "ts",
+				Format: "auto",
+			},
+		},
+	})
+
+	results, errs := set.Apply("sensor/kitchen/climate", []byte(`{"temperature": 21.5, "battery": {"level": "87"}, "ts": 1700000000123}`))
+
+	require.Len(t, results, 1)
+	assert.Equal(t, []Value{{Field: "temperature", Value: 21.5}, {Field: "battery.level", Value: 87}}, results[0].Values)
+	assert.Equal(t, time.UnixMilli(1700000000123), results[0].Timestamp)
+
+	require.Len(t, errs, 1)
+
+	var mappingErr *Error
+	require.True(t, errors.As(errs[0], &mappingErr))
+	assert.Equal(t, ReasonMissingField, mappingErr.Reason)
+	assert.Equal(t, "missing", mappingErr.Field)
+
+	results, errs = set.Apply("sensor/kitchen/climate", []byte(`not json`))
+	assert.Empty(t, results)
+	require.Len(t, errs, 1)
+	require.True(t, errors.As(errs[0], &mappingErr))
+	assert.Equal(t, ReasonInvalidJSON, mappingErr.Reason)
+
+	results, errs = set.Apply("other/topic", []byte(`not json`))
+	assert.Empty(t, results)
+	assert.Empty(t, errs)
+}
+
+func TestCompile(t *testing.T) {
+	set, err := Compile([]config.MappingConfig{
+		{Name: "climate", Topic: "sensor/+/climate", Fields: []string{"temperature", "battery.level"}},
+		{Name: "broken", Topic: "meter/#", Fields: []string{"power.", "ok"}, Sequence: config.SequenceConfig{Field: ".seq"}},
+	})
+
+	require.Error(t, err)
+	assert.Equal(t, `mapping "broken": field path "power." has an empty segment
+mapping "broken": field path ".seq" has an empty segment`, err.Error())
+	assert.Equal(t, 2, set.Len())
+
+	_, err = Compile([]config.MappingConfig{
+		{Name: "climate", Topic: "sensor/+/climate", Fields: []string{"temperature", "values.0"}},
+	})
+	assert.NoError(t, err)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	cases := []struct {
+		raw    any
+		format string
+		want   time.Time
+	}{
+		{"2024-05-01T12:00:00Z", "auto", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"2024-05-01T12:00:00.5+02:00", "rfc3339", time.Date(2024, 5, 1, 10, 0, 0, 500000000, time.UTC)},
+		{"1700000000", "auto", time.Unix(1700000000, 0)},
+		{"1700000000000", "auto", time.Unix(1700000000, 0)},
+		{"1700000000", "unix", time.Unix(1700000000, 0)},
+		{"1700000000500", "unix_ms", time.Unix(1700000000, 500000000)},
+	}
+
+	for _, c := range cases {
+		got, err := ParseTimestamp(c.raw, c.format)
+		require.NoError(t, err, "%v %s", c.raw, c.format)
+		assert.True(t, c.want.Equal(got), "%v %s: want %v, got %v", c.raw, c.format, c.want, got)
+	}
+
+	_, err := ParseTimestamp("yesterday", "rfc3339")
+	assert.Error(t, err)
+
+	_, err = ParseTimestamp("-1", "unix")
+	assert.Error(t, err)
+}
@@ -0,0 +1,276 @@
+// Package mappingtest runs payload mapping test cases without a broker, for
+// the test-mapping subcommand. Each case feeds messages through the same
+// pipeline as messages received from the broker and compares the resulting
+// metrics with the expected ones, like promtool test rules.
+package mappingtest
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/d0ugal/mqtt-exporter/internal/collectors"
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	promexporter_config "github.com/d0ugal/promexporter/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixtures is a file of mapping test cases
+type Fixtures struct {
+	Tests []Case `yaml:"tests"`
+}
+
+// Case is a single test: the messages to process and the samples expected
+// afterwards. A case with a topic is a single message; messages lists
+// several, processed in order.
+type Case struct {
+	Name     string    `yaml:"name"`
+	Topic    string    `yaml:"topic"`
+	Payload  string    `yaml:"payload"`
+	QoS      byte      `yaml:"qos"`
+	Retained bool      `yaml:"retained"`
+	Messages []Message `yaml:"messages"`
+	// Expected lists samples in the exposition format. Every sample of the
+	// metrics named here must be listed; other metrics are ignored.
+	Expected string `yaml:"expected"`
+}
+
+// Message is a message processed by a test case
+type Message struct {
+	Topic    string `yaml:"topic"`
+	Payload  string `yaml:"payload"`
+	QoS      byte   `yaml:"qos"`
+	Retained bool   `yaml:"retained"`
+}
+
+// Result is the outcome of a test case
+type Result struct {
+	// Exposition is the text exposition of the message metrics after the
+	// case ran
+	Exposition string
+	// Problems lists the differences from the expected samples, empty when
+	// the case passed
+	Problems []string
+}
+
+// LoadFixtures reads a fixtures file
+func LoadFixtures(path string) (*Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures Fixtures
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&fixtures); err != nil {
+		return nil, fmt.Errorf("failed to parse fixtures file %s: %w", path, err)
+	}
+
+	for i, c := range fixtures.Tests {
+		if c.Name == "" {
+			fixtures.Tests[i].Name = fmt.Sprintf("test %d", i+1)
+		}
+
+		if c.Topic == "" && len(c.Messages) == 0 {
+			return nil, fmt.Errorf("%s: %s: a topic or messages are required", path, fixtures.Tests[i].Name)
+		}
+	}
+
+	return &fixtures, nil
+}
+
+// Run runs a test case against a fresh collector for cfg
+func Run(cfg *config.Config, c Case) (*Result, error) {
+	expected, err := parseSamples(c.Expected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected samples: %w", err)
+	}
+
+	// Process every message inline and keep tracing and logging out of the
+	// way; mapping errors show up in the metrics
+	copied := *cfg
+	cfg = &copied
+	cfg.MQTT.Processing.Workers = 0
+	cfg.Tracing = promexporter_config.TracingConfig{}
+	cfg.Logging = promexporter_config.LoggingConfig{Level: "error", Format: "text"}
+
+	collector, registry := collectors.NewOfflineCollector(cfg)
+
+	messages := c.Messages
+	if c.Topic != "" {
+		messages = append([]Message{{Topic: c.Topic, Payload: c.Payload, QoS: c.QoS, Retained: c.Retained}}, messages...)
+	}
+
+	for _, msg := range messages {
+		collector.HandleMessage(&message{
+			topic:    msg.Topic,
+			payload:  []byte(msg.Payload),
+			qos:      msg.QoS,
+			retained: msg.Retained,
+		})
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	var exposition bytes.Buffer
+
+	encoder := expfmt.NewEncoder(&exposition, expfmt.NewFormat(expfmt.TypeTextPlain))
+
+	for _, family := range families {
+		if !messageMetric(family.GetName()) {
+			continue
+		}
+
+		if err := encoder.Encode(family); err != nil {
+			return nil, fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+
+	actual, err := parseSamples(exposition.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %w", err)
+	}
+
+	return &Result{
+		Exposition: exposition.String(),
+		Problems:   compare(expected, actual),
+	}, nil
+}
+
+// messageMetric reports whether a metric is about the processed messages,
+// leaving out the Go runtime, process and exporter self metrics
+func messageMetric(name string) bool {
+	return strings.HasPrefix(name, "mqtt_") && !strings.HasPrefix(name, "mqtt_exporter_")
+}
+
+// sample is a single series and its value
+type sample struct {
+	name   string
+	series string
+	value  float64
+}
+
+// parseSamples parses exposition text into samples keyed by series. Comment
+// lines are ignored, so histogram buckets, sums and counts are separate
+// untyped series, just as they are written in expectations.
+func parseSamples(text string) (map[string]sample, error) {
+	var lines []string
+
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+
+	families, err := parser.TextToMetricFamilies(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make(map[string]sample)
+
+	for name, family := range families {
+		for _, metric := range family.GetMetric() {
+			series := seriesName(name, metric.GetLabel())
+			samples[series] = sample{
+				name:   name,
+				series: series,
+				value:  metric.GetUntyped().GetValue(),
+			}
+		}
+	}
+
+	return samples, nil
+}
+
+// seriesName formats a series with its labels sorted by name
+func seriesName(name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+
+	slices.Sort(pairs)
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// compare lists the expected samples that are missing or have a different
+// value, and the unexpected samples of the metrics that were expected
+func compare(expected, actual map[string]sample) []string {
+	var problems []string
+
+	names := make(map[string]bool)
+
+	for _, series := range sortedSeries(expected) {
+		want := expected[series]
+		names[want.name] = true
+
+		got, ok := actual[series]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing %s %g", series, want.value))
+			continue
+		}
+
+		if !sameValue(got.value, want.value) {
+			problems = append(problems, fmt.Sprintf("%s: got %g, want %g", series, got.value, want.value))
+		}
+	}
+
+	for _, series := range sortedSeries(actual) {
+		got := actual[series]
+
+		if _, ok := expected[series]; !ok && names[got.name] {
+			problems = append(problems, fmt.Sprintf("unexpected %s %g", series, got.value))
+		}
+	}
+
+	return problems
+}
+
+func sortedSeries(samples map[string]sample) []string {
+	return slices.Sorted(maps.Keys(samples))
+}
+
+// sameValue compares sample values, allowing for float formatting
+func sameValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+
+	return a == b || math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// message is a MQTT.Message built from a test case
+type message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return m.qos }
+func (m *message) Retained() bool    { return m.retained }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
@@ -0,0 +1,94 @@
+package mappingtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+mqtt:
+  broker: "localhost:1883"
+  mappings:
+    - name: power
+      topic: "meter/+/power"
+      fields: ["watts"]
+`), 0o600))
+
+	cfg, err := config.LoadConfig(path)
+	require.NoError(t, err)
+
+	return cfg
+}
+
+// TestRun checks that expected samples are matched regardless of label
+// order, and that wrong values, missing samples and unexpected samples of
+// the expected metrics are all reported.
+func TestRun(t *testing.T) {
+	cfg := testConfig(t)
+
+	result, err := Run(cfg, Case{
+		Topic:   "meter/a/power",
+		Payload: `{"watts": 230}`,
+		Messages: []Message{
+			{Topic: "meter/b/power", Payload: `{"watts": 115.5}`},
+			{Topic: "meter/c/power", Payload: `{"volts": 230}`},
+		},
+		Expected: `
+mqtt_payload_value{topic="meter/a/power",field="watts",mapping="power"} 230
+mqtt_payload_value{mapping="power",topic="meter/b/power",field="watts"} 115.5
+mqtt_payload_errors_total{mapping="power",reason="missing_field"} 1
+mqtt_messages_total{topic="meter/a/power"} 1
+mqtt_messages_total{topic="meter/b/power"} 1
+mqtt_messages_total{topic="meter/c/power"} 1
+`,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, result.Problems)
+	assert.Contains(t, result.Exposition, `mqtt_payload_value{field="watts",mapping="power",topic="meter/a/power"} 230`)
+	assert.NotContains(t, result.Exposition, "go_goroutines")
+
+	result, err = Run(cfg, Case{
+		Messages: []Message{
+			{Topic: "meter/a/power", Payload: `{"watts": 230}`},
+			{Topic: "meter/b/power", Payload: `{"watts": 115.5}`},
+		},
+		Expected: `
+mqtt_payload_value{mapping="power",topic="meter/a/power",field="watts"} 231
+mqtt_payload_value{mapping="power",topic="meter/c/power",field="watts"} 1
+`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`mqtt_payload_value{field="watts",mapping="power",topic="meter/a/power"}: got 230, want 231`,
+		`missing mqtt_payload_value{field="watts",mapping="power",topic="meter/c/power"} 1`,
+		`unexpected mqtt_payload_value{field="watts",mapping="power",topic="meter/b/power"} 115.5`,
+	}, result.Problems)
+
+	_, err = Run(cfg, Case{Topic: "meter/a/power", Expected: "not a sample"})
+	assert.Error(t, err)
+}
+
+func TestLoadFixtures(t *testing.T) {
+	fixtures, err := LoadFixtures("../../mapping-tests.example.yaml")
+	require.NoError(t, err)
+	assert.Len(t, fixtures.Tests, 3)
+
+	path := filepath.Join(t.TempDir(), "fixtures.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte("tests:\n  - expected: \"\"\n"), 0o600))
+	_, err = LoadFixtures(path)
+	assert.ErrorContains(t, err, "test 1: a topic or messages are required")
+
+	require.NoError(t, os.WriteFile(path, []byte("tests:\n  - topic: a\n    payloads: b\n"), 0o600))
+	_, err = LoadFixtures(path)
+	assert.ErrorContains(t, err, "field payloads not found")
+}
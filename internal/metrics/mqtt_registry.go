@@ -1,38 +1,110 @@
 package metrics
 
 import (
+	"strconv"
+
 	promexporter_metrics "github.com/d0ugal/promexporter/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// Options selects the optional labels of the MQTT metrics
+type Options struct {
+	// MessageQoSLabel adds a qos label to mqtt_messages_total
+	MessageQoSLabel bool
+	// MessageDupLabel adds a dup label to mqtt_messages_total
+	MessageDupLabel bool
+	// Replica, if set, is added as a replica label to every MQTT metric, to
+	// tell apart the replicas sharing subscriptions
+	Replica string
+}
+
 // MQTTRegistry wraps the promexporter registry with MQTT-specific metrics
 type MQTTRegistry struct {
 	*promexporter_metrics.Registry
 
+	options Options
+
 	// MQTT message counters
-	MQTTMessageCount *prometheus.CounterVec
-	MQTTMessageBytes *prometheus.CounterVec
+	MQTTMessageCount         *prometheus.CounterVec
+	MQTTMessageBytes         *prometheus.CounterVec
+	MQTTRetainedMessageCount *prometheus.CounterVec
 
 	// MQTT connection metrics
-	MQTTConnectionStatus *prometheus.GaugeVec
-	MQTTConnectionErrors *prometheus.CounterVec
-	MQTTReconnectsTotal  *prometheus.CounterVec
+	MQTTConnectionStatus   *prometheus.GaugeVec
+	MQTTConnectionErrors   *prometheus.CounterVec
+	MQTTReconnectsTotal    *prometheus.CounterVec
+	MQTTBrokerCertNotAfter *prometheus.GaugeVec
 
 	// MQTT topic metrics
-	MQTTTopicLastMessage *prometheus.GaugeVec
+	MQTTTopicLastMessage      *prometheus.GaugeVec
+	MQTTTopicExpectedInterval *prometheus.GaugeVec
+	MQTTTopicSilent           *prometheus.GaugeVec
+
+	// Payload mapping metrics
+	MQTTPayloadValues  *PayloadValues
+	MQTTPayloadErrors  *prometheus.CounterVec
+	MQTTMessageLatency *prometheus.HistogramVec
+
+	// Payload sequence metrics
+	MQTTSequenceGaps     *prometheus.CounterVec
+	MQTTSequenceReorders *prometheus.CounterVec
+	MQTTSequenceResets   *prometheus.CounterVec
+
+	// Round-trip probe metrics
+	MQTTProbeRTT     *prometheus.HistogramVec
+	MQTTProbeSuccess *prometheus.GaugeVec
+	MQTTProbeLost    *prometheus.CounterVec
+
+	// Device availability metrics
+	MQTTDeviceUp              *prometheus.GaugeVec
+	MQTTDeviceLastStateChange *prometheus.GaugeVec
+	MQTTDeviceFlaps           *prometheus.CounterVec
+
+	// Processing queue metrics
+	MQTTQueueDepth                prometheus.Gauge
+	MQTTQueueDropped              prometheus.Counter
+	MQTTMessageProcessingDuration prometheus.Histogram
+
+	// Configuration reload metrics
+	ConfigReloads                    *prometheus.CounterVec
+	ConfigLastReloadSuccessful       prometheus.Gauge
+	ConfigLastReloadSuccessTimestamp prometheus.Gauge
+
+	// State snapshot metrics
+	StateSaves             *prometheus.CounterVec
+	StateLastSaveTimestamp prometheus.Gauge
+
+	// Leader election metrics
+	Leader *prometheus.GaugeVec
 }
 
 // NewMQTTRegistry creates a new MQTT metrics registry
 //
 
-func NewMQTTRegistry(baseRegistry *promexporter_metrics.Registry) *MQTTRegistry {
+func NewMQTTRegistry(baseRegistry *promexporter_metrics.Registry, options Options) *MQTTRegistry {
 	// Get the underlying Prometheus registry
 	promRegistry := baseRegistry.GetRegistry()
-	factory := promauto.With(promRegistry)
+
+	var registerer prometheus.Registerer = promRegistry
+	if options.Replica != "" {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"replica": options.Replica}, promRegistry)
+	}
+
+	factory := promauto.With(registerer)
 
 	mqtt := &MQTTRegistry{
 		Registry: baseRegistry,
+		options:  options,
+	}
+
+	messageLabels := []string{"topic"}
+	if options.MessageQoSLabel {
+		messageLabels = append(messageLabels, "qos")
+	}
+
+	if options.MessageDupLabel {
+		messageLabels = append(messageLabels, "dup")
 	}
 
 	// MQTT message counters
@@ -41,10 +113,10 @@ func NewMQTTRegistry(baseRegistry *promexporter_metrics.Registry) *MQTTRegistry
 			Name: "mqtt_messages_total",
 			Help: "Total number of MQTT messages received",
 		},
-		[]string{"topic"},
+		messageLabels,
 	)
 
-	baseRegistry.AddMetricInfo("mqtt_messages_total", "Total number of MQTT messages received", []string{"topic"})
+	baseRegistry.AddMetricInfo("mqtt_messages_total", "Total number of MQTT messages received", messageLabels)
 
 	mqtt.MQTTMessageBytes = factory.NewCounterVec(
 		prometheus.CounterOpts{
@@ -56,6 +128,16 @@ func NewMQTTRegistry(baseRegistry *promexporter_metrics.Registry) *MQTTRegistry
 
 	baseRegistry.AddMetricInfo("mqtt_message_bytes_total", "Total number of bytes received in MQTT messages", []string{"topic"})
 
+	mqtt.MQTTRetainedMessageCount = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_retained_messages_total",
+			Help: "Total number of retained MQTT messages received",
+		},
+		[]string{"topic"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_retained_messages_total", "Total number of retained MQTT messages received", []string{"topic"})
+
 	// MQTT connection metrics
 	mqtt.MQTTConnectionStatus = factory.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -87,6 +169,16 @@ func NewMQTTRegistry(baseRegistry *promexporter_metrics.Registry) *MQTTRegistry
 
 	baseRegistry.AddMetricInfo("mqtt_reconnects_total", "Total number of MQTT reconnection attempts", []string{"broker"})
 
+	mqtt.MQTTBrokerCertNotAfter = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_broker_cert_not_after_timestamp_seconds",
+			Help: "Unix timestamp at which each certificate presented by the broker expires",
+		},
+		[]string{"broker", "subject", "issuer", "serial"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_broker_cert_not_after_timestamp_seconds", "Unix timestamp at which each certificate presented by the broker expires", []string{"broker", "subject", "issuer", "serial"})
+
 	// MQTT topic metrics
 	mqtt.MQTTTopicLastMessage = factory.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -98,5 +190,256 @@ func NewMQTTRegistry(baseRegistry *promexporter_metrics.Registry) *MQTTRegistry
 
 	baseRegistry.AddMetricInfo("mqtt_topic_last_message_timestamp", "Unix timestamp of the last message received on each topic", []string{"topic"})
 
+	mqtt.MQTTTopicExpectedInterval = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_topic_expected_interval_seconds",
+			Help: "Interval at which the topics matching each heartbeat pattern are expected to publish",
+		},
+		[]string{"pattern"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_topic_expected_interval_seconds", "Interval at which the topics matching each heartbeat pattern are expected to publish", []string{"pattern"})
+
+	mqtt.MQTTTopicSilent = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_topic_silent",
+			Help: "Whether a topic missed its expected heartbeats (1 = silent, 0 = publishing)",
+		},
+		[]string{"pattern", "topic"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_topic_silent", "Whether a topic missed its expected heartbeats (1 = silent, 0 = publishing)", []string{"pattern", "topic"})
+
+	// Payload mapping metrics
+	mqtt.MQTTPayloadValues = NewPayloadValues(
+		"mqtt_payload_value",
+		"Last value extracted from the payload by a mapping",
+		[]string{"mapping", "topic", "field"},
+	)
+	registerer.MustRegister(mqtt.MQTTPayloadValues)
+
+	baseRegistry.AddMetricInfo("mqtt_payload_value", "Last value extracted from the payload by a mapping", []string{"mapping", "topic", "field"})
+
+	mqtt.MQTTPayloadErrors = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_payload_errors_total",
+			Help: "Total number of payloads a mapping failed to extract a value from",
+		},
+		[]string{"mapping", "reason"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_payload_errors_total", "Total number of payloads a mapping failed to extract a value from", []string{"mapping", "reason"})
+
+	mqtt.MQTTMessageLatency = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mqtt_message_latency_seconds",
+			Help:    "Time between the device-side payload timestamp and the message being received",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		},
+		[]string{"mapping"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_message_latency_seconds", "Time between the device-side payload timestamp and the message being received", []string{"mapping"})
+
+	// Payload sequence metrics
+	mqtt.MQTTSequenceGaps = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_sequence_gaps_total",
+			Help: "Total number of payload sequence numbers skipped on each topic",
+		},
+		[]string{"mapping", "topic"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_sequence_gaps_total", "Total number of payload sequence numbers skipped on each topic", []string{"mapping", "topic"})
+
+	mqtt.MQTTSequenceReorders = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_sequence_reorders_total",
+			Help: "Total number of messages that arrived with an older payload sequence number than the last one seen",
+		},
+		[]string{"mapping", "topic"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_sequence_reorders_total", "Total number of messages that arrived with an older payload sequence number than the last one seen", []string{"mapping", "topic"})
+
+	mqtt.MQTTSequenceResets = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_sequence_resets_total",
+			Help: "Total number of payload sequence number resets on each topic",
+		},
+		[]string{"mapping", "topic"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_sequence_resets_total", "Total number of payload sequence number resets on each topic", []string{"mapping", "topic"})
+
+	// Round-trip probe metrics
+	mqtt.MQTTProbeRTT = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mqtt_probe_rtt_seconds",
+			Help:    "Round-trip time of probe messages published to and received back from the broker",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"broker"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_probe_rtt_seconds", "Round-trip time of probe messages published to and received back from the broker", []string{"broker"})
+
+	mqtt.MQTTProbeSuccess = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_probe_success",
+			Help: "Whether the last probe message was received back from the broker (1 = success, 0 = failure)",
+		},
+		[]string{"broker"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_probe_success", "Whether the last probe message was received back from the broker (1 = success, 0 = failure)", []string{"broker"})
+
+	mqtt.MQTTProbeLost = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_probe_lost_total",
+			Help: "Total number of probe messages that were not received back before the timeout",
+		},
+		[]string{"broker"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_probe_lost_total", "Total number of probe messages that were not received back before the timeout", []string{"broker"})
+
+	// Device availability metrics
+	mqtt.MQTTDeviceUp = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_device_up",
+			Help: "Device availability from its status topic (1 = online, 0 = offline)",
+		},
+		[]string{"device"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_device_up", "Device availability from its status topic (1 = online, 0 = offline)", []string{"device"})
+
+	mqtt.MQTTDeviceLastStateChange = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_device_last_state_change_timestamp_seconds",
+			Help: "Unix timestamp of the last availability change of each device",
+		},
+		[]string{"device"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_device_last_state_change_timestamp_seconds", "Unix timestamp of the last availability change of each device", []string{"device"})
+
+	mqtt.MQTTDeviceFlaps = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_device_flaps_total",
+			Help: "Total number of times each device changed between online and offline",
+		},
+		[]string{"device"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_device_flaps_total", "Total number of times each device changed between online and offline", []string{"device"})
+
+	// Processing queue metrics
+	mqtt.MQTTQueueDepth = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt_exporter_queue_depth",
+			Help: "Number of received messages waiting to be processed",
+		},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_queue_depth", "Number of received messages waiting to be processed", []string{})
+
+	mqtt.MQTTQueueDropped = factory.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_queue_dropped_total",
+			Help: "Total number of received messages dropped because the processing queue was full",
+		},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_queue_dropped_total", "Total number of received messages dropped because the processing queue was full", []string{})
+
+	mqtt.MQTTMessageProcessingDuration = factory.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mqtt_exporter_message_processing_seconds",
+			Help:    "Time between a message being received and its processing finishing, including time spent queued",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_message_processing_seconds", "Time between a message being received and its processing finishing, including time spent queued", []string{})
+
+	// Configuration reload metrics
+	mqtt.ConfigReloads = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_config_reloads_total",
+			Help: "Total number of configuration reloads by result",
+		},
+		[]string{"result"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_config_reloads_total", "Total number of configuration reloads by result", []string{"result"})
+
+	mqtt.ConfigLastReloadSuccessful = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload succeeded (1 = success, 0 = failure)",
+		},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_config_last_reload_successful", "Whether the last configuration reload succeeded (1 = success, 0 = failure)", []string{})
+
+	mqtt.ConfigLastReloadSuccessTimestamp = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful configuration load",
+		},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_config_last_reload_success_timestamp_seconds", "Unix timestamp of the last successful configuration load", []string{})
+
+	mqtt.StateSaves = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_state_saves_total",
+			Help: "Total number of state snapshots saved by result",
+		},
+		[]string{"result"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_state_saves_total", "Total number of state snapshots saved by result", []string{"result"})
+
+	mqtt.StateLastSaveTimestamp = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt_exporter_state_last_save_timestamp_seconds",
+			Help: "Unix timestamp of the last successful state snapshot",
+		},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_state_last_save_timestamp_seconds", "Unix timestamp of the last successful state snapshot", []string{})
+
+	// Leader election metrics
+	mqtt.Leader = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mqtt_exporter_leader",
+			Help: "Whether this exporter is the leader of its leader election (1 = leader, 0 = standby)",
+		},
+		[]string{"topic"},
+	)
+
+	baseRegistry.AddMetricInfo("mqtt_exporter_leader", "Whether this exporter is the leader of its leader election (1 = leader, 0 = standby)", []string{"topic"})
+
 	return mqtt
 }
+
+// MessageLabels returns the labels for mqtt_messages_total, including the
+// optional qos and dup labels when they are enabled
+func (r *MQTTRegistry) MessageLabels(topic string, qos byte, duplicate bool) prometheus.Labels {
+	labels := prometheus.Labels{
+		"topic": topic,
+	}
+
+	if r.options.MessageQoSLabel {
+		labels["qos"] = strconv.Itoa(int(qos))
+	}
+
+	if r.options.MessageDupLabel {
+		labels["dup"] = strconv.FormatBool(duplicate)
+	}
+
+	return labels
+}
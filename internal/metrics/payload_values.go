@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PayloadValues exposes the last value each payload mapping extracted per
+// topic and field. Values can carry the device-side timestamp, which a
+// GaugeVec cannot, so this is a custom collector.
+type PayloadValues struct {
+	desc *prometheus.Desc
+
+	mu     sync.RWMutex
+	values map[payloadValueKey]payloadValue
+}
+
+type payloadValueKey struct {
+	mapping string
+	topic   string
+	field   string
+}
+
+type payloadValue struct {
+	value     float64
+	timestamp time.Time
+}
+
+// NewPayloadValues creates an empty payload value collector
+func NewPayloadValues(name, help string, labels []string) *PayloadValues {
+	return &PayloadValues{
+		desc:   prometheus.NewDesc(name, help, labels, nil),
+		values: make(map[payloadValueKey]payloadValue),
+	}
+}
+
+// Set stores the last value for a mapping, topic and field. A zero timestamp
+// exposes the value without a timestamp.
+func (p *PayloadValues) Set(mapping, topic, field string, value float64, timestamp time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.values[payloadValueKey{mapping: mapping, topic: topic, field: field}] = payloadValue{
+		value:     value,
+		timestamp: timestamp,
+	}
+}
+
+// Retain removes every value for which keep returns false, such as the
+// values of mappings that were removed from the configuration
+func (p *PayloadValues) Retain(keep func(mapping, field string) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key := range p.values {
+		if !keep(key.mapping, key.field) {
+			delete(p.values, key)
+		}
+	}
+}
+
+// Each calls fn with every stored value
+func (p *PayloadValues) Each(fn func(mapping, topic, field string, value float64, timestamp time.Time)) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for key, value := range p.values {
+		fn(key.mapping, key.topic, key.field, value.value, value.timestamp)
+	}
+}
+
+// Describe implements prometheus.Collector
+func (p *PayloadValues) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+// Collect implements prometheus.Collector
+func (p *PayloadValues) Collect(ch chan<- prometheus.Metric) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for key, value := range p.values {
+		metric := prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, value.value, key.mapping, key.topic, key.field)
+
+		if !value.timestamp.IsZero() {
+			metric = prometheus.NewMetricWithTimestamp(value.timestamp, metric)
+		}
+
+		ch <- metric
+	}
+}
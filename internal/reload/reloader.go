@@ -0,0 +1,176 @@
+package reload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reloader reloads the configuration file on SIGHUP, on POST /-/reload and,
+// when watching is enabled, whenever the file changes. A configuration that
+// fails to load or validate, or that the collector refuses to apply, is
+// rejected and the running one is kept.
+// Reloader implements app.Collector so that it runs for the lifetime of the
+// application.
+type Reloader struct {
+	path    string
+	watch   config.ReloadConfig
+	metrics *metrics.MQTTRegistry
+	apply   func(*config.Config) error
+
+	mu       sync.Mutex
+	checksum [sha256.Size]byte
+	done     chan struct{}
+}
+
+// New creates a Reloader for the configuration file at path. apply is called
+// with every configuration that loads successfully, and returns an error
+// when it rejects it.
+func New(path string, cfg *config.Config, metricsRegistry *metrics.MQTTRegistry, apply func(*config.Config) error) *Reloader {
+	r := &Reloader{
+		path:    path,
+		watch:   cfg.Reload,
+		metrics: metricsRegistry,
+		apply:   apply,
+		done:    make(chan struct{}),
+	}
+
+	// The running configuration was loaded successfully at startup
+	r.checksum, _ = r.fileChecksum()
+	r.metrics.ConfigLastReloadSuccessful.Set(1)
+	r.metrics.ConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+
+	return r
+}
+
+// Reload loads, validates and applies the configuration file
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Remember the file even if it is invalid, so that a broken file is
+	// not reloaded again on every watch interval
+	if checksum, err := r.fileChecksum(); err == nil {
+		r.checksum = checksum
+	}
+
+	cfg, err := config.LoadConfig(r.path)
+	if err == nil {
+		err = r.apply(cfg)
+	}
+
+	if err != nil {
+		slog.Error("Failed to reload configuration, keeping the running configuration", "path", r.path, "error", err)
+
+		r.metrics.ConfigReloads.With(prometheus.Labels{"result": "failure"}).Inc()
+		r.metrics.ConfigLastReloadSuccessful.Set(0)
+
+		return err
+	}
+
+	r.metrics.ConfigReloads.With(prometheus.Labels{"result": "success"}).Inc()
+	r.metrics.ConfigLastReloadSuccessful.Set(1)
+	r.metrics.ConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+
+	return nil
+}
+
+// Start listens for SIGHUP and, if enabled, watches the configuration file
+func (r *Reloader) Start(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		// A nil channel never fires, so without watching only signals and
+		// the endpoint trigger reloads
+		var watch <-chan time.Time
+
+		if r.watch.Watch {
+			ticker := time.NewTicker(r.watch.WatchInterval.Duration)
+			defer ticker.Stop()
+
+			watch = ticker.C
+
+			slog.Info("Watching configuration file for changes", "path", r.path, "interval", r.watch.WatchInterval.Duration)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.done:
+				return
+			case <-signals:
+				slog.Info("Received SIGHUP, reloading configuration", "path", r.path)
+				_ = r.Reload()
+			case <-watch:
+				if r.changed() {
+					slog.Info("Configuration file changed, reloading", "path", r.path)
+					_ = r.Reload()
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops listening for reload triggers
+func (r *Reloader) Stop() {
+	close(r.done)
+}
+
+// ServeHTTP implements http.Handler for POST /-/reload
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if err := r.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = fmt.Fprintln(w, "configuration reloaded")
+}
+
+// changed reports whether the file content differs from the last reload
+func (r *Reloader) changed() bool {
+	checksum, err := r.fileChecksum()
+	if err != nil {
+		slog.Debug("Failed to read configuration file", "path", r.path, "error", err)
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !bytes.Equal(checksum[:], r.checksum[:])
+}
+
+// fileChecksum hashes the configuration file. Comparing contents rather
+// than modification times also catches ConfigMap updates, which replace a
+// symlink.
+func (r *Reloader) fileChecksum() ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return sha256.Sum256(data), nil
+}
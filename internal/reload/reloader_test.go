@@ -0,0 +1,140 @@
+package reload
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	promexporter_metrics "github.com/d0ugal/promexporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validConfig = `
+mqtt:
+    broker: "localhost:1883"
+    topics: ["sensor/#"]
+`
+
+func newTestReloader(t *testing.T, content string) (*Reloader, string, *[]*config.Config) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	cfg, err := config.LoadConfig(path)
+	require.NoError(t, err)
+
+	baseRegistry := promexporter_metrics.NewRegistry("mqtt_exporter_info_test")
+	mqttMetrics := metrics.NewMQTTRegistry(baseRegistry, metrics.Options{})
+
+	var applied []*config.Config
+
+	reloader := New(path, cfg, mqttMetrics, func(cfg *config.Config) error {
+		if cfg.MQTT.ClientID == "restart-required" {
+			return errors.New("changing mqtt.client_id needs a restart")
+		}
+
+		applied = append(applied, cfg)
+
+		return nil
+	})
+
+	return reloader, path, &applied
+}
+
+func postReload(reloader *Reloader) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+
+	return recorder
+}
+
+// TestReloader_Endpoint checks that POST /-/reload applies a valid file,
+// rejects an invalid one without applying it and records both in the
+// reload metrics.
+func TestReloader_Endpoint(t *testing.T) {
+	reloader, path, applied := newTestReloader(t, validConfig)
+	reloads := reloader.metrics.ConfigReloads
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(reloader.metrics.ConfigLastReloadSuccessful))
+
+	recorder := httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Empty(t, *applied)
+
+	require.NoError(t, os.WriteFile(path, []byte(validConfig+`    qos: 1
+`), 0o600))
+
+	recorder = postReload(reloader)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	require.Len(t, *applied, 1)
+	assert.Equal(t, 1, (*applied)[0].MQTT.QoS)
+	assert.Equal(t, float64(1), testutil.ToFloat64(reloads.With(prometheus.Labels{"result": "success"})))
+
+	require.NoError(t, os.WriteFile(path, []byte(validConfig+`    qos: 7
+`), 0o600))
+
+	recorder = postReload(reloader)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "qos")
+	assert.Len(t, *applied, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(reloads.With(prometheus.Labels{"result": "failure"})))
+	assert.Equal(t, float64(0), testutil.ToFloat64(reloader.metrics.ConfigLastReloadSuccessful))
+
+	// A configuration the collector refuses is a failed reload too
+	require.NoError(t, os.WriteFile(path, []byte(validConfig+`    client_id: "restart-required"
+`), 0o600))
+
+	recorder = postReload(reloader)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "needs a restart")
+	assert.Len(t, *applied, 1)
+	assert.Equal(t, float64(2), testutil.ToFloat64(reloads.With(prometheus.Labels{"result": "failure"})))
+}
+
+// TestReloader_Watch checks that a changed file is reloaded once, and that
+// an unchanged or invalid file is not reloaded again on every interval.
+func TestReloader_Watch(t *testing.T) {
+	reloader, path, applied := newTestReloader(t, validConfig)
+
+	assert.False(t, reloader.changed())
+
+	require.NoError(t, os.WriteFile(path, []byte(validConfig+`    qos: 2
+`), 0o600))
+	assert.True(t, reloader.changed())
+
+	require.NoError(t, reloader.Reload())
+	assert.False(t, reloader.changed())
+	assert.Len(t, *applied, 1)
+
+	require.NoError(t, os.WriteFile(path, []byte("mqtt: ["), 0o600))
+	assert.True(t, reloader.changed())
+	assert.Error(t, reloader.Reload())
+	assert.False(t, reloader.changed())
+}
+
+// TestReloader_StartStop checks that the watcher reloads on its own.
+func TestReloader_StartStop(t *testing.T) {
+	reloader, path, _ := newTestReloader(t, validConfig)
+	reloader.watch = config.ReloadConfig{Watch: true, WatchInterval: config.Duration{Duration: 10 * time.Millisecond}}
+
+	reloader.Start(t.Context())
+	defer reloader.Stop()
+
+	require.NoError(t, os.WriteFile(path, []byte(validConfig+`    qos: 1
+`), 0o600))
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(reloader.metrics.ConfigReloads.With(prometheus.Labels{"result": "success"})) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Saver saves a snapshot every interval and once more when it is stopped.
+// Saver implements app.Collector; it is added after the MQTT collector so
+// that the final snapshot is taken once no more messages are processed.
+type Saver struct {
+	path     string
+	interval time.Duration
+	metrics  *metrics.MQTTRegistry
+	take     func() *Snapshot
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSaver creates a Saver for cfg. take returns the snapshot to save.
+func NewSaver(cfg config.StateConfig, metricsRegistry *metrics.MQTTRegistry, take func() *Snapshot) *Saver {
+	return &Saver{
+		path:     cfg.File,
+		interval: cfg.Interval.Duration,
+		metrics:  metricsRegistry,
+		take:     take,
+		done:     make(chan struct{}),
+	}
+}
+
+// Save takes and saves a snapshot
+func (s *Saver) Save() error {
+	if err := Save(s.path, s.take()); err != nil {
+		slog.Error("Failed to save state", "file", s.path, "error", err)
+		s.metrics.StateSaves.With(prometheus.Labels{"result": "failure"}).Inc()
+
+		return err
+	}
+
+	s.metrics.StateSaves.With(prometheus.Labels{"result": "success"}).Inc()
+	s.metrics.StateLastSaveTimestamp.SetToCurrentTime()
+
+	return nil
+}
+
+// Start saves a snapshot every interval in the background
+func (s *Saver) Start(ctx context.Context) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+				_ = s.Save()
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic saves and saves a final snapshot
+func (s *Saver) Stop() {
+	close(s.done)
+	s.wg.Wait()
+
+	if err := s.Save(); err == nil {
+		slog.Info("Saved state", "file", s.path)
+	}
+}
@@ -0,0 +1,114 @@
+// Package state saves snapshots of the per-topic counters and last values to
+// disk and loads them back, so that they survive a restart of the exporter.
+// A snapshot is a JSON file, replaced atomically on every save.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// version is the snapshot format version
+const version = 1
+
+// Snapshot is what the exporter had counted when it was taken
+type Snapshot struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Topics  []Topic   `json:"topics"`
+	// Counters and Gauges hold the series of metrics by name
+	Counters map[string][]Series `json:"counters"`
+	Gauges   map[string][]Series `json:"gauges"`
+	Values   []Value             `json:"values"`
+}
+
+// Topic is the state of a topic. Payloads are never saved.
+type Topic struct {
+	Topic    string    `json:"topic"`
+	Messages int64     `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+	LastSeen time.Time `json:"last_seen"`
+	Retained bool      `json:"retained,omitempty"`
+	Size     int       `json:"size"`
+}
+
+// Series is a single series of a metric
+type Series struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// Value is the last value a payload mapping extracted
+type Value struct {
+	Mapping   string    `json:"mapping"`
+	Topic     string    `json:"topic"`
+	Field     string    `json:"field"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp,omitzero"`
+}
+
+// Load reads the snapshot at path. The error wraps os.ErrNotExist when no
+// snapshot was saved yet.
+func Load(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // G304: the state path comes from the configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+
+	if snapshot.Version != version {
+		return nil, fmt.Errorf("unsupported state file version %d in %s", snapshot.Version, path)
+	}
+
+	return &snapshot, nil
+}
+
+// Save writes snapshot to path. It is written to a temporary file in the
+// same directory first and renamed over path, so a crash while saving
+// leaves the previous snapshot in place rather than a truncated one.
+func Save(path string, snapshot *Snapshot) error {
+	snapshot.Version = version
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		return discard(file, fmt.Errorf("failed to write state file: %w", err))
+	}
+
+	if err := file.Sync(); err != nil {
+		return discard(file, fmt.Errorf("failed to sync state file: %w", err))
+	}
+
+	if err := file.Close(); err != nil {
+		return discard(file, fmt.Errorf("failed to close state file: %w", err))
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return discard(file, fmt.Errorf("failed to replace state file: %w", err))
+	}
+
+	return nil
+}
+
+// discard removes the temporary file of a failed save
+func discard(file *os.File, err error) error {
+	_ = file.Close()
+
+	return errors.Join(err, os.Remove(file.Name()))
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+	"github.com/d0ugal/mqtt-exporter/internal/metrics"
+	promexporter_metrics "github.com/d0ugal/promexporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSnapshot() *Snapshot {
+	return &Snapshot{
+		Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		Topics: []Topic{
+			{Topic: "sensor/hall", Messages: 3, Bytes: 42, LastSeen: time.Date(2026, 3, 1, 11, 59, 0, 0, time.UTC), Size: 14},
+		},
+		Counters: map[string][]Series{
+			"mqtt_messages_total": {{Labels: map[string]string{"topic": "sensor/hall"}, Value: 3}},
+		},
+		Gauges: map[string][]Series{},
+		Values: []Value{
+			{Mapping: "climate", Topic: "sensor/hall", Field: "temperature", Value: 19.5},
+		},
+	}
+}
+
+// TestSaveLoad checks that a saved snapshot loads back the same and that
+// saving leaves no temporary files behind.
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	_, err := Load(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	snapshot := testSnapshot()
+	require.NoError(t, Save(path, snapshot))
+
+	snapshot.Topics[0].Messages = 4
+	require.NoError(t, Save(path, snapshot))
+
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot, loaded)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be renamed or removed")
+}
+
+// TestLoad_Invalid checks that broken or newer files are rejected.
+func TestLoad_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "topics": [`), 0o600))
+	_, err := Load(path)
+	assert.ErrorContains(t, err, "failed to parse state file")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 2}`), 0o600))
+	_, err = Load(path)
+	assert.ErrorContains(t, err, "unsupported state file version 2")
+}
+
+// TestSaver checks that stopping the saver saves a final snapshot and
+// records it in the metrics.
+func TestSaver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	baseRegistry := promexporter_metrics.NewRegistry("mqtt_exporter_info_test")
+	mqttMetrics := metrics.NewMQTTRegistry(baseRegistry, metrics.Options{})
+
+	saver := NewSaver(config.StateConfig{File: path, Interval: config.Duration{Duration: time.Hour}}, mqttMetrics, testSnapshot)
+	saver.Start(t.Context())
+	saver.Stop()
+
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), loaded.Topics[0].Messages)
+	assert.Equal(t, float64(1), testutil.ToFloat64(mqttMetrics.StateSaves.With(prometheus.Labels{"result": "success"})))
+
+	saver = NewSaver(config.StateConfig{File: filepath.Join(path, "missing", "state.json")}, mqttMetrics, testSnapshot)
+	assert.Error(t, saver.Save())
+	assert.Equal(t, float64(1), testutil.ToFloat64(mqttMetrics.StateSaves.With(prometheus.Labels{"result": "failure"})))
+}
@@ -0,0 +1,93 @@
+package topic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateFilter checks that filter is a valid MQTT topic filter: "#" may
+// only appear as the last level and wildcards must fill a whole level.
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("topic filter must not be empty")
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return fmt.Errorf("invalid topic filter %q: '#' must be the last level", filter)
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "#+"):
+			return fmt.Errorf("invalid topic filter %q: wildcards must occupy a whole level", filter)
+		}
+	}
+
+	return nil
+}
+
+// Match reports whether topic matches the MQTT topic filter. Topics starting
+// with "$" are only matched by filters that name them explicitly.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	for {
+		filterLevel, filterRest, filterMore := strings.Cut(filter, "/")
+		if filterLevel == "#" {
+			return true
+		}
+
+		topicLevel, topicRest, topicMore := strings.Cut(topic, "/")
+		if filterLevel != "+" && filterLevel != topicLevel {
+			return false
+		}
+
+		switch {
+		case !filterMore && !topicMore:
+			return true
+		case !topicMore:
+			// "a/#" also matches "a"
+			return filterRest == "#"
+		case !filterMore:
+			return false
+		}
+
+		filter, topic = filterRest, topicRest
+	}
+}
+
+// Wildcards returns the topic levels matched by the "+" and "#" wildcards of
+// filter, in order. It returns nil if topic does not match filter.
+func Wildcards(filter, topic string) []string {
+	if !Match(filter, topic) {
+		return nil
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	matched := []string{}
+
+	for i, level := range filterLevels {
+		switch level {
+		case "+":
+			matched = append(matched, topicLevels[i])
+		case "#":
+			if i < len(topicLevels) {
+				matched = append(matched, strings.Join(topicLevels[i:], "/"))
+			}
+
+			return matched
+		}
+	}
+
+	return matched
+}
+
+// HasWildcards reports whether filter contains any MQTT wildcards.
+func HasWildcards(filter string) bool {
+	return strings.ContainsAny(filter, "#+")
+}
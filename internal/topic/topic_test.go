@@ -0,0 +1,51 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"#", "sensor/a/temp", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"sensor/+/temp", "sensor/a/temp", true},
+		{"sensor/+/temp", "sensor/a/humidity", false},
+		{"sensor/+/temp", "sensor/a/b/temp", false},
+		{"sensor/+", "sensor", false},
+		{"sensor/#", "sensor", true},
+		{"sensor/#", "sensor/a/b", true},
+		{"sensor/a", "sensor/a", true},
+		{"sensor/a", "sensor/a/b", false},
+		{"sensor/a/b", "sensor/a", false},
+		{"+/+", "/a", true},
+		{"+", "", true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.want, Match(c.filter, c.topic), "Match(%q, %q)", c.filter, c.topic)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	for _, filter := range []string{"#", "+", "a/+/b", "a/#", "$SYS/#"} {
+		assert.NoError(t, ValidateFilter(filter), filter)
+	}
+
+	for _, filter := range []string{"", "a/#/b", "a/b+", "a#"} {
+		assert.Error(t, ValidateFilter(filter), filter)
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	assert.Equal(t, []string{"kitchen"}, Wildcards("home/+/status", "home/kitchen/status"))
+	assert.Equal(t, []string{"a", "b/c"}, Wildcards("+/x/#", "a/x/b/c"))
+	assert.Equal(t, []string{}, Wildcards("a/b", "a/b"))
+	assert.Nil(t, Wildcards("a/+", "b/c"))
+}
@@ -0,0 +1,72 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/d0ugal/mqtt-exporter/internal/config"
+)
+
+// Server serves the exporter's own HTTP endpoints. The promexporter server
+// owns the main port and does not accept extra routes, so these are served
+// on a separate listener. Server implements app.Collector so that the
+// application starts and stops it together with the MQTT collector.
+type Server struct {
+	config *config.WebConfig
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// NewServer creates a web server for cfg.Web
+func NewServer(cfg *config.Config) *Server {
+	return &Server{
+		config: &cfg.Web,
+		mux:    http.NewServeMux(),
+	}
+}
+
+// Handle registers the handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start starts serving in the background
+func (s *Server) Start(ctx context.Context) {
+	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	slog.Info("Starting web server", "address", addr)
+
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Web server failed", "address", addr, "error", err)
+		}
+	}()
+}
+
+// Stop gracefully shuts the server down
+func (s *Server) Stop() {
+	if s.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		slog.Error("Web server shutdown error", "error", err)
+	}
+}